@@ -0,0 +1,41 @@
+package authn
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// DefaultAPIKeyHeader is used by APIKey when no Header is set
+const DefaultAPIKeyHeader = "X-API-Key"
+
+// APIKey authenticates users with their token in a custom header
+type APIKey struct {
+	Users Users
+
+	// Header is the name of the header containing the key
+	Header string
+}
+
+func (a APIKey) Authenticate(r *http.Request) (types.Principal, bool, error) {
+	header := a.Header
+	if header == "" {
+		header = DefaultAPIKeyHeader
+	}
+
+	values, ok := r.Header[http.CanonicalHeaderKey(header)]
+	if !ok {
+		return types.Principal{}, false, nil
+	}
+	if len(values) != 1 || strings.TrimSpace(values[0]) == "" {
+		return types.Principal{}, true, ErrMalformedCredentials
+	}
+
+	userName, ok := lookupToken(a.Users, strings.TrimSpace(values[0]))
+	if !ok {
+		return types.Principal{}, true, ErrInvalidCredentials
+	}
+
+	return types.Principal{Name: userName, Authenticator: "api_key"}, true, nil
+}
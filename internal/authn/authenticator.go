@@ -0,0 +1,51 @@
+package authn
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+var (
+	// ErrMalformedCredentials is returned when credentials are present in a
+	// request but can't be parsed
+	ErrMalformedCredentials = errors.New("malformed credentials")
+
+	// ErrInvalidCredentials is returned when credentials don't identify any
+	// principal
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticator identifies the principal making a request from the
+// credentials in it
+type Authenticator interface {
+	// Authenticate returns the principal for the request. found is false when
+	// the request has no credentials of the kind the authenticator handles, so
+	// the next authenticator can be tried. err is set when the credentials are
+	// present but invalid.
+	Authenticate(r *http.Request) (principal types.Principal, found bool, err error)
+}
+
+// Users are the users that principals are authenticated as, the server uses
+// a *userstore.Store which is shared with the engines
+type Users interface {
+	Get(name string) (types.User, bool)
+	Range(f func(name string, user types.User))
+}
+
+// lookupToken finds the user with the token
+func lookupToken(users Users, token string) (userName string, found bool) {
+	users.Range(func(name string, user types.User) {
+		if !found && tokensEqual(user.Token, token) {
+			userName, found = name, true
+		}
+	})
+	return userName, found
+}
+
+// tokensEqual compares secrets in constant time
+func tokensEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,32 @@
+package authn
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// Basic authenticates users with HTTP Basic auth, the password is the user's
+// token
+type Basic struct {
+	Users Users
+}
+
+func (a Basic) Authenticate(r *http.Request) (types.Principal, bool, error) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Basic ") {
+		return types.Principal{}, false, nil
+	}
+
+	userName, password, ok := r.BasicAuth()
+	if !ok {
+		return types.Principal{}, true, ErrMalformedCredentials
+	}
+
+	user, ok := a.Users.Get(userName)
+	if !ok || user.Token == "" || !tokensEqual(user.Token, password) {
+		return types.Principal{}, true, ErrInvalidCredentials
+	}
+
+	return types.Principal{Name: userName, Authenticator: "basic"}, true, nil
+}
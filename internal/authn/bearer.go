@@ -0,0 +1,32 @@
+package authn
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// BearerToken authenticates users with their token in an
+// 'Authorization: Bearer' header
+type BearerToken struct {
+	Users Users
+}
+
+func (a BearerToken) Authenticate(r *http.Request) (types.Principal, bool, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return types.Principal{}, false, nil
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	if token == "" {
+		return types.Principal{}, true, ErrMalformedCredentials
+	}
+
+	userName, ok := lookupToken(a.Users, token)
+	if !ok {
+		return types.Principal{}, true, ErrInvalidCredentials
+	}
+
+	return types.Principal{Name: userName, Authenticator: "bearer"}, true, nil
+}
@@ -0,0 +1,126 @@
+package authn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// CertificateMapping maps client certificates to principal names, either by
+// the certificate's subject or by one of its subject alternative names
+type CertificateMapping struct {
+	// Subjects is keyed by distinguished name, e.g. CN=backup,OU=jobs,O=Example
+	Subjects map[string]string `json:"subjects"`
+
+	// SANs is keyed by DNS name, email address or URI
+	SANs map[string]string `json:"sans"`
+}
+
+// LoadCertificateMapping reads a CertificateMapping from a JSON file
+func LoadCertificateMapping(path string) (CertificateMapping, error) {
+	var mapping CertificateMapping
+
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return mapping, err
+	}
+	if err := json.Unmarshal(bytes, &mapping); err != nil {
+		return mapping, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+
+	return mapping, nil
+}
+
+// Lookup returns the principal name for a certificate, the subject is
+// checked before the SANs
+func (m CertificateMapping) Lookup(cert *x509.Certificate) (string, bool) {
+	if name, ok := m.Subjects[cert.Subject.String()]; ok {
+		return name, true
+	}
+
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		if name, ok := m.SANs[san]; ok {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// ClientCertificate authenticates callers with the client certificate they
+// presented to a TLS listener. The certificate must already have been
+// verified by the listener, see ClientCertTLSConfig.
+type ClientCertificate struct {
+	Mapping CertificateMapping
+}
+
+func (a ClientCertificate) Authenticate(r *http.Request) (types.Principal, bool, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return types.Principal{}, false, nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	name, ok := a.Mapping.Lookup(cert)
+	if !ok {
+		return types.Principal{}, true, ErrInvalidCredentials
+	}
+
+	return types.Principal{
+		Name:          name,
+		Authenticator: "client_certificate",
+		Certificate:   NewCertificate(cert),
+	}, true, nil
+}
+
+// NewCertificate copies the attributes policies can use from a certificate,
+// lists are never nil so that they're easy to use in every engine
+func NewCertificate(cert *x509.Certificate) *types.Certificate {
+	c := &types.Certificate{
+		Subject:            cert.Subject.String(),
+		CommonName:         cert.Subject.CommonName,
+		Organization:       append([]string{}, cert.Subject.Organization...),
+		OrganizationalUnit: append([]string{}, cert.Subject.OrganizationalUnit...),
+		DNSNames:           append([]string{}, cert.DNSNames...),
+		EmailAddresses:     append([]string{}, cert.EmailAddresses...),
+		URIs:               []string{},
+		Issuer:             cert.Issuer.String(),
+		SerialNumber:       cert.SerialNumber.String(),
+		NotAfter:           cert.NotAfter.UTC(),
+	}
+	for _, uri := range cert.URIs {
+		c.URIs = append(c.URIs, uri.String())
+	}
+
+	return c
+}
+
+// ClientCertTLSConfig returns a TLS config which requires clients to present
+// a certificate signed by one of the CAs in the PEM file
+func ClientCertTLSConfig(caFile string) (*tls.Config, error) {
+	bytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bytes) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,102 @@
+package authn
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/requestid"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// ActAsHeader names the user an admin wants to impersonate
+const ActAsHeader = "X-Act-As"
+
+// ImpersonationPolicy decides if the actor may act as the target user
+type ImpersonationPolicy func(r *http.Request, actor types.Principal, target string) (bool, error)
+
+// Impersonation lets principals act as another user with the X-Act-As header
+// when the engine's policy permits it. Policies are keyed by engine, the first
+// segment of the request path. While impersonating, the principal in the
+// request context is the target with the actor as its Impersonator, and each
+// request is logged with both identities.
+func Impersonation(policies map[string]ImpersonationPolicy, logger *log.Logger) mux.MiddlewareFunc {
+	if logger == nil {
+		logger = log.New(log.Writer(), "", log.LstdFlags)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			target := r.Header.Get(ActAsHeader)
+			if target == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			actor, ok := PrincipalFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			engine := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+			policy, ok := policies[engine]
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			// service accounts aren't users and can't act as them, whatever
+			// the engine's policy says about their name
+			allowed := false
+			var err error
+			if actor.Type == types.PrincipalTypeUser {
+				allowed, err = policy(r, actor, target)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			logger := requestid.Logger(logger, requestid.FromContext(r.Context()))
+			if !allowed {
+				logger.Printf("impersonation denied: %s as %s: %s %s", actor.Name, target, r.Method, r.URL.Path)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			// the actor's claims and certificate describe them, not the
+			// target, so they're not carried over. Scopes still limit what
+			// the actor's credentials can be used for.
+			principal := types.Principal{
+				Name:          target,
+				Type:          types.PrincipalTypeUser,
+				Authenticator: actor.Authenticator,
+				Impersonator:  actor.Name,
+				Risk:          actor.Risk,
+				Scopes:        actor.Scopes,
+			}
+
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r.WithContext(WithPrincipal(r.Context(), principal)))
+
+			logger.Printf("impersonation: %s as %s: %s %s %d", actor.Name, target, r.Method, r.URL.Path, recorder.status)
+		})
+	}
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	// only the first status is sent, so only it is recorded
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,271 @@
+package authn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// JWT authenticates signed JSON Web Tokens sent as 'Authorization: Bearer'
+// tokens. The subject of the token is the principal's name and the claims are
+// made available to policies.
+type JWT struct {
+	// Algorithm is the only signing algorithm accepted, one of HS256, RS256 or
+	// ES256. Tokens must say they use it, which prevents alg=none and
+	// confusing a public key for an HMAC secret.
+	Algorithm string
+
+	// Key is the []byte secret for HS256, the *rsa.PublicKey for RS256 or the
+	// *ecdsa.PublicKey for ES256
+	Key interface{}
+
+	// Issuer and Audience must match the iss and aud claims when set
+	Issuer   string
+	Audience string
+
+	// Leeway is allowed when checking exp and nbf to account for clock skew
+	Leeway time.Duration
+
+	// Now is used to check exp and nbf, time.Now is used if not set
+	Now func() time.Time
+}
+
+func (a JWT) Authenticate(r *http.Request) (types.Principal, bool, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return types.Principal{}, false, nil
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+
+	// opaque tokens are left for the BearerToken authenticator
+	if strings.Count(token, ".") != 2 {
+		return types.Principal{}, false, nil
+	}
+
+	claims, err := a.Verify(token)
+	if err != nil {
+		return types.Principal{}, true, err
+	}
+
+	return types.Principal{
+		Name:          claims["sub"].(string),
+		Authenticator: "jwt",
+		Claims:        claims,
+		Scopes:        scopesFromClaims(claims),
+	}, true, nil
+}
+
+// scopesFromClaims reads the space separated scope claim, tokens without one
+// aren't restricted and nil is returned
+func scopesFromClaims(claims map[string]interface{}) []string {
+	scope, ok := claims["scope"].(string)
+	if !ok {
+		return nil
+	}
+
+	scopes := []string{}
+	for _, s := range strings.Fields(scope) {
+		if types.IsScope(s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// Verify checks the signature and the registered claims of a token, returning
+// all the claims if it's valid
+func (a JWT) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: token must have three parts", ErrMalformedCredentials)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != a.Algorithm {
+		return nil, fmt.Errorf("%w: unexpected alg %q", ErrInvalidCredentials, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature is not base64url", ErrMalformedCredentials)
+	}
+	if err := a.verifySignature(parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := a.verifyClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (a JWT) verifySignature(signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch a.Algorithm {
+	case "HS256":
+		secret, ok := a.Key.([]byte)
+		if !ok {
+			return fmt.Errorf("HS256 requires a []byte key, got %T", a.Key)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("%w: bad signature", ErrInvalidCredentials)
+		}
+	case "RS256":
+		key, ok := a.Key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("RS256 requires an *rsa.PublicKey, got %T", a.Key)
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("%w: bad signature", ErrInvalidCredentials)
+		}
+	case "ES256":
+		key, ok := a.Key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("ES256 requires an *ecdsa.PublicKey, got %T", a.Key)
+		}
+		// the signature is the two 32 byte integers r and s concatenated
+		if len(signature) != 64 {
+			return fmt.Errorf("%w: bad signature", ErrInvalidCredentials)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return fmt.Errorf("%w: bad signature", ErrInvalidCredentials)
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", a.Algorithm)
+	}
+
+	return nil
+}
+
+func (a JWT) verifyClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	if a.Now != nil {
+		now = a.Now()
+	}
+
+	if sub, ok := claims["sub"].(string); !ok || sub == "" {
+		return fmt.Errorf("%w: missing sub", ErrInvalidCredentials)
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing exp", ErrInvalidCredentials)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(a.Leeway)) {
+		return fmt.Errorf("%w: token expired", ErrInvalidCredentials)
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(a.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return fmt.Errorf("%w: token not yet valid", ErrInvalidCredentials)
+		}
+	}
+
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return fmt.Errorf("%w: unexpected iss", ErrInvalidCredentials)
+	}
+
+	if a.Audience != "" && !audienceContains(claims["aud"], a.Audience) {
+		return fmt.Errorf("%w: unexpected aud", ErrInvalidCredentials)
+	}
+
+	return nil
+}
+
+// audienceContains handles aud being either a single string or a list
+func audienceContains(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: segment is not base64url", ErrMalformedCredentials)
+	}
+	if err := json.Unmarshal(bytes, v); err != nil {
+		return fmt.Errorf("%w: segment is not JSON", ErrMalformedCredentials)
+	}
+	return nil
+}
+
+// LoadPublicKey reads an RSA or ECDSA public key from a PEM file, either as a
+// PUBLIC KEY block or the public key of a CERTIFICATE
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q in %s", block.Type, path)
+	}
+}
+
+// LoadHMACSecret reads the secret for HS256 from a file, surrounding
+// whitespace is ignored
+func LoadHMACSecret(path string) ([]byte, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := []byte(strings.TrimSpace(string(bytes)))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("empty secret in %s", path)
+	}
+
+	return secret, nil
+}
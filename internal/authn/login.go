@@ -0,0 +1,105 @@
+package authn
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// LoginPayload is the expected body of a request to log in
+type LoginPayload struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// LoginHandler exchanges a user's password for a session. The session id is
+// returned as a token for use as a bearer token and set as a cookie.
+func LoginHandler(users Users, sessions *Sessions, cookie CookieSession) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		payloadBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var payload LoginPayload
+		err = json.Unmarshal(payloadBytes, &payload)
+		if err != nil || payload.User == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// unknown users and users without passwords are checked against a
+		// dummy hash so they can't be distinguished by timing
+		hash, known := dummyHash(), false
+		user, ok := users.Get(payload.User)
+		if ok && user.PasswordHash != "" {
+			hash, known = user.PasswordHash, true
+		}
+		if !CheckPassword(hash, payload.Password) || !known {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		id, err := sessions.Create(payload.User)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		expiresAt, _ := sessions.ExpiresAt(id)
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookie.cookieName(),
+			Value:    id,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+
+		bytes, err := json.Marshal(struct {
+			Token     string    `json:"token"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}{
+			Token:     id,
+			ExpiresAt: expiresAt.UTC(),
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(bytes)
+	}
+}
+
+// LogoutHandler ends the session used to make the request, whether it was
+// sent as a bearer token or a cookie
+func LogoutHandler(sessions *Sessions, cookie CookieSession) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := bearerSessionID(r)
+		if !ok {
+			c, err := r.Cookie(cookie.cookieName())
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			id = c.Value
+		}
+
+		if _, ok := sessions.Lookup(id); !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		sessions.Delete(id)
+
+		http.SetCookie(w, &http.Cookie{
+			Name:   cookie.cookieName(),
+			Value:  "",
+			Path:   "/",
+			MaxAge: -1,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
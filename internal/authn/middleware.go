@@ -0,0 +1,111 @@
+package authn
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+type contextKey int
+
+const principalKey contextKey = iota
+
+// WithPrincipal returns a copy of the context holding the principal
+func WithPrincipal(ctx context.Context, principal types.Principal) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// PrincipalFromContext returns the principal set by the Middleware. found is
+// false for requests without any credentials.
+func PrincipalFromContext(ctx context.Context) (principal types.Principal, found bool) {
+	principal, found = ctx.Value(principalKey).(types.Principal)
+	return principal, found
+}
+
+// Middleware tries each of the authenticators in turn and stores the first
+// principal found in the request context. Requests with invalid credentials
+// are rejected here, requests without any credentials are passed on to the
+// handlers which decide if a principal is required.
+func Middleware(authenticators ...Authenticator) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, found, err := Authenticate(r, authenticators...)
+			if err != nil {
+				var lockout *LockoutError
+				if errors.As(err, &lockout) {
+					w.Header().Set("Retry-After", retryAfter(lockout.RetryAfter))
+				}
+				w.WriteHeader(StatusCode(err))
+				return
+			}
+
+			if found {
+				// service accounts are identified as such by their
+				// authenticator, everyone else is a user
+				if principal.Type == "" {
+					principal.Type = types.PrincipalTypeUser
+				}
+
+				// only throttled authenticators know the risk
+				if principal.Risk == "" {
+					principal.Risk = types.RiskLow
+				}
+
+				// only some credentials are scoped, the rest can do anything
+				// the policies permit
+				if principal.Scopes == nil {
+					principal.Scopes = types.AllScopes
+				}
+				r = r.WithContext(WithPrincipal(r.Context(), principal))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Authenticate returns the principal from the first authenticator to find
+// credentials in the request
+func Authenticate(r *http.Request, authenticators ...Authenticator) (types.Principal, bool, error) {
+	for _, authenticator := range authenticators {
+		principal, found, err := authenticator.Authenticate(r)
+		if err != nil {
+			return types.Principal{}, true, err
+		}
+		if found {
+			return principal, true, nil
+		}
+	}
+
+	// an Authorization header that no authenticator understood is treated
+	// as a bad request, rather than ignored
+	if r.Header.Get("Authorization") != "" {
+		return types.Principal{}, true, ErrMalformedCredentials
+	}
+
+	return types.Principal{}, false, nil
+}
+
+// StatusCode returns the response code for an authentication error
+func StatusCode(err error) int {
+	var lockout *LockoutError
+	if errors.As(err, &lockout) {
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, ErrMalformedCredentials) {
+		return http.StatusBadRequest
+	}
+	return http.StatusUnauthorized
+}
+
+// retryAfter formats a wait in whole seconds for a Retry-After header,
+// rounding up so clients don't retry too soon
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
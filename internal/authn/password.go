@@ -0,0 +1,90 @@
+package authn
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters for new password hashes, the parameters are stored with
+// each hash so they can be raised without breaking existing passwords
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptKeyLen  = 32
+	scryptSaltLen = 16
+)
+
+// dummyPasswordHash is checked when a user doesn't exist so that logging in
+// as an unknown user takes as long as using the wrong password. It's only
+// computed when first needed since hashing is deliberately slow.
+var (
+	dummyPasswordHash     string
+	dummyPasswordHashOnce sync.Once
+)
+
+func dummyHash() string {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = HashPassword("dummy password")
+	})
+	return dummyPasswordHash
+}
+
+// HashPassword derives a hash of the password with scrypt and a random salt.
+// The result has the form scrypt$N$r$p$salt$hash.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, scryptSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("scrypt$%d$%d$%d$%s$%s",
+		scryptN, scryptR, scryptP,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// CheckPassword reports if the password matches a hash from HashPassword
+func CheckPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "scrypt" {
+		return false
+	}
+
+	var params [3]int
+	for i, part := range parts[1:4] {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return false
+		}
+		params[i] = n
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, params[0], params[1], params[2], len(expected))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
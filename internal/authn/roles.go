@@ -0,0 +1,26 @@
+package authn
+
+import (
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// UserRoles sets the roles of the principal from their user. It runs after
+// the Impersonation middleware, so impersonated principals have the roles of
+// the user being impersonated. Service accounts don't have roles.
+func UserRoles(users Users) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := PrincipalFromContext(r.Context())
+			if ok && principal.Type == types.PrincipalTypeUser {
+				user, _ := users.Get(principal.Name)
+				principal.Roles = user.Roles
+				r = r.WithContext(WithPrincipal(r.Context(), principal))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
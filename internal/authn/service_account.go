@@ -0,0 +1,39 @@
+package authn
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// ServiceAccountPrefix starts the token of every service account, so that
+// they can be told apart from the tokens of users
+const ServiceAccountPrefix = "sa_"
+
+// ServiceAccountToken authenticates service accounts with their token in an
+// 'Authorization: Bearer' header
+type ServiceAccountToken struct {
+	Accounts *map[string]types.ServiceAccount
+}
+
+func (a ServiceAccountToken) Authenticate(r *http.Request) (types.Principal, bool, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer "+ServiceAccountPrefix) {
+		return types.Principal{}, false, nil
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+
+	for name, account := range *a.Accounts {
+		if tokensEqual(account.Token, token) {
+			return types.Principal{
+				Name:          name,
+				Type:          types.PrincipalTypeServiceAccount,
+				Authenticator: "service_account",
+				Grants:        account.Grants,
+			}, true, nil
+		}
+	}
+
+	return types.Principal{}, true, ErrInvalidCredentials
+}
@@ -0,0 +1,165 @@
+package authn
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// DefaultSessionCookie is used by CookieSession when no Cookie is set
+const DefaultSessionCookie = "session"
+
+// DefaultSessionTTL is how long a session lasts without being used
+const DefaultSessionTTL = 30 * time.Minute
+
+// SessionPrefix starts every session id, so that they can be told apart from
+// other bearer tokens
+const SessionPrefix = "ds_"
+
+type session struct {
+	userName  string
+	expiresAt time.Time
+}
+
+// Sessions is an in-memory store of session ids to userNames. Sessions have a
+// sliding expiry, each use extends them by the TTL.
+type Sessions struct {
+	mu       sync.Mutex
+	sessions map[string]session
+
+	// TTL is how long a session lasts after it was last used
+	TTL time.Duration
+
+	// Now is used for session expiry, time.Now is used if not set
+	Now func() time.Time
+}
+
+// NewSessions creates an empty session store
+func NewSessions() *Sessions {
+	return &Sessions{
+		sessions: make(map[string]session),
+		TTL:      DefaultSessionTTL,
+	}
+}
+
+func (s *Sessions) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// Create starts a new session for the user and returns its id
+func (s *Sessions) Create(userName string) (string, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	id := SessionPrefix + secret
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = session{userName: userName, expiresAt: s.now().Add(s.TTL)}
+
+	return id, nil
+}
+
+// Lookup returns the userName for a session id and extends the session.
+// Expired sessions are deleted and not found.
+func (s *Sessions) Lookup(id string) (userName string, found bool) {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, found := s.sessions[id]
+	if !found {
+		return "", false
+	}
+	if !now.Before(sess.expiresAt) {
+		delete(s.sessions, id)
+		return "", false
+	}
+
+	sess.expiresAt = now.Add(s.TTL)
+	s.sessions[id] = sess
+
+	return sess.userName, true
+}
+
+// ExpiresAt returns when a session will expire if it's not used again
+func (s *Sessions) ExpiresAt(id string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, found := s.sessions[id]
+	return sess.expiresAt, found
+}
+
+// Delete ends a session
+func (s *Sessions) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+}
+
+// CookieSession authenticates users with a session id in a cookie
+type CookieSession struct {
+	Sessions *Sessions
+
+	// Cookie is the name of the cookie containing the session id
+	Cookie string
+}
+
+func (a CookieSession) Authenticate(r *http.Request) (types.Principal, bool, error) {
+	cookie, err := r.Cookie(a.cookieName())
+	if err != nil {
+		return types.Principal{}, false, nil
+	}
+
+	userName, ok := a.Sessions.Lookup(cookie.Value)
+	if !ok {
+		return types.Principal{}, true, ErrInvalidCredentials
+	}
+
+	return types.Principal{Name: userName, Authenticator: "cookie_session"}, true, nil
+}
+
+func (a CookieSession) cookieName() string {
+	if a.Cookie == "" {
+		return DefaultSessionCookie
+	}
+	return a.Cookie
+}
+
+// BearerSession authenticates users with a session id sent as an
+// 'Authorization: Bearer' token
+type BearerSession struct {
+	Sessions *Sessions
+}
+
+func (a BearerSession) Authenticate(r *http.Request) (types.Principal, bool, error) {
+	id, ok := bearerSessionID(r)
+	if !ok {
+		return types.Principal{}, false, nil
+	}
+
+	userName, ok := a.Sessions.Lookup(id)
+	if !ok {
+		return types.Principal{}, true, ErrInvalidCredentials
+	}
+
+	return types.Principal{Name: userName, Authenticator: "bearer_session"}, true, nil
+}
+
+func bearerSessionID(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer "+SessionPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")), true
+}
@@ -0,0 +1,365 @@
+package authn
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// Defaults used by a Throttle when its fields aren't set
+const (
+	DefaultBaseDelay       = time.Second
+	DefaultMaxDelay        = time.Minute
+	DefaultLockoutFailures = 10
+	DefaultLockoutDuration = 15 * time.Minute
+	DefaultFailureWindow   = 15 * time.Minute
+	DefaultRiskFailures    = 3
+)
+
+// LockoutError is returned when a client or user has failed to authenticate
+// too many times and must wait before trying again
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("too many failed attempts, retry after %s", e.RetryAfter)
+}
+
+// Failures is the record of recent failed attempts to authenticate for a
+// client IP or a claimed user
+type Failures struct {
+	Count       int
+	LastFailure time.Time
+}
+
+// FailureStore holds the failure counters for a Throttle, keyed by client IP
+// or claimed user. NewThrottle uses a MemoryFailureStore, other backends could
+// share the counters between servers. Failures are forgotten once they've
+// been kept for the TTL given when they were last counted.
+type FailureStore interface {
+	// Get returns the failures of the key, unless they've been forgotten
+	Get(key string, now time.Time) (Failures, bool)
+
+	// Increment counts a failure of the key at now and returns its failures
+	// from before and after it. It's atomic, so that concurrent failures are
+	// all counted. The failures are kept for the TTL of their new count.
+	Increment(key string, now time.Time, ttl func(count int) time.Duration) (before, after Failures)
+
+	Delete(key string)
+}
+
+// memoryPruneInterval is how often a MemoryFailureStore forgets the failures
+// which have expired, rather than on each failure
+const memoryPruneInterval = time.Minute
+
+// MemoryFailureStore is an in-memory FailureStore
+type MemoryFailureStore struct {
+	mu       sync.Mutex
+	failures map[string]expiringFailures
+	pruned   time.Time
+}
+
+type expiringFailures struct {
+	Failures
+	expires time.Time
+}
+
+// NewMemoryFailureStore creates an empty MemoryFailureStore
+func NewMemoryFailureStore() *MemoryFailureStore {
+	return &MemoryFailureStore{failures: make(map[string]expiringFailures)}
+}
+
+func (s *MemoryFailureStore) Get(key string, now time.Time) (Failures, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failures, ok := s.failures[key]
+	if !ok || !now.Before(failures.expires) {
+		return Failures{}, false
+	}
+	return failures.Failures, true
+}
+
+func (s *MemoryFailureStore) Increment(key string, now time.Time, ttl func(count int) time.Duration) (before, after Failures) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(now)
+
+	if failures, ok := s.failures[key]; ok && now.Before(failures.expires) {
+		before = failures.Failures
+	}
+	after = Failures{Count: before.Count + 1, LastFailure: now}
+	s.failures[key] = expiringFailures{Failures: after, expires: now.Add(ttl(after.Count))}
+	return before, after
+}
+
+func (s *MemoryFailureStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, key)
+}
+
+// Len returns the number of keys with failures kept, which includes those
+// that have expired but haven't been pruned yet
+func (s *MemoryFailureStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.failures)
+}
+
+// prune forgets the failures which have expired, so that keys which fail
+// once, like random user names, aren't kept forever. It's called with the
+// store locked.
+func (s *MemoryFailureStore) prune(now time.Time) {
+	if now.Sub(s.pruned) < memoryPruneInterval {
+		return
+	}
+	s.pruned = now
+
+	for key, failures := range s.failures {
+		if !now.Before(failures.expires) {
+			delete(s.failures, key)
+		}
+	}
+}
+
+// Throttle counts failed attempts to authenticate by client IP and by claimed
+// user. After each failure the next attempt must wait twice as long as the
+// last, up to MaxDelay, and after LockoutFailures the key is locked out for
+// LockoutDuration.
+type Throttle struct {
+	Store FailureStore
+
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutFailures int
+	LockoutDuration time.Duration
+
+	// FailureWindow is how long failures are remembered for after the last
+	// one
+	FailureWindow time.Duration
+
+	// RiskFailures is the number of recent failures after which successful
+	// attempts are given types.RiskElevated
+	RiskFailures int
+
+	// Now is used for failure times, time.Now is used if not set
+	Now func() time.Time
+}
+
+// NewThrottle creates a Throttle with an in-memory store and the defaults
+func NewThrottle() *Throttle {
+	return &Throttle{Store: NewMemoryFailureStore()}
+}
+
+// Wait returns how long is left before another attempt is allowed for any of
+// the keys, because of either the backoff or a lockout
+func (t *Throttle) Wait(keys ...string) (wait time.Duration) {
+	now := t.now()
+	for _, key := range keys {
+		failures, ok := t.Store.Get(key, now)
+		if !ok {
+			continue
+		}
+
+		if d := t.until(failures).Sub(now); d > wait {
+			wait = d
+		}
+	}
+
+	return wait
+}
+
+// Fail records a failed attempt against each of the keys. It returns how long
+// was left to wait when the attempt was made, which is decided from the
+// failures counted before it so that concurrent attempts can't all see no
+// wait.
+func (t *Throttle) Fail(keys ...string) (wait time.Duration) {
+	now := t.now()
+	for _, key := range keys {
+		before, _ := t.Store.Increment(key, now, t.ttl)
+		if before.Count == 0 {
+			continue
+		}
+
+		if d := t.until(before).Sub(now); d > wait {
+			wait = d
+		}
+	}
+
+	return wait
+}
+
+// Reset forgets the failures of a key, e.g. once a user has authenticated
+func (t *Throttle) Reset(key string) {
+	t.Store.Delete(key)
+}
+
+// Risk is types.RiskElevated when any of the keys have had RiskFailures
+// recent failures
+func (t *Throttle) Risk(keys ...string) string {
+	now := t.now()
+	for _, key := range keys {
+		failures, ok := t.Store.Get(key, now)
+		if ok && failures.Count >= t.riskFailures() {
+			return types.RiskElevated
+		}
+	}
+	return types.RiskLow
+}
+
+// until is when another attempt is allowed after the failures, because of
+// either the backoff or a lockout
+func (t *Throttle) until(failures Failures) time.Time {
+	if failures.Count >= t.lockoutFailures() {
+		return failures.LastFailure.Add(t.lockoutDuration())
+	}
+	return failures.LastFailure.Add(t.delay(failures.Count))
+}
+
+// ttl is how long failures are remembered for after the last one, lockouts
+// are kept for at least as long as they last
+func (t *Throttle) ttl(count int) time.Duration {
+	window := t.failureWindow()
+	if count >= t.lockoutFailures() && t.lockoutDuration() > window {
+		window = t.lockoutDuration()
+	}
+	return window
+}
+
+// delay is the exponential backoff after a number of failures
+func (t *Throttle) delay(count int) time.Duration {
+	delay := float64(t.baseDelay()) * math.Pow(2, float64(count-1))
+	if delay > float64(t.maxDelay()) {
+		return t.maxDelay()
+	}
+	return time.Duration(delay)
+}
+
+func (t *Throttle) now() time.Time {
+	if t.Now != nil {
+		return t.Now()
+	}
+	return time.Now()
+}
+
+func (t *Throttle) baseDelay() time.Duration {
+	if t.BaseDelay > 0 {
+		return t.BaseDelay
+	}
+	return DefaultBaseDelay
+}
+
+func (t *Throttle) maxDelay() time.Duration {
+	if t.MaxDelay > 0 {
+		return t.MaxDelay
+	}
+	return DefaultMaxDelay
+}
+
+func (t *Throttle) lockoutFailures() int {
+	if t.LockoutFailures > 0 {
+		return t.LockoutFailures
+	}
+	return DefaultLockoutFailures
+}
+
+func (t *Throttle) lockoutDuration() time.Duration {
+	if t.LockoutDuration > 0 {
+		return t.LockoutDuration
+	}
+	return DefaultLockoutDuration
+}
+
+func (t *Throttle) failureWindow() time.Duration {
+	if t.FailureWindow > 0 {
+		return t.FailureWindow
+	}
+	return DefaultFailureWindow
+}
+
+func (t *Throttle) riskFailures() int {
+	if t.RiskFailures > 0 {
+		return t.RiskFailures
+	}
+	return DefaultRiskFailures
+}
+
+// Throttled wraps authenticators with a Throttle. Invalid credentials count
+// as a failure for the client IP and the claimed user, and while either must
+// wait further failures are refused with a LockoutError saying for how long.
+// The throttle is only consulted when credentials are presented, so requests
+// without any aren't refused, and valid credentials are always accepted since
+// clients and users are shared by many callers. Their recent failures are
+// given to the policies as the principal's risk instead.
+type Throttled struct {
+	Throttle       *Throttle
+	Authenticators []Authenticator
+}
+
+func (a Throttled) Authenticate(r *http.Request) (types.Principal, bool, error) {
+	principal, found, err := Authenticate(r, a.Authenticators...)
+	if err == nil && !found {
+		return principal, false, nil
+	}
+
+	ipKey := "ip:" + clientIP(r)
+	keys := []string{ipKey}
+	userKey := ""
+	if user := claimedUser(r); user != "" {
+		userKey = "user:" + user
+		keys = append(keys, userKey)
+	}
+
+	if errors.Is(err, ErrInvalidCredentials) {
+		// failures while waiting still count, so the wait keeps growing for
+		// clients which don't back off
+		if a.Throttle.Fail(keys...) > 0 {
+			return types.Principal{}, true, &LockoutError{RetryAfter: a.Throttle.Wait(keys...)}
+		}
+		return principal, found, err
+	}
+	if err != nil {
+		return principal, found, err
+	}
+
+	// the failures before this success are a signal for the policies. The
+	// user has proven who they are so their counter is reset, but not the
+	// client's since it may be guessing for other users too.
+	principal.Risk = a.Throttle.Risk(keys...)
+	if userKey != "" {
+		a.Throttle.Reset(userKey)
+	}
+
+	return principal, true, nil
+}
+
+// clientIP is the address the request came from, forwarding headers aren't
+// trusted since they're set by the client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// claimedUser is the user named in the credentials, before they've been
+// checked. Only Basic auth credentials name a user.
+func claimedUser(r *http.Request) string {
+	userName, _, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+	return userName
+}
@@ -0,0 +1,172 @@
+package authn
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// TokenPrefix starts the secret of every issued token, so that they can be
+// told apart from the static tokens of users
+const TokenPrefix = "dt_"
+
+// Tokens is an in-memory store of issued tokens
+type Tokens struct {
+	mu sync.Mutex
+
+	// tokens is keyed by the token ID
+	tokens map[string]types.Token
+
+	// Now is used for token times, time.Now is used if not set
+	Now func() time.Time
+}
+
+// NewTokens creates an empty token store
+func NewTokens() *Tokens {
+	return &Tokens{tokens: make(map[string]types.Token)}
+}
+
+func (t *Tokens) now() time.Time {
+	if t.Now != nil {
+		return t.Now()
+	}
+	return time.Now()
+}
+
+// Issue creates a new token for a user, restricted to the scopes, and returns
+// it along with its secret. The secret is not stored and can't be retrieved
+// later.
+func (t *Tokens) Issue(userName, name string, scopes []string, ttl time.Duration) (types.Token, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return types.Token{}, "", err
+	}
+	secretBytes, err := randomHex(32)
+	if err != nil {
+		return types.Token{}, "", err
+	}
+	secret := TokenPrefix + secretBytes
+
+	now := t.now().UTC()
+	token := types.Token{
+		ID:         id,
+		User:       userName,
+		Name:       name,
+		Scopes:     scopes,
+		SecretHash: hashSecret(secret),
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens[id] = token
+
+	return token, secret, nil
+}
+
+// Get returns a token by ID
+func (t *Tokens) Get(id string) (types.Token, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	token, ok := t.tokens[id]
+	return token, ok
+}
+
+// All returns every token, oldest first. Callers decide which tokens can be
+// seen by whom.
+func (t *Tokens) All() []types.Token {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tokens := make([]types.Token, 0, len(t.tokens))
+	for _, token := range t.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].ID < tokens[j].ID
+		}
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+
+	return tokens
+}
+
+// Revoke deletes a token, it can't be used from then on
+func (t *Tokens) Revoke(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.tokens, id)
+}
+
+// Use finds the unexpired token with the secret and records that it has been
+// used
+func (t *Tokens) Use(secret string) (types.Token, bool) {
+	hash := hashSecret(secret)
+	now := t.now().UTC()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, token := range t.tokens {
+		if !tokensEqual(token.SecretHash, hash) {
+			continue
+		}
+		if !now.Before(token.ExpiresAt) {
+			return types.Token{}, false
+		}
+		token.LastUsedAt = now
+		t.tokens[id] = token
+		return token, true
+	}
+
+	return types.Token{}, false
+}
+
+// IssuedToken authenticates users with tokens from a Tokens store in an
+// 'Authorization: Bearer' header
+type IssuedToken struct {
+	Tokens *Tokens
+}
+
+func (a IssuedToken) Authenticate(r *http.Request) (types.Principal, bool, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer "+TokenPrefix) {
+		return types.Principal{}, false, nil
+	}
+	secret := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+
+	token, ok := a.Tokens.Use(secret)
+	if !ok {
+		return types.Principal{}, true, ErrInvalidCredentials
+	}
+
+	return types.Principal{
+		Name:          token.User,
+		Authenticator: "issued_token",
+		Scopes:        token.Scopes,
+	}, true, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
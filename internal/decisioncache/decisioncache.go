@@ -0,0 +1,203 @@
+package decisioncache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/metrics"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// DefaultSize is the number of decisions the server caches unless configured
+const DefaultSize = 10000
+
+// version is the version of the data and policies decisions are made with,
+// it's increased whenever either changes
+var version uint64
+
+// Version returns the current data and policy version
+func Version() uint64 {
+	return atomic.LoadUint64(&version)
+}
+
+// Invalidate increases the data and policy version, decisions cached before
+// then are no longer used. It's called whenever a policy is compiled, and by
+// the users and entries stores whenever the data policies use is changed,
+// which is only done through them.
+func Invalidate() {
+	atomic.AddUint64(&version, 1)
+}
+
+// Key identifies a check, decisions are only reused for identical checks made
+// with the same version of the data and policies
+type Key struct {
+	Engine string
+
+	// Principal is a digest of the principal, so that checks made with
+	// different roles, scopes or claims aren't confused
+	Principal string
+
+	Action   string
+	Resource string
+	Version  uint64
+}
+
+// NewKey creates the key for the principal performing the action on the
+// resource with the current version of the data and policies
+func NewKey(engine string, principal types.Principal, action, resource string) Key {
+	return Key{
+		Engine:    engine,
+		Principal: digest(principal),
+		Action:    action,
+		Resource:  resource,
+		Version:   Version(),
+	}
+}
+
+func digest(principal types.Principal) string {
+	bytes, err := json.Marshal(principal)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(bytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// Cache keeps the most recently used decisions, the least recently used is
+// evicted once it's full
+type Cache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[Key]*list.Element
+	order   *list.List
+
+	hits   *metrics.Counter
+	misses *metrics.Counter
+}
+
+type entry struct {
+	key     Key
+	allowed bool
+	reason  string
+}
+
+// New creates a Cache of up to size decisions, its hits and misses are counted
+// in the registry. A size of zero or less caches nothing.
+func New(size int, registry *metrics.Registry) *Cache {
+	return &Cache{
+		size:    size,
+		entries: make(map[Key]*list.Element),
+		order:   list.New(),
+		hits: registry.NewCounter(
+			"authz_decision_cache_hits_total",
+			"Number of authorization decisions taken from the cache.",
+			"engine",
+		),
+		misses: registry.NewCounter(
+			"authz_decision_cache_misses_total",
+			"Number of authorization decisions which weren't cached and were evaluated.",
+			"engine",
+		),
+	}
+}
+
+// Check returns the cached decision for the key and the reason the policy
+// gave for it, or evaluates it with eval and caches the result. Errors aren't
+// cached.
+func (c *Cache) Check(key Key, eval func() (bool, string, error)) (bool, string, error) {
+	if cached, ok := c.get(key); ok {
+		c.hits.Inc(key.Engine)
+		return cached.allowed, cached.reason, nil
+	}
+	c.misses.Inc(key.Engine)
+
+	allowed, reason, err := eval()
+	if err != nil {
+		return false, "", err
+	}
+	c.put(key, allowed, reason)
+	return allowed, reason, nil
+}
+
+// Len returns the number of decisions in the cache
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *Cache) get(key Key) (entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return entry{}, false
+	}
+	c.order.MoveToFront(element)
+	return *element.Value.(*entry), true
+}
+
+func (c *Cache) put(key Key, allowed bool, reason string) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*entry).allowed = allowed
+		element.Value.(*entry).reason = reason
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&entry{key: key, allowed: allowed, reason: reason})
+
+	// decisions of old versions are never hit again, so they're the first to
+	// be evicted as they're left at the back
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+	}
+}
+
+type contextKey int
+
+const cacheKey contextKey = iota
+
+// WithCache returns a copy of the context holding the cache
+func WithCache(ctx context.Context, c *Cache) context.Context {
+	return context.WithValue(ctx, cacheKey, c)
+}
+
+// Middleware makes the cache available to the handlers, checks made without
+// one are always evaluated
+func Middleware(c *Cache) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithCache(r.Context(), c)))
+		})
+	}
+}
+
+// Check uses the cache in the context for the check, if there is one.
+// Otherwise the check is evaluated with eval.
+func Check(ctx context.Context, key Key, eval func() (bool, string, error)) (bool, string, error) {
+	c, ok := ctx.Value(cacheKey).(*Cache)
+	if !ok {
+		return eval()
+	}
+	return c.Check(key, eval)
+}
@@ -0,0 +1,333 @@
+package decisions
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditGenesis is the previous hash of the first record in an audit log
+var AuditGenesis = "hmac-sha256:" + strings.Repeat("0", 64)
+
+// AuditRecord is a line of an audit log. Its hash covers the sequence number,
+// the hash of the record before it and the decision exactly as written, so
+// editing, removing or reordering records breaks the chain. The hashes are
+// HMACs keyed with a secret which the log's readers don't have, so that the
+// chain can't be recomputed after editing it.
+type AuditRecord struct {
+	Seq      int64           `json:"seq"`
+	PrevHash string          `json:"prev_hash"`
+	Decision json.RawMessage `json:"decision"`
+	Hash     string          `json:"hash"`
+}
+
+// AuditCheckpoint is the head of an audit log at some point, it's kept apart
+// from the log so that dropping records from the end can be detected too. Its
+// MAC is keyed like the records' hashes, so that it can't be moved back to an
+// earlier record.
+type AuditCheckpoint struct {
+	Seq       int64     `json:"seq"`
+	Hash      string    `json:"hash"`
+	Timestamp time.Time `json:"timestamp"`
+	MAC       string    `json:"mac"`
+}
+
+// auditHash is the hash of a record with the given fields
+func auditHash(key []byte, seq int64, prevHash string, decision []byte) string {
+	h := hmac.New(sha256.New, key)
+	fmt.Fprintf(h, "%d\n%s\n", seq, prevHash)
+	h.Write(decision)
+	return "hmac-sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// checkpointMAC is the MAC of a checkpoint with the given fields
+func checkpointMAC(key []byte, checkpoint AuditCheckpoint) string {
+	h := hmac.New(sha256.New, key)
+	fmt.Fprintf(h, "checkpoint\n%d\n%s\n%s", checkpoint.Seq, checkpoint.Hash, checkpoint.Timestamp.Format(time.RFC3339Nano))
+	return "hmac-sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// LoadAuditKey reads the secret an audit log's chain is keyed with from a
+// file, surrounding whitespace is ignored
+func LoadAuditKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, errors.New("audit log key is empty")
+	}
+	return key, nil
+}
+
+// AuditLog writes each decision to a file as a hash chained record. The head
+// of the chain is written to a checkpoint file every checkpointEvery records
+// and when the log is closed. The file isn't rotated since the chain would
+// then span files.
+type AuditLog struct {
+	mu sync.Mutex
+
+	key             []byte
+	path            string
+	checkpointPath  string
+	checkpointEvery int64
+
+	file      *os.File
+	seq       int64
+	head      string
+	unchecked int64
+
+	// Now is used for checkpoint times, time.Now is used if not set
+	Now func() time.Time
+}
+
+// NewAuditLog opens the audit log at path for appending decisions, with its
+// checkpoint at path.checkpoint and its chain keyed with key. An existing log
+// is verified first and the chain continues from its last record, it won't be
+// appended to if broken.
+func NewAuditLog(path string, key []byte, checkpointEvery int64) (*AuditLog, error) {
+	if len(key) == 0 {
+		return nil, errors.New("audit log key is required")
+	}
+
+	a := &AuditLog{
+		key:             key,
+		path:            path,
+		checkpointPath:  CheckpointPath(path),
+		checkpointEvery: checkpointEvery,
+		head:            AuditGenesis,
+	}
+
+	checkpoint, err := LoadAuditCheckpoint(a.checkpointPath)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := os.Open(path)
+	if err == nil {
+		report, err := VerifyAudit(existing, key, checkpoint)
+		existing.Close()
+		if err != nil {
+			return nil, fmt.Errorf("existing audit log is broken: %s", err)
+		}
+		a.seq, a.head = report.Records, report.Head
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if checkpoint != nil {
+		return nil, fmt.Errorf("audit log is missing but has a checkpoint at record %d", checkpoint.Seq)
+	}
+
+	a.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) Write(decision Decision) error {
+	raw, err := json.Marshal(decision)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	record := AuditRecord{Seq: a.seq + 1, PrevHash: a.head, Decision: raw}
+	record.Hash = auditHash(a.key, record.Seq, record.PrevHash, raw)
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// the chain only moves on once the record is written, so a failed write
+	// doesn't leave a gap
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	a.seq, a.head = record.Seq, record.Hash
+	a.unchecked++
+
+	if a.checkpointEvery > 0 && a.unchecked >= a.checkpointEvery {
+		return a.checkpoint()
+	}
+	return nil
+}
+
+// Close writes a final checkpoint and closes the file
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.unchecked > 0 {
+		if err := a.checkpoint(); err != nil {
+			a.file.Close()
+			return err
+		}
+	}
+	return a.file.Close()
+}
+
+// checkpoint syncs the log and replaces the checkpoint file with its head
+func (a *AuditLog) checkpoint() error {
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+
+	now := time.Now
+	if a.Now != nil {
+		now = a.Now
+	}
+	checkpoint := AuditCheckpoint{Seq: a.seq, Hash: a.head, Timestamp: now().UTC()}
+	checkpoint.MAC = checkpointMAC(a.key, checkpoint)
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	// written beside the checkpoint and renamed over it so that it's never
+	// left half written
+	tmp, err := ioutil.TempFile(filepath.Dir(a.checkpointPath), filepath.Base(a.checkpointPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), a.checkpointPath); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	a.unchecked = 0
+	return nil
+}
+
+// CheckpointPath is where the checkpoint of the audit log at path is kept
+func CheckpointPath(path string) string {
+	return path + ".checkpoint"
+}
+
+// LoadAuditCheckpoint reads the checkpoint at path, it's nil if there isn't
+// one yet
+func LoadAuditCheckpoint(path string) (*AuditCheckpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoint AuditCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse audit checkpoint: %s", err)
+	}
+	return &checkpoint, nil
+}
+
+// AuditReport describes an audit log which was verified
+type AuditReport struct {
+	Records int64
+	Head    string
+}
+
+// BrokenLinkError is the first place an audit log's chain is broken. Line is
+// 0 when the log ends before its checkpoint.
+type BrokenLinkError struct {
+	Line   int
+	Seq    int64
+	Reason string
+}
+
+func (e *BrokenLinkError) Error() string {
+	if e.Line == 0 {
+		return e.Reason
+	}
+	return fmt.Sprintf("line %d (record %d): %s", e.Line, e.Seq, e.Reason)
+}
+
+// VerifyAudit walks the records of an audit log checking each links to the
+// one before it with the key, and that the log reaches the checkpoint if there
+// is one. The first broken link is returned as a *BrokenLinkError.
+func VerifyAudit(r io.Reader, key []byte, checkpoint *AuditCheckpoint) (AuditReport, error) {
+	report := AuditReport{Head: AuditGenesis}
+	checkpointSeen := checkpoint == nil || checkpoint.Seq == 0
+
+	if checkpoint != nil && !hmac.Equal([]byte(checkpoint.MAC), []byte(checkpointMAC(key, *checkpoint))) {
+		return report, &BrokenLinkError{Seq: checkpoint.Seq, Reason: fmt.Sprintf("checkpoint at record %d doesn't match its MAC", checkpoint.Seq)}
+	}
+
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		raw, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(raw) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return report, err
+		}
+
+		seq := report.Records + 1
+		broken := func(format string, v ...interface{}) (AuditReport, error) {
+			return report, &BrokenLinkError{Line: line, Seq: seq, Reason: fmt.Sprintf(format, v...)}
+		}
+
+		if err == io.EOF {
+			return broken("record isn't terminated by a newline")
+		}
+
+		var record AuditRecord
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&record); err != nil {
+			return broken("invalid record: %s", err)
+		}
+		if record.Seq != seq {
+			return broken("sequence number is %d", record.Seq)
+		}
+		if record.PrevHash != report.Head {
+			return broken("previous hash %s doesn't match %s", record.PrevHash, report.Head)
+		}
+		if hash := auditHash(key, record.Seq, record.PrevHash, record.Decision); !hmac.Equal([]byte(record.Hash), []byte(hash)) {
+			return broken("hash %s doesn't match the record's contents", record.Hash)
+		}
+
+		if checkpoint != nil && record.Seq == checkpoint.Seq {
+			if record.Hash != checkpoint.Hash {
+				return broken("hash %s doesn't match the checkpoint %s", record.Hash, checkpoint.Hash)
+			}
+			checkpointSeen = true
+		}
+
+		report.Records, report.Head = record.Seq, record.Hash
+	}
+
+	if !checkpointSeen {
+		return report, &BrokenLinkError{
+			Seq:    report.Records + 1,
+			Reason: fmt.Sprintf("log ends at record %d before the checkpoint at record %d", report.Records, checkpoint.Seq),
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,234 @@
+package decisions
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/requestid"
+	"github.com/charlieegan3/go-authz-dsls/internal/tracing"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// Results of a decision
+const (
+	ResultAllow = "allow"
+	ResultDeny  = "deny"
+	ResultError = "error"
+)
+
+// Decision is the record of a single authorization decision made by one of
+// the engines
+type Decision struct {
+	Timestamp time.Time `json:"timestamp"`
+	Engine    string    `json:"engine"`
+	Principal string    `json:"principal"`
+
+	// RequestID identifies the request the decision was made for, it's also
+	// in the request's logs and error response
+	RequestID string `json:"request_id,omitempty"`
+
+	// Endpoint is the route template of the request the decision was made
+	// for, e.g. /golang/entries/{entryID}
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Impersonator is the admin acting as the principal, if any
+	Impersonator string `json:"impersonator,omitempty"`
+
+	// Action is what the principal attempted, e.g. read_entry
+	Action string `json:"action"`
+
+	// Resource is what the action was on, e.g. entries/1
+	Resource string `json:"resource"`
+
+	// InputDigest is the SHA-256 of the JSON input to the policy, so the
+	// decision can be matched to its input without recording the data
+	InputDigest string `json:"input_digest"`
+
+	Result string `json:"result"`
+
+	// Reason is the rule which permitted the action, the requirement which
+	// wasn't met or the error evaluating the policy, e.g. owner
+	Reason string `json:"reason"`
+
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// Sink receives every decision recorded in a Log
+type Sink interface {
+	Write(decision Decision) error
+}
+
+// Log sends each decision to all of its sinks
+type Log struct {
+	sinks []Sink
+
+	// Now is used for decision times, time.Now is used if not set
+	Now func() time.Time
+
+	// Logger gets errors from the sinks, the standard logger is used if
+	// not set
+	Logger *log.Logger
+}
+
+// NewLog creates a Log writing to the sinks
+func NewLog(sinks ...Sink) *Log {
+	return &Log{sinks: sinks}
+}
+
+// Record writes the decision to each of the sinks. A failing sink doesn't
+// stop the others or the request, but is logged.
+func (l *Log) Record(decision Decision) {
+	for _, sink := range l.sinks {
+		if err := sink.Write(decision); err != nil {
+			requestid.Logger(l.logger(), decision.RequestID).Printf("failed to record decision: %s", err)
+		}
+	}
+}
+
+func (l *Log) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+func (l *Log) logger() *log.Logger {
+	if l.Logger != nil {
+		return l.Logger
+	}
+	return log.New(log.Writer(), "", log.LstdFlags)
+}
+
+type contextKey int
+
+const (
+	logKey contextKey = iota
+	endpointKey
+)
+
+// WithLog returns a copy of the context holding the decision log
+func WithLog(ctx context.Context, l *Log) context.Context {
+	return context.WithValue(ctx, logKey, l)
+}
+
+// Middleware makes the decision log available to the handlers, decisions
+// made without one aren't recorded. Decisions are given the route template of
+// the request as their endpoint.
+func Middleware(l *Log) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithLog(r.Context(), l)
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					ctx = context.WithValue(ctx, endpointKey, template)
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Pending is a decision which is being made, it's recorded when finished
+type Pending struct {
+	log      *Log
+	decision Decision
+	start    time.Time
+	span     *tracing.Span
+}
+
+// Start begins a decision for the principal to perform the action on the
+// resource. input is what's given to the policy, only its digest is kept. The
+// evaluation has a span of its own when the request is being traced.
+func Start(ctx context.Context, engine string, principal types.Principal, action, resource string, input interface{}) *Pending {
+	_, span := tracing.StartSpan(ctx, "policy.evaluate")
+	span.SetAttribute("authz.engine", engine)
+	span.SetAttribute("authz.action", action)
+	span.SetAttribute("authz.resource", resource)
+
+	l, ok := ctx.Value(logKey).(*Log)
+	if !ok {
+		return &Pending{span: span}
+	}
+
+	endpoint, _ := ctx.Value(endpointKey).(string)
+
+	return &Pending{
+		log: l,
+		decision: Decision{
+			Engine:       engine,
+			Principal:    principal.Name,
+			RequestID:    requestid.FromContext(ctx),
+			Endpoint:     endpoint,
+			Impersonator: principal.Impersonator,
+			Action:       action,
+			Resource:     resource,
+			InputDigest:  digest(input),
+		},
+		start: l.now(),
+		span:  span,
+	}
+}
+
+// Finish records the result of the decision with the reason the policy gave
+// for it, i.e. the rule which permitted it or the requirement which wasn't
+// met. err is set when the policy couldn't be evaluated, it's recorded as the
+// reason instead.
+func (p *Pending) Finish(allowed bool, reason string, err error) {
+	switch {
+	case err != nil:
+		p.finish(ResultError, err.Error())
+	case allowed:
+		p.finish(ResultAllow, reason)
+	default:
+		p.finish(ResultDeny, reason)
+	}
+}
+
+func (p *Pending) finish(result, reason string) {
+	p.span.SetAttribute("authz.result", result)
+	p.span.End()
+
+	if p.log == nil {
+		return
+	}
+
+	now := p.log.now()
+	decision := p.decision
+	decision.Timestamp = now.UTC()
+	decision.Result = result
+	decision.Reason = reason
+	decision.LatencyMS = float64(now.Sub(p.start)) / float64(time.Millisecond)
+
+	p.log.Record(decision)
+}
+
+func digest(input interface{}) string {
+	bytes, err := json.Marshal(input)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(bytes)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// ImpersonationPolicy is an authn.ImpersonationPolicy which also gives the
+// reason for its decision
+type ImpersonationPolicy func(r *http.Request, actor types.Principal, target string) (allowed bool, reason string, err error)
+
+// RecordImpersonation wraps an engine's impersonation policy so that its
+// decisions are recorded like those of the handlers
+func RecordImpersonation(engine string, policy ImpersonationPolicy) authn.ImpersonationPolicy {
+	return func(r *http.Request, actor types.Principal, target string) (bool, error) {
+		decision := Start(r.Context(), engine, actor, "impersonate", "users/"+target, []interface{}{actor, target})
+		allowed, reason, err := policy(r, actor, target)
+		decision.Finish(allowed, reason, err)
+		return allowed, err
+	}
+}
@@ -0,0 +1,73 @@
+package decisions
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+)
+
+// Ring keeps the most recent decisions in memory
+type Ring struct {
+	mu        sync.Mutex
+	decisions []Decision
+	next      int
+	full      bool
+}
+
+// NewRing creates a Ring holding up to size decisions
+func NewRing(size int) *Ring {
+	return &Ring{decisions: make([]Decision, size)}
+}
+
+func (r *Ring) Write(decision Decision) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.decisions) == 0 {
+		return nil
+	}
+
+	r.decisions[r.next] = decision
+	r.next = (r.next + 1) % len(r.decisions)
+	if r.next == 0 {
+		r.full = true
+	}
+	return nil
+}
+
+// Decisions returns the decisions in the ring, oldest first
+func (r *Ring) Decisions() []Decision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]Decision{}, r.decisions[:r.next]...)
+	}
+	return append(append([]Decision{}, r.decisions[r.next:]...), r.decisions[:r.next]...)
+}
+
+// DebugHandler lists the decisions in the ring as JSON, oldest first. The
+// decisions say who did what, so only admins may see them.
+func DebugHandler(ring *Ring) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok || !principal.IsAdmin() {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		bytes, err := json.Marshal(ring.Decisions())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(bytes)
+	}
+}
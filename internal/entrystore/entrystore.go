@@ -0,0 +1,63 @@
+package entrystore
+
+import (
+	"sync"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// Store holds the entries shared by the handlers of every engine. Entries are
+// read concurrently, but they're changed one at a time with Update so that
+// concurrent updates don't lose revisions.
+type Store struct {
+	mu      sync.RWMutex
+	entries map[string]types.Entry
+}
+
+// New creates a store holding a copy of the entries
+func New(entries map[string]types.Entry) *Store {
+	store := &Store{entries: make(map[string]types.Entry, len(entries))}
+	for id, entry := range entries {
+		store.entries[id] = entry
+	}
+	return store
+}
+
+// Get looks up an entry by its id
+func (s *Store) Get(id string) (types.Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.entries[id]
+	return entry, ok
+}
+
+// Range calls f with each entry, the entries can't change until it returns
+func (s *Store) Range(f func(id string, entry types.Entry)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for id, entry := range s.entries {
+		f(id, entry)
+	}
+}
+
+// Update replaces an entry with the result of update, which is given the entry
+// as it is stored. The store is locked until update returns, so that the entry
+// can't change in between. It returns false if there's no such entry.
+// Decisions cached before the update are invalidated.
+func (s *Store) Update(id string, update func(types.Entry) types.Entry) (types.Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[id]
+	if !ok {
+		return types.Entry{}, false
+	}
+
+	entry = update(entry)
+	s.entries[id] = entry
+	decisioncache.Invalidate()
+	return entry, true
+}
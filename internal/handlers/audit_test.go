@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestAuditLog(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+		"Bob":   {Token: "456"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	dir, err := ioutil.TempDir("", "audit-log-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	key := []byte("audit-test-key")
+
+	// each request is made against a freshly opened log, so the chain is
+	// continued across restarts
+	request := func(language, token string) {
+		audit, err := decisions.NewAuditLog(path, key, 3)
+		if err != nil {
+			t.Fatalf("failed to open audit log: %s", err)
+		}
+
+		router := mux.NewRouter()
+		router.Use(
+			decisions.Middleware(decisions.NewLog(audit)),
+			authn.Middleware(authn.BearerToken{Users: users}),
+		)
+		router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks))
+		router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks))
+		router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks))
+		router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks))
+
+		req := httptest.NewRequest("GET", fmt.Sprintf("/%s/entries/1", language), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		if err := audit.Close(); err != nil {
+			t.Fatalf("failed to close audit log: %s", err)
+		}
+	}
+	for _, language := range []string{"golang", "rego", "cue", "polar"} {
+		request(language, "123")
+		request(language, "456")
+	}
+
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(original), "\n")
+	lines = lines[:len(lines)-1]
+	if len(lines) != 8 {
+		t.Fatalf("unexpected number of records: got %d want 8", len(lines))
+	}
+	checkpoint, err := decisions.LoadAuditCheckpoint(decisions.CheckpointPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint == nil || checkpoint.Seq != 8 {
+		t.Fatalf("unexpected checkpoint: %+v", checkpoint)
+	}
+
+	testCases := []struct {
+		Description    string
+		Tamper         func(lines []string) []string
+		Checkpoint     func(checkpoint decisions.AuditCheckpoint) decisions.AuditCheckpoint
+		ExpectedBroken string
+	}{
+		{
+			Description: "untouched log is intact",
+			Tamper:      func(lines []string) []string { return lines },
+		},
+		{
+			Description: "edited decision breaks its record",
+			Tamper: func(lines []string) []string {
+				lines[3] = strings.Replace(lines[3], `"result":"deny"`, `"result":"allow"`, 1)
+				return lines
+			},
+			ExpectedBroken: "line 4 (record 4): hash",
+		},
+		{
+			Description: "removed record breaks the next one",
+			Tamper: func(lines []string) []string {
+				return append(lines[:2], lines[3:]...)
+			},
+			ExpectedBroken: "line 3 (record 3): sequence number is 4",
+		},
+		{
+			Description: "reordered records break the chain",
+			Tamper: func(lines []string) []string {
+				lines[4], lines[5] = lines[5], lines[4]
+				return lines
+			},
+			ExpectedBroken: "line 5 (record 5): sequence number is 6",
+		},
+		{
+			Description: "chain rewritten without the key is broken",
+			Tamper: func(lines []string) []string {
+				return rewriteAuditLog(t, dir, len(lines))
+			},
+			ExpectedBroken: "line 1 (record 1): hash",
+		},
+		{
+			Description: "checkpoint moved back without the key is broken",
+			Tamper: func(lines []string) []string {
+				return lines[:6]
+			},
+			Checkpoint: func(checkpoint decisions.AuditCheckpoint) decisions.AuditCheckpoint {
+				var record decisions.AuditRecord
+				if err := json.Unmarshal([]byte(lines[5]), &record); err != nil {
+					t.Fatal(err)
+				}
+				checkpoint.Seq, checkpoint.Hash = record.Seq, record.Hash
+				return checkpoint
+			},
+			ExpectedBroken: "checkpoint at record 6 doesn't match its MAC",
+		},
+		{
+			Description: "truncated log ends before the checkpoint",
+			Tamper: func(lines []string) []string {
+				return lines[:6]
+			},
+			ExpectedBroken: "log ends at record 6 before the checkpoint at record 8",
+		},
+		{
+			Description: "partly written record is reported",
+			Tamper: func(lines []string) []string {
+				lines[7] = strings.TrimSuffix(lines[7], "\n")
+				return lines
+			},
+			ExpectedBroken: "line 8 (record 8): record isn't terminated by a newline",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			tampered := tc.Tamper(append([]string{}, lines...))
+			tamperedCheckpoint := *checkpoint
+			if tc.Checkpoint != nil {
+				tamperedCheckpoint = tc.Checkpoint(tamperedCheckpoint)
+			}
+
+			_, err := decisions.VerifyAudit(strings.NewReader(strings.Join(tampered, "")), key, &tamperedCheckpoint)
+			if tc.ExpectedBroken == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+
+			if _, ok := err.(*decisions.BrokenLinkError); !ok {
+				t.Fatalf("expected a broken link, got %v", err)
+			}
+			if !strings.HasPrefix(err.Error(), tc.ExpectedBroken) {
+				t.Fatalf("unexpected broken link: got %q want %q", err, tc.ExpectedBroken)
+			}
+		})
+	}
+
+	t.Run("log doesn't verify with another key", func(t *testing.T) {
+		_, err := decisions.VerifyAudit(strings.NewReader(string(original)), []byte("guessed-key"), nil)
+		if _, ok := err.(*decisions.BrokenLinkError); !ok {
+			t.Fatalf("expected a broken link, got %v", err)
+		}
+	})
+
+	t.Run("log isn't opened without a key", func(t *testing.T) {
+		if _, err := decisions.NewAuditLog(filepath.Join(dir, "unkeyed.log"), nil, 3); err == nil {
+			t.Fatalf("expected an error opening a log without a key")
+		}
+	})
+
+	t.Run("tampered log isn't appended to", func(t *testing.T) {
+		tampered := strings.Replace(string(original), `"result":"deny"`, `"result":"allow"`, 1)
+		if err := ioutil.WriteFile(path, []byte(tampered), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decisions.NewAuditLog(path, key, 3); err == nil {
+			t.Fatalf("expected an error opening a broken log")
+		}
+	})
+}
+
+// rewriteAuditLog writes a new, internally consistent, chain of n decisions
+// as someone covering their tracks might, without the log's key
+func rewriteAuditLog(t *testing.T, dir string, n int) []string {
+	path := filepath.Join(dir, "rewritten.log")
+	audit, err := decisions.NewAuditLog(path, []byte("guessed-key"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		audit.Write(decisions.Decision{Engine: "golang", Principal: "Alice", Action: "read_entry", Resource: "entries/1", Result: decisions.ResultAllow})
+	}
+	audit.Close()
+
+	rewritten, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(rewritten), "\n")
+	return lines[:len(lines)-1]
+}
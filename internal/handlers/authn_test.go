@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestAuthenticatorChain(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+		"Bob":   {Token: "456"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "Dear diary..."},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	sessions := authn.NewSessions()
+	bobSession, err := sessions.Create("Bob")
+	if err != nil {
+		t.Fatalf("failed to create session: %s", err)
+	}
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(
+		authn.BearerToken{Users: users},
+		authn.Basic{Users: users},
+		authn.APIKey{Users: users},
+		authn.CookieSession{Sessions: sessions},
+	))
+	router.HandleFunc("/golang/whoami", golang.WhoAmIHandler(users))
+	router.HandleFunc("/rego/whoami", rego.WhoAmIHandler(mustRegoStore(users)))
+	router.HandleFunc("/cue/whoami", cue.WhoAmIHandler(users))
+	router.HandleFunc("/polar/whoami", polar.WhoAmIHandler(users))
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks))
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description      string
+		Path             string
+		Setup            func(r *http.Request)
+		ExpectedStatus   int
+		ExpectedResponse string
+	}{
+		{
+			Description: "basic auth with token as password",
+			Path:        "/whoami",
+			Setup: func(r *http.Request) {
+				r.SetBasicAuth("Alice", "123")
+			},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Alice",
+		},
+		{
+			Description: "basic auth with another user's token",
+			Path:        "/whoami",
+			Setup: func(r *http.Request) {
+				r.SetBasicAuth("Alice", "456")
+			},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description: "malformed basic auth",
+			Path:        "/whoami",
+			Setup: func(r *http.Request) {
+				r.Header.Set("Authorization", "Basic not-base64!")
+			},
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Description: "api key header",
+			Path:        "/whoami",
+			Setup: func(r *http.Request) {
+				r.Header.Set("X-API-Key", "456")
+			},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Bob",
+		},
+		{
+			Description: "unknown api key",
+			Path:        "/whoami",
+			Setup: func(r *http.Request) {
+				r.Header.Set("X-API-Key", "789")
+			},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description: "session cookie",
+			Path:        "/whoami",
+			Setup: func(r *http.Request) {
+				r.AddCookie(&http.Cookie{Name: "session", Value: bobSession})
+			},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Bob",
+		},
+		{
+			Description: "unknown session cookie",
+			Path:        "/whoami",
+			Setup: func(r *http.Request) {
+				r.AddCookie(&http.Cookie{Name: "session", Value: "expired"})
+			},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description: "unsupported authorization scheme",
+			Path:        "/whoami",
+			Setup: func(r *http.Request) {
+				r.Header.Set("Authorization", "Digest 123")
+			},
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Description: "first authenticator with credentials is used",
+			Path:        "/whoami",
+			Setup: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer 123")
+				r.Header.Set("X-API-Key", "456")
+			},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Alice",
+		},
+		{
+			Description: "entry permitted with basic auth",
+			Path:        "/entries/1",
+			Setup: func(r *http.Request) {
+				r.SetBasicAuth("Alice", "123")
+			},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Dear diary...",
+		},
+		{
+			Description: "entry denied with session cookie",
+			Path:        "/entries/1",
+			Setup: func(r *http.Request) {
+				r.AddCookie(&http.Cookie{Name: "session", Value: bobSession})
+			},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "entry without credentials",
+			Path:           "/entries/1",
+			Setup:          func(r *http.Request) {},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				req, err := http.NewRequest("GET", fmt.Sprintf("/%s%s", language, tc.Path), nil)
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				tc.Setup(req)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				body, err := ioutil.ReadAll(w.Body)
+				if err != nil {
+					t.Fatalf("failed to read request: %s", err)
+				}
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+
+				if got, want := string(body), tc.ExpectedResponse; got != want {
+					t.Fatalf("unexpected body: got %s want %s", got, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/synthetic"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+// benchmarkSizes are the numbers of users in the benchmarked graphs, the
+// largest is skipped with -short
+var benchmarkSizes = []int{10, 1000, 100000}
+
+// benchmarkGraphs are generated once for all the benchmarks, the largest
+// takes a while to make
+var benchmarkGraphs = map[int]synthetic.Graph{}
+
+func benchmarkGraph(b *testing.B, users int) synthetic.Graph {
+	b.Helper()
+
+	if users > 1000 && testing.Short() {
+		b.Skip("skipping large graph in short mode")
+	}
+
+	graph, ok := benchmarkGraphs[users]
+	if !ok {
+		var err error
+		graph, err = synthetic.Generate(synthetic.Config{
+			Topology: synthetic.SmallWorld,
+			Users:    users,
+			Entries:  users,
+			Seed:     1,
+		})
+		if err != nil {
+			b.Fatalf("failed to generate graph: %s", err)
+		}
+		benchmarkGraphs[users] = graph
+	}
+	return graph
+}
+
+// benchmarkPrincipal is the principal of the named user with unrestricted
+// credentials, it's set directly in the request context so that the benchmarks
+// measure the engines rather than looking up tokens
+func benchmarkPrincipal(graph synthetic.Graph, name string) types.Principal {
+	return types.Principal{
+		Name:          name,
+		Type:          types.PrincipalTypeUser,
+		Authenticator: "bearer",
+		Roles:         graph.Users[name].Roles,
+		Risk:          types.RiskLow,
+		Scopes:        types.AllScopes,
+	}
+}
+
+// runBenchmark calls the handler b.N times with requests made by newRequest,
+// failing if any response doesn't have the expected status
+func runBenchmark(b *testing.B, handler http.HandlerFunc, newRequest func() *http.Request, expectedStatus int) {
+	b.Helper()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rr := httptest.NewRecorder()
+		handler(rr, newRequest())
+		if rr.Code != expectedStatus {
+			b.Fatalf("unexpected response code: got %d want %d", rr.Code, expectedStatus)
+		}
+	}
+}
+
+func BenchmarkWhoAmI(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		for _, language := range []string{"golang", "rego", "cue", "polar"} {
+			b.Run(fmt.Sprintf("%s users=%d", language, size), func(b *testing.B) {
+				graph := benchmarkGraph(b, size)
+				users := userstore.New(graph.Users)
+
+				handlers := map[string]func(*userstore.Store) func(http.ResponseWriter, *http.Request){
+					"golang": golang.WhoAmIHandler,
+					"rego": func(users *userstore.Store) func(http.ResponseWriter, *http.Request) {
+						return rego.WhoAmIHandler(mustRegoStore(users))
+					},
+					"cue":   cue.WhoAmIHandler,
+					"polar": polar.WhoAmIHandler,
+				}
+				handler := handlers[language](users)
+
+				principal := benchmarkPrincipal(graph, graph.Names[len(graph.Names)/2])
+				runBenchmark(b, handler, func() *http.Request {
+					req := httptest.NewRequest("GET", "/"+language+"/whoami", nil)
+					return req.WithContext(authn.WithPrincipal(req.Context(), principal))
+				}, http.StatusOK)
+			})
+		}
+	}
+}
+
+func BenchmarkGetEntry(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		for _, language := range []string{"golang", "rego", "cue", "polar"} {
+			b.Run(fmt.Sprintf("%s users=%d", language, size), func(b *testing.B) {
+				graph := benchmarkGraph(b, size)
+				entries := entrystore.New(graph.Entries)
+				notebooks := graph.Notebooks
+
+				handlers := map[string]func(*entrystore.Store, *map[string]types.Notebook) func(http.ResponseWriter, *http.Request){
+					"golang": golang.GetEntryHandler,
+					"rego":   rego.GetEntryHandler,
+					"cue":    cue.GetEntryHandler,
+					"polar":  polar.GetEntryHandler,
+				}
+				handler := handlers[language](entries, &notebooks)
+
+				// the entry is read by one of its readers, so the policies
+				// have to look past the owner
+				entryID, reader := benchmarkEntryReader(b, graph)
+				principal := benchmarkPrincipal(graph, reader)
+				runBenchmark(b, handler, func() *http.Request {
+					req := httptest.NewRequest("GET", "/"+language+"/entries/"+entryID, nil)
+					req = mux.SetURLVars(req, map[string]string{"entryID": entryID})
+					return req.WithContext(authn.WithPrincipal(req.Context(), principal))
+				}, http.StatusOK)
+			})
+		}
+	}
+}
+
+// BenchmarkGetEntryParallel reads an entry from many goroutines at once, as
+// the server does, so handlers which serialise their evaluations are seen.
+// The cue handler is also run compiling its policy for each request, as it
+// used to, to compare with its pool of compiled policies.
+func BenchmarkGetEntryParallel(b *testing.B) {
+	for _, language := range []string{"golang", "rego", "cue", "polar"} {
+		b.Run(fmt.Sprintf("%s users=%d", language, 1000), func(b *testing.B) {
+			handlers := map[string]func(*entrystore.Store, *map[string]types.Notebook) func(http.ResponseWriter, *http.Request){
+				"golang": golang.GetEntryHandler,
+				"rego":   rego.GetEntryHandler,
+				"cue":    cue.GetEntryHandler,
+				"polar":  polar.GetEntryHandler,
+			}
+			benchmarkGetEntryParallel(b, handlers[language])
+		})
+	}
+
+	b.Run(fmt.Sprintf("cue compiled per request users=%d", 1000), func(b *testing.B) {
+		cue.CompilePerRequest = true
+		defer func() { cue.CompilePerRequest = false }()
+
+		benchmarkGetEntryParallel(b, cue.GetEntryHandler)
+	})
+}
+
+// benchmarkGetEntryParallel reads an entry of a graph of 1000 users from many
+// goroutines at once with the handler
+func benchmarkGetEntryParallel(b *testing.B, newHandler func(*entrystore.Store, *map[string]types.Notebook) func(http.ResponseWriter, *http.Request)) {
+	graph := benchmarkGraph(b, 1000)
+	entries := entrystore.New(graph.Entries)
+	notebooks := graph.Notebooks
+	handler := newHandler(entries, &notebooks)
+
+	entryID, reader := benchmarkEntryReader(b, graph)
+	principal := benchmarkPrincipal(graph, reader)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest("GET", "/entries/"+entryID, nil)
+			req = mux.SetURLVars(req, map[string]string{"entryID": entryID})
+			req = req.WithContext(authn.WithPrincipal(req.Context(), principal))
+
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			if rr.Code != http.StatusOK {
+				b.Errorf("unexpected response code: got %d want %d", rr.Code, http.StatusOK)
+				return
+			}
+		}
+	})
+}
+
+// benchmarkEntryReader finds the first entry which is shared with a reader and
+// isn't reported
+func benchmarkEntryReader(b *testing.B, graph synthetic.Graph) (string, string) {
+	b.Helper()
+
+	for _, id := range graph.EntryIDs {
+		entry := graph.Entries[id]
+		if len(entry.Readers) > 0 && !entry.Reported {
+			return id, entry.Readers[0]
+		}
+	}
+	b.Fatalf("no entry has a reader")
+	return "", ""
+}
+
+func BenchmarkCreateFriendRequest(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		for _, language := range []string{"golang", "rego", "polar"} {
+			b.Run(fmt.Sprintf("%s users=%d", language, size), func(b *testing.B) {
+				graph := benchmarkGraph(b, size)
+				users := userstore.New(graph.Users)
+
+				handlers := map[string]func(*userstore.Store) func(http.ResponseWriter, *http.Request){
+					"golang": golang.CreateFriendRequestHandler,
+					"rego": func(users *userstore.Store) func(http.ResponseWriter, *http.Request) {
+						return rego.CreateFriendRequestHandler(mustRegoStore(users))
+					},
+					"polar": polar.CreateFriendRequestHandler,
+				}
+				handler := handlers[language](users)
+
+				// the friend is a friend of a friend, so the request is
+				// allowed without the handlers needing to search the whole
+				// graph to find them
+				requester, friend := benchmarkFriendOfFriend(b, graph)
+				principal := benchmarkPrincipal(graph, requester)
+				payload, err := json.Marshal(map[string]string{"friend": friend})
+				if err != nil {
+					b.Fatalf("failed to marshal payload: %s", err)
+				}
+
+				runBenchmark(b, handler, func() *http.Request {
+					req := httptest.NewRequest("POST", "/"+language+"/friendrequests", bytes.NewReader(payload))
+					return req.WithContext(authn.WithPrincipal(req.Context(), principal))
+				}, http.StatusOK)
+			})
+		}
+	}
+}
+
+// benchmarkFriendOfFriend finds the first user with a friend of a friend they
+// aren't friends with yet
+func benchmarkFriendOfFriend(b *testing.B, graph synthetic.Graph) (string, string) {
+	b.Helper()
+
+	for _, name := range graph.Names {
+		friends := map[string]bool{name: true}
+		for _, friend := range graph.Users[name].Friends {
+			friends[friend] = true
+		}
+		for _, friend := range graph.Users[name].Friends {
+			for _, candidate := range graph.Users[friend].Friends {
+				if !friends[candidate] {
+					return name, candidate
+				}
+			}
+		}
+	}
+	b.Fatalf("no user has a friend of a friend")
+	return "", ""
+}
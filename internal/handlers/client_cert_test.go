@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+// testCA can issue client certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %s", err)
+	}
+
+	return testCA{cert: cert, key: key}
+}
+
+// issue signs a client certificate for the template, the validity defaults to
+// the hour either side of now
+func (ca testCA) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca testCA) writePEM(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "ca.pem")
+	bytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := ioutil.WriteFile(path, bytes, 0600); err != nil {
+		t.Fatalf("failed to write CA: %s", err)
+	}
+	return path
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+		"Bob":   {Token: "456"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "Team plans", Groups: []string{"team"}},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	dir, err := ioutil.TempDir("", "client-cert-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "Test CA")
+	otherCA := newTestCA(t, "Other CA")
+
+	mappingFile := filepath.Join(dir, "mapping.json")
+	err = ioutil.WriteFile(mappingFile, []byte(`{
+		"subjects": {"CN=alice,OU=people,O=Example": "Alice"},
+		"sans": {"spiffe://example.com/bob": "Bob", "bob.example.com": "Bob"}
+	}`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write mapping: %s", err)
+	}
+	mapping, err := authn.LoadCertificateMapping(mappingFile)
+	if err != nil {
+		t.Fatalf("failed to load mapping: %s", err)
+	}
+	tlsConfig, err := authn.ClientCertTLSConfig(ca.writePEM(t, dir))
+	if err != nil {
+		t.Fatalf("failed to build TLS config: %s", err)
+	}
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(
+		authn.BearerToken{Users: users},
+		authn.ClientCertificate{Mapping: mapping},
+	))
+	router.HandleFunc("/golang/whoami", golang.WhoAmIHandler(users))
+	router.HandleFunc("/rego/whoami", rego.WhoAmIHandler(mustRegoStore(users)))
+	router.HandleFunc("/cue/whoami", cue.WhoAmIHandler(users))
+	router.HandleFunc("/polar/whoami", polar.WhoAmIHandler(users))
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks))
+
+	server := httptest.NewUnstartedServer(router)
+	server.TLS = tlsConfig
+	// rejected handshakes are expected, so don't log them
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	bobURI, _ := url.Parse("spiffe://example.com/bob")
+	certs := map[string]tls.Certificate{
+		"alice subject": ca.issue(t, &x509.Certificate{
+			Subject: pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"people"}, Organization: []string{"Example"}},
+		}),
+		"bob uri": ca.issue(t, &x509.Certificate{
+			Subject: pkix.Name{CommonName: "bob", OrganizationalUnit: []string{"team"}},
+			URIs:    []*url.URL{bobURI},
+		}),
+		"bob dns": ca.issue(t, &x509.Certificate{
+			Subject:  pkix.Name{CommonName: "bob", OrganizationalUnit: []string{"finance"}},
+			DNSNames: []string{"bob.example.com"},
+		}),
+		"unmapped": ca.issue(t, &x509.Certificate{
+			Subject: pkix.Name{CommonName: "mallory", OrganizationalUnit: []string{"team"}},
+		}),
+		"other ca": otherCA.issue(t, &x509.Certificate{
+			Subject: pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"people"}, Organization: []string{"Example"}},
+		}),
+		"expired": ca.issue(t, &x509.Certificate{
+			Subject:   pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"people"}, Organization: []string{"Example"}},
+			NotBefore: time.Now().Add(-2 * time.Hour),
+			NotAfter:  time.Now().Add(-time.Hour),
+		}),
+	}
+
+	// clientFor returns a client trusting the server and presenting the
+	// certificate, or none
+	serverTransport := server.Client().Transport.(*http.Transport)
+	clientFor := func(certName string) *http.Client {
+		transport := serverTransport.Clone()
+		if cert, ok := certs[certName]; ok {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		}
+		return &http.Client{Transport: transport}
+	}
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description      string
+		Certificate      string
+		Token            string
+		Path             string
+		ExpectedStatus   int
+		ExpectedResponse string
+	}{
+		{
+			Description:      "certificate mapped by subject",
+			Certificate:      "alice subject",
+			Path:             "/whoami",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Alice",
+		},
+		{
+			Description:      "certificate mapped by URI SAN",
+			Certificate:      "bob uri",
+			Path:             "/whoami",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Bob",
+		},
+		{
+			Description:      "certificate mapped by DNS SAN",
+			Certificate:      "bob dns",
+			Path:             "/whoami",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Bob",
+		},
+		{
+			Description:    "certificate without a mapping",
+			Certificate:    "unmapped",
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:      "bearer tokens are used before certificates",
+			Certificate:      "bob uri",
+			Token:            "123",
+			Path:             "/whoami",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Alice",
+		},
+		{
+			Description:      "certificate organizational unit grants access to a shared entry",
+			Certificate:      "bob uri",
+			Path:             "/entries/1",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Team plans",
+		},
+		{
+			Description:    "certificate organizational unit for another group",
+			Certificate:    "bob dns",
+			Path:           "/entries/1",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "organizational unit of an unmapped certificate is not trusted",
+			Certificate:    "unmapped",
+			Path:           "/entries/1",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s%s", server.URL, language, tc.Path), nil)
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				if tc.Token != "" {
+					req.Header.Set("Authorization", "Bearer "+tc.Token)
+				}
+
+				resp, err := clientFor(tc.Certificate).Do(req)
+				if err != nil {
+					t.Fatalf("request failed: %s", err)
+				}
+				defer resp.Body.Close()
+
+				body, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatalf("failed to read request: %s", err)
+				}
+
+				if got, want := resp.StatusCode, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+
+				if got, want := string(body), tc.ExpectedResponse; got != want {
+					t.Fatalf("unexpected body: got %s want %s", got, want)
+				}
+			})
+		}
+	}
+
+	// these are rejected by the listener before reaching any handler
+	for _, certName := range []string{"", "other ca", "expired"} {
+		t.Run(fmt.Sprintf("handshake rejected for %q", certName), func(t *testing.T) {
+			resp, err := clientFor(certName).Get(server.URL + "/golang/whoami")
+			if err == nil {
+				resp.Body.Close()
+				t.Fatalf("expected the request to fail, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
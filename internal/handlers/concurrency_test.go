@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+// TestCUEConcurrentRequests makes requests from many goroutines at once to the
+// cue handlers, which share pools of compiled policies. Run it with -race to
+// check the sharing is safe.
+func TestCUEConcurrentRequests(t *testing.T) {
+	// the policies have an instance for each of GOMAXPROCS, so that more than
+	// one is used at once even with a single CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123"},
+		"Bob":     {Token: "456"},
+		"Charlie": {Token: "789"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary", Readers: []string{"Bob"}},
+		"2": {User: "Bob", Content: "private thoughts"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+	router.HandleFunc("/cue/whoami", cue.WhoAmIHandler(users))
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks))
+
+	// each principal gets a different answer, so values filled in for one
+	// request leaking into another would be seen
+	testCases := []struct {
+		Path           string
+		Token          string
+		ExpectedStatus int
+		ExpectedBody   string
+	}{
+		{Path: "/cue/whoami", Token: "123", ExpectedStatus: http.StatusOK, ExpectedBody: "Alice"},
+		{Path: "/cue/whoami", Token: "456", ExpectedStatus: http.StatusOK, ExpectedBody: "Bob"},
+		{Path: "/cue/entries/1", Token: "123", ExpectedStatus: http.StatusOK},
+		{Path: "/cue/entries/1", Token: "456", ExpectedStatus: http.StatusOK},
+		{Path: "/cue/entries/1", Token: "789", ExpectedStatus: http.StatusUnauthorized},
+		{Path: "/cue/entries/2", Token: "123", ExpectedStatus: http.StatusUnauthorized},
+		{Path: "/cue/entries/2", Token: "456", ExpectedStatus: http.StatusOK},
+	}
+
+	const workers = 8
+	const requests = 20
+
+	errs := make(chan error, workers*requests*len(testCases))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				tc := testCases[(offset+j)%len(testCases)]
+
+				req := httptest.NewRequest("GET", tc.Path, nil)
+				req.Header.Set("Authorization", "Bearer "+tc.Token)
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+
+				if rr.Code != tc.ExpectedStatus {
+					errs <- fmt.Errorf("%s as %s: unexpected response code: got %d want %d", tc.Path, tc.Token, rr.Code, tc.ExpectedStatus)
+					continue
+				}
+				if tc.ExpectedBody != "" && rr.Body.String() != tc.ExpectedBody {
+					errs <- fmt.Errorf("%s as %s: unexpected body: got %s want %s", tc.Path, tc.Token, rr.Body.String(), tc.ExpectedBody)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestConcurrentEntryUpdates updates an entry from many goroutines at once
+// with every engine while it's read, every update must be kept as a revision.
+// Run it with -race to check the entries are shared safely.
+func TestConcurrentEntryUpdates(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+	index := search.NewIndex(entryStore)
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+	router.HandleFunc("/golang/entries/{entryID}", golang.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+	router.HandleFunc("/rego/entries/{entryID}", rego.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+	router.HandleFunc("/cue/entries/{entryID}", cue.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+	router.HandleFunc("/polar/entries/{entryID}", polar.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	const workers = 8
+	const requests = 10
+
+	errs := make(chan error, 2*workers*requests)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				language := languages[(worker+j)%len(languages)]
+
+				body := fmt.Sprintf(`{"content": "update %d %d"}`, worker, j)
+				req := httptest.NewRequest("PUT", "/"+language+"/entries/1", strings.NewReader(body))
+				req.Header.Set("Authorization", "Bearer 123")
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				if rr.Code != http.StatusOK {
+					errs <- fmt.Errorf("%s update: unexpected response code: got %d want %d", language, rr.Code, http.StatusOK)
+				}
+
+				req = httptest.NewRequest("GET", "/"+language+"/entries/1", nil)
+				req.Header.Set("Authorization", "Bearer 123")
+				rr = httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				if rr.Code != http.StatusOK {
+					errs <- fmt.Errorf("%s read: unexpected response code: got %d want %d", language, rr.Code, http.StatusOK)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	entry, _ := entryStore.Get("1")
+	if got, want := len(entry.Revisions), workers*requests; got != want {
+		t.Fatalf("unexpected number of revisions: got %d want %d", got, want)
+	}
+
+	// the index has the content which was stored last
+	if got := index.Search(entry.Content); len(got) != 1 || got[0] != "1" {
+		t.Fatalf("latest content isn't indexed: got %v", got)
+	}
+}
+
+// TestConcurrentUserUpdates changes users from many goroutines at once while
+// friend requests are made with each engine which has them. Run it with -race
+// to check the users are shared safely.
+func TestConcurrentUserUpdates(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123", Friends: []string{"Bob"}},
+		"Bob":     {Token: "456", Friends: []string{"Alice", "Charlie"}},
+		"Charlie": {Token: "789", Friends: []string{"Bob"}},
+	})
+	store := mustRegoStore(users)
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+	router.HandleFunc("/golang/friendrequests", golang.CreateFriendRequestHandler(users))
+	router.HandleFunc("/rego/friendrequests", rego.CreateFriendRequestHandler(store))
+	router.HandleFunc("/polar/friendrequests", polar.CreateFriendRequestHandler(users))
+
+	languages := []string{"golang", "rego", "polar"}
+
+	const workers = 8
+	const requests = 10
+
+	errs := make(chan error, workers*requests)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				name := fmt.Sprintf("User%d", worker)
+				if err := users.Put(context.Background(), name, types.User{Friends: []string{"Alice"}}); err != nil {
+					errs <- fmt.Errorf("failed to put user: %s", err)
+				}
+				if err := users.Delete(context.Background(), name); err != nil {
+					errs <- fmt.Errorf("failed to delete user: %s", err)
+				}
+			}
+		}(i)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				language := languages[(worker+j)%len(languages)]
+
+				req := httptest.NewRequest("POST", "/"+language+"/friendrequests", strings.NewReader(`{"friend": "Charlie"}`))
+				req.Header.Set("Authorization", "Bearer 123")
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				if rr.Code != http.StatusOK {
+					errs <- fmt.Errorf("%s: unexpected response code: got %d want %d", language, rr.Code, http.StatusOK)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,26 +10,30 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
 	"github.com/gorilla/mux"
 )
 
 func TestCreateFriendRequestEndpoint(t *testing.T) {
-	var users = map[string]types.User{
+	users := userstore.New(map[string]types.User{
 		"Alice":   {Token: "123", Friends: []string{"Bob"}},
 		"Bob":     {Token: "456", Friends: []string{"Alice", "Charlie"}},
 		"Charlie": {Token: "789", Friends: []string{"Bob", "Edward"}},
 		"Dennis":  {Token: "101", Friends: []string{}},
 		"Edward":  {Token: "112", Friends: []string{"Charlie"}},
-	}
+	})
 
 	router := mux.NewRouter()
-	router.HandleFunc("/golang/friendrequests", golang.CreateFriendRequestHandler(&users))
-	router.HandleFunc("/polar/friendrequests", polar.CreateFriendRequestHandler(&users))
-	router.HandleFunc("/rego/friendrequests", rego.CreateFriendRequestHandler(&users))
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+	router.HandleFunc("/golang/friendrequests", golang.CreateFriendRequestHandler(users))
+	router.HandleFunc("/polar/friendrequests", polar.CreateFriendRequestHandler(users))
+	store := mustRegoStore(users)
+	router.HandleFunc("/rego/friendrequests", rego.CreateFriendRequestHandler(store))
 
 	languages := []string{"golang", "rego", "polar"}
 
@@ -102,4 +107,136 @@ func TestCreateFriendRequestEndpoint(t *testing.T) {
 			})
 		}
 	}
+
+	// handlers are created once, so the policies must see friendships which
+	// change after that
+	t.Run("friendships made after the handlers were created are used", func(t *testing.T) {
+		dennis, _ := users.Get("Dennis")
+		dennis.Friends = []string{"Edward"}
+		if err := users.Put(context.Background(), "Dennis", dennis); err != nil {
+			t.Fatalf("failed to put user: %s", err)
+		}
+		edward, _ := users.Get("Edward")
+		edward.Friends = append(edward.Friends, "Dennis")
+		if err := users.Put(context.Background(), "Edward", edward); err != nil {
+			t.Fatalf("failed to put user: %s", err)
+		}
+
+		for _, language := range languages {
+			req := httptest.NewRequest("POST", fmt.Sprintf("/%s/friendrequests", language), bytes.NewBufferString(`{"friend": "Dennis"}`))
+			req.Header.Set("Authorization", "Bearer 123")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("%s: unexpected response code: got %d want %d", language, got, want)
+			}
+		}
+	})
+}
+
+// TestPolarFriendshipsGoBothWays checks that polar treats friendships as
+// mutual when only one of the users lists the other, as its policy did before
+// the friendships were looked up from a graph
+func TestPolarFriendshipsGoBothWays(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123", Friends: []string{"Bob"}},
+		"Bob":     {Token: "456"},
+		"Charlie": {Token: "789", Friends: []string{"Bob"}},
+		"Dennis":  {Token: "101", Friends: []string{"Edward"}},
+		"Edward":  {Token: "112"},
+	})
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+	router.HandleFunc("/polar/friendrequests", polar.CreateFriendRequestHandler(users))
+
+	testCases := []struct {
+		Description    string
+		Token          string
+		FriendName     string
+		ExpectedStatus int
+	}{
+		{
+			Description:    "alice and charlie both list bob",
+			Token:          "123",
+			FriendName:     "Charlie",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "bob lists no one but is listed by charlie",
+			Token:          "456",
+			FriendName:     "Charlie",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "edward is only connected to dennis",
+			Token:          "112",
+			FriendName:     "Alice",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/polar/friendrequests", bytes.NewBufferString(`{"friend": "`+tc.FriendName+`"}`))
+			req.Header.Set("Authorization", "Bearer "+tc.Token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if got, want := w.Code, tc.ExpectedStatus; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+		})
+	}
+}
+
+// TestRevokedFriendshipsAreUsed checks that each engine stops permitting
+// requests along a friendship as soon as it's removed from the users, with
+// nothing else changed
+func TestRevokedFriendshipsAreUsed(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123", Friends: []string{"Bob"}},
+		"Bob":     {Token: "456", Friends: []string{"Alice", "Charlie"}},
+		"Charlie": {Token: "789", Friends: []string{"Bob"}},
+	})
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+	router.HandleFunc("/golang/friendrequests", golang.CreateFriendRequestHandler(users))
+	router.HandleFunc("/rego/friendrequests", rego.CreateFriendRequestHandler(mustRegoStore(users)))
+	router.HandleFunc("/polar/friendrequests", polar.CreateFriendRequestHandler(users))
+
+	languages := []string{"golang", "rego", "polar"}
+
+	request := func(t *testing.T, language string, want int) {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/%s/friendrequests", language), bytes.NewBufferString(`{"friend": "Charlie"}`))
+		req.Header.Set("Authorization", "Bearer 123")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if got := w.Code; got != want {
+			t.Fatalf("%s: unexpected response code: got %d want %d", language, got, want)
+		}
+	}
+
+	// the friends are indexed by the first requests
+	for _, language := range languages {
+		request(t, language, http.StatusOK)
+	}
+
+	bob, _ := users.Get("Bob")
+	bob.Friends = []string{"Alice"}
+	if err := users.Put(context.Background(), "Bob", bob); err != nil {
+		t.Fatalf("failed to update bob: %s", err)
+	}
+	charlie, _ := users.Get("Charlie")
+	charlie.Friends = nil
+	if err := users.Put(context.Background(), "Charlie", charlie); err != nil {
+		t.Fatalf("failed to update charlie: %s", err)
+	}
+
+	for _, language := range languages {
+		request(t, language, http.StatusUnauthorized)
+	}
 }
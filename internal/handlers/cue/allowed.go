@@ -0,0 +1,29 @@
+package cue
+
+import (
+	"cuelang.org/go/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// evalAllowed evaluates an entry policy with the user, their type, claims,
+// certificate, roles, grants and scopes, the permissions of each role, the
+// entry and its notebook filled in, and returns the values of its allowed and
+// reason fields
+func evalAllowed(p *policy, principal types.Principal, entry types.Entry, notebook types.Notebook) (allowed bool, reason string, err error) {
+	err = p.eval([]fill{
+		{"user", principal.Name},
+		{"principal_type", principal.Type},
+		{"claims", principal.Claims},
+		{"certificate", principal.Certificate},
+		{"roles", principal.Roles},
+		{"role_permissions", types.RolePermissions},
+		{"grants", principal.Grants},
+		{"scopes", principal.Scopes},
+		{"entry", entry},
+		{"notebook", notebook},
+	}, func(instance *cue.Instance) error {
+		allowed, reason, err = lookupDecision(instance, p.name)
+		return err
+	})
+	return allowed, reason, err
+}
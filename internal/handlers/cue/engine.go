@@ -0,0 +1,161 @@
+package cue
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"cuelang.org/go/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/metrics"
+	"github.com/charlieegan3/go-authz-dsls/internal/profile"
+)
+
+// engine is the name decisions made by this package's policies are recorded
+// under
+const engine = "cue"
+
+// CUE's builtin packages are shared by every runtime, and they're completed
+// the first time they're used. They're used once here, so that requests
+// evaluating policies with different runtimes don't race to do it.
+func init() {
+	var rt cue.Runtime
+	instance, err := rt.Compile("builtins", `
+import "list"
+
+used: list.Contains(["list"], "list")`)
+	if err == nil {
+		_, err = instance.Lookup("used").Bool()
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to use cue builtins: %s", err))
+	}
+}
+
+// compile compiles the config, how long it took is recorded in the policy
+// compile metrics under name and whether it compiled in the health checks.
+// Decisions cached with earlier policies are invalidated.
+func compile(rt *cue.Runtime, name, config string) (*cue.Instance, error) {
+	start := time.Now()
+	instance, err := rt.Compile(name, config)
+	metrics.ObservePolicyCompile(engine, name, time.Since(start), err)
+	health.ObservePolicy(engine, name, err)
+	decisioncache.Invalidate()
+	return instance, err
+}
+
+// CompilePerRequest makes policies compile their config for every request,
+// rather than into a pool when their handler is created, as the engine used
+// to. It's read as handlers are created, so that benchmarks can compare the
+// two.
+var CompilePerRequest bool
+
+// policy is a config compiled when its handler is created, each request's
+// values are filled into an instance of it. Filling and evaluating use the
+// runtime the instance was compiled with, which isn't safe for concurrent use,
+// so the config is compiled into a pool of instances with a runtime each, one
+// for every CPU. A request holds an instance while it evaluates the policy, so
+// as many requests evaluate at once as there are CPUs and the rest wait for an
+// instance to be returned.
+type policy struct {
+	name      string
+	config    string
+	instances chan *cue.Instance
+}
+
+// newPolicy compiles the config into the pool when the handler is created, so
+// that a broken config is found before any requests are made with it
+func newPolicy(name, config string) (*policy, error) {
+	var rt cue.Runtime
+	instance, err := compile(&rt, name, config)
+	if err != nil {
+		return nil, err
+	}
+	if CompilePerRequest {
+		return &policy{name: name, config: config}, nil
+	}
+
+	size := runtime.GOMAXPROCS(0)
+	p := &policy{name: name, config: config, instances: make(chan *cue.Instance, size)}
+	p.instances <- instance
+
+	// the config is known to compile, so the copies aren't recorded as
+	// compiles of their own
+	for i := 1; i < size; i++ {
+		var rt cue.Runtime
+		instance, err := rt.Compile(name, config)
+		if err != nil {
+			return nil, err
+		}
+		p.instances <- instance
+	}
+
+	return p, nil
+}
+
+// fill is a value to fill in at a path of a policy
+type fill struct {
+	path  string
+	value interface{}
+}
+
+// eval takes an instance from the pool and fills the values into it, then
+// calls lookup to read the results before the instance is returned. Without
+// a pool the config is compiled for each evaluation instead.
+func (p *policy) eval(fills []fill, lookup func(instance *cue.Instance) error) error {
+	var compiled *cue.Instance
+	if p.instances == nil {
+		var rt cue.Runtime
+		var err error
+		compiled, err = rt.Compile(p.name, p.config)
+		if err != nil {
+			return err
+		}
+	} else {
+		compiled = <-p.instances
+		defer func() { p.instances <- compiled }()
+	}
+
+	instance := compiled
+	for _, f := range fills {
+		var err error
+		instance, err = instance.Fill(f.value, f.path)
+		if err != nil {
+			return err
+		}
+	}
+	return lookup(instance)
+}
+
+// CUE evaluates a value as it's looked up and converted, so that's what's
+// timed under name:path when the engine is being profiled
+
+// lookupBool looks up the bool at path in the instance of the config name
+func lookupBool(instance *cue.Instance, name, path string) (bool, error) {
+	defer profile.Active(engine).Time(name + ":" + path)()
+	return instance.Lookup(path).Bool()
+}
+
+// lookupDecision looks up the allowed and reason fields of a policy's
+// decision in the instance of the config name
+func lookupDecision(instance *cue.Instance, name string) (allowed bool, reason string, err error) {
+	allowed, err = lookupBool(instance, name, "allowed")
+	if err != nil {
+		return false, "", err
+	}
+	reason, err = lookupString(instance, name, "reason")
+	return allowed, reason, err
+}
+
+// lookupInt64 looks up the integer at path in the instance of the config name
+func lookupInt64(instance *cue.Instance, name, path string) (int64, error) {
+	defer profile.Active(engine).Time(name + ":" + path)()
+	return instance.Lookup(path).Int64()
+}
+
+// lookupString looks up the string at path in the instance of the config name
+func lookupString(instance *cue.Instance, name, path string) (string, error) {
+	defer profile.Active(engine).Time(name + ":" + path)()
+	return instance.Lookup(path).String()
+}
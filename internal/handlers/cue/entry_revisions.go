@@ -0,0 +1,136 @@
+package cue
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// entryHistoryConfig is the policy for who may see the past revisions of an
+// entry. Unlike the GetEntryHandler policy, readers and service accounts are
+// not included.
+const entryHistoryConfig = `
+import "list"
+
+entry: {
+    User: string
+    Editors: [...string]
+    Notebook: string
+    OverrideSharing: bool
+}
+notebook: {
+    User: string
+    Editors: [...string]
+}
+user: string
+principal_type: "user" | "service_account"
+scopes: [...string]
+
+#inherits: entry.Notebook != "" && !entry.OverrideSharing
+
+#rules: [
+    // scoped tokens must also hold entries:read
+    {set: !list.Contains(scopes, "entries:read"), allowed: false, reason: "missing scope entries:read"},
+    {set: principal_type != "user", allowed: false, reason: "not a user"},
+    {set: entry.User == user, allowed: true, reason: "owner"},
+    {set: list.Contains(entry.Editors, user), allowed: true, reason: "editor"},
+    {
+        set: #inherits && (notebook.User == user || list.Contains(notebook.Editors, user)),
+        allowed: true,
+        reason: "notebook sharing",
+    },
+    {set: true, allowed: false, reason: "not an editor"},
+]
+
+#decision: [ for r in #rules if r.set { r } ][0]
+allowed: #decision.allowed
+reason: #decision.reason
+`
+
+// ListEntryRevisionsHandler lists the past revisions of an entry for users
+// permitted to see its history
+func ListEntryRevisionsHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook) func(w http.ResponseWriter, r *http.Request) {
+	p, err := newPolicy("entry_history", entryHistoryConfig)
+	if err != nil {
+		return health.Unavailable(engine, "entry_history", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry, ok := authzEntryHistory(w, r, p, entries, notebooks)
+		if !ok {
+			return
+		}
+
+		helpers.WriteRevisions(w, entry.Revisions)
+	}
+}
+
+// GetEntryRevisionHandler returns the content of a single past revision of an
+// entry for users permitted to see its history
+func GetEntryRevisionHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook) func(w http.ResponseWriter, r *http.Request) {
+	p, err := newPolicy("entry_history", entryHistoryConfig)
+	if err != nil {
+		return health.Unavailable(engine, "entry_history", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry, ok := authzEntryHistory(w, r, p, entries, notebooks)
+		if !ok {
+			return
+		}
+
+		revision, ok := helpers.LookupRevision(entry, mux.Vars(r)["revisionID"])
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, revision.Content)
+	}
+}
+
+// authzEntryHistory looks up the requested entry and checks the user may see
+// its history. When not ok, the response has already been written.
+func authzEntryHistory(w http.ResponseWriter, r *http.Request, p *policy, entries *entrystore.Store, notebooks *map[string]types.Notebook) (entry types.Entry, ok bool) {
+	// the principal has been set in the request context by the authn
+	// middleware
+	principal, ok := authn.PrincipalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return types.Entry{}, false
+	}
+
+	entryID, ok := mux.Vars(r)["entryID"]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return types.Entry{}, false
+	}
+
+	entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, entryID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return types.Entry{}, false
+	}
+
+	decision := decisions.Start(r.Context(), engine, principal, "read_entry_history", "entries/"+entryID, []interface{}{principal, entry, notebook})
+	allowed, reason, err := evalAllowed(p, principal, entry, notebook)
+	decision.Finish(allowed, reason, err)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return types.Entry{}, false
+	}
+	if !allowed {
+		w.WriteHeader(http.StatusUnauthorized)
+		return types.Entry{}, false
+	}
+
+	return entry, true
+}
@@ -4,32 +4,114 @@ import (
 	"fmt"
 	"net/http"
 
-	"cuelang.org/go/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
 	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/requestid"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
 	"github.com/gorilla/mux"
 )
 
-func GetEntryHandler(users *map[string]types.User, entries *map[string]types.Entry) func(w http.ResponseWriter, r *http.Request) {
-	// config is our CUE 'policy' code
-	const config = `
+// getEntryConfig is our CUE 'policy' code, sharing is inherited from the
+// notebook unless the entry overrides it. Groups from JWT claims are only
+// trusted for users with a verified email, the organizational units of a
+// client certificate are groups too. Reported entries can also be read by users
+// whose roles are granted permission to in role_permissions. Service accounts
+// can only read with a grant. The first rule which is set decides, giving the
+// reason for the decision.
+const getEntryConfig = `
+import "list"
+
 entry: {
     User: string
+    Readers: [...string]
+    Editors: [...string]
+    Groups: [...string]
+    Notebook: string
+    OverrideSharing: bool
+    Reported: bool
+    Private: bool
+}
+notebook: {
+    User: string
+    Readers: [...string]
+    Editors: [...string]
 }
 user: string
+principal_type: "user" | "service_account"
+grants: [...string]
+scopes: [...string]
+claims: {...}
+certificate: *null | {...}
+roles: [...string]
+role_permissions: [string]: [...string]
+
+#inherits: entry.Notebook != "" && !entry.OverrideSharing
+
+#verified: *(claims.email_verified & true) | false
+#claimGroups: *(claims.groups & [...string]) | []
+#sharedGroups: [ for g in #claimGroups if list.Contains(entry.Groups, g) { g } ]
+#certificateUnits: *(certificate.OrganizationalUnit & [...string]) | []
+#sharedUnits: [ for u in #certificateUnits if list.Contains(entry.Groups, u) { u } ]
+
+#permissions: [ for r, ps in role_permissions if list.Contains(roles, r) for p in ps { p } ]
 
-allowed: entry.User == user
+// service accounts aren't part of any sharing, only their grants apply
+#granted: list.Contains(grants, "read_all_entries")
+#serviceAccount: principal_type == "service_account"
+
+#rules: [
+    // scoped tokens must also hold entries:read
+    {set: !list.Contains(scopes, "entries:read"), allowed: false, reason: "missing scope entries:read"},
+    {set: #serviceAccount && #granted, allowed: true, reason: "grant read_all_entries"},
+    {set: #serviceAccount, allowed: false, reason: "missing grant read_all_entries"},
+    {set: entry.User == user, allowed: true, reason: "owner"},
+    {set: list.Contains(entry.Readers, user), allowed: true, reason: "reader"},
+    {set: list.Contains(entry.Editors, user), allowed: true, reason: "editor"},
+    {set: #verified && len(#sharedGroups) > 0, allowed: true, reason: "group"},
+    {set: len(#sharedUnits) > 0, allowed: true, reason: "certificate group"},
+    // moderators can read reported entries unless they're private
+    {
+        set: entry.Reported && list.Contains(#permissions, "read_private_reported_entries"),
+        allowed: true,
+        reason: "permission read_private_reported_entries",
+    },
+    {
+        set: entry.Reported && !entry.Private && list.Contains(#permissions, "read_reported_entries"),
+        allowed: true,
+        reason: "permission read_reported_entries",
+    },
+    {
+        set: #inherits && (notebook.User == user ||
+            list.Contains(notebook.Readers, user) ||
+            list.Contains(notebook.Editors, user)),
+        allowed: true,
+        reason: "notebook sharing",
+    },
+    {set: true, allowed: false, reason: "not shared with the user"},
+]
+
+#decision: [ for r in #rules if r.set { r } ][0]
+allowed: #decision.allowed
+reason: #decision.reason
 `
 
-	// we're going to share the CUE runtime between requests
-	var rt cue.Runtime
+func GetEntryHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook) func(w http.ResponseWriter, r *http.Request) {
+	// the config is compiled once and shared between requests
+	p, err := newPolicy("get_entry", getEntryConfig)
+	if err != nil {
+		return health.Unavailable(engine, "get_entry", err)
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		// we're using a bearer token, we have a helper to look up the user
-		// from using the data in the headers
-		userName, responseCode := helpers.AuthnUser(&r.Header, users)
-		if responseCode > 0 {
-			w.WriteHeader(responseCode)
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
@@ -41,39 +123,26 @@ allowed: entry.User == user
 		}
 
 		// check that the entry exists
-		entry, ok := (*entries)[entryID]
+		entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, entryID)
 		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		// first compile the cue code to make sure it's valid
-		instance, err := rt.Compile("get_entry", config)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		// next, poplate the list of users and the headers from the request
-		instance, err = instance.Fill(userName, "user")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		instance, err = instance.Fill(entry, "entry")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		decision := decisions.Start(r.Context(), engine, principal, "read_entry", "entries/"+entryID, []interface{}{principal, entry, notebook})
 
-		// load the results from the instance
-		allowed, err := instance.Lookup("allowed").Bool()
+		key := decisioncache.NewKey(engine, principal, "read_entry", "entries/"+entryID)
+		allowed, reason, err := decisioncache.Check(r.Context(), key, func() (bool, string, error) {
+			return evalAllowed(p, principal, entry, notebook)
+		})
 		if err != nil {
-			fmt.Println(err)
+			requestid.Printf(r.Context(), "failed to evaluate get_entry: %s", err)
+			decision.Finish(false, "", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
+		decision.Finish(allowed, reason, nil)
 		if !allowed {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
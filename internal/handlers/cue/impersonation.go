@@ -0,0 +1,69 @@
+package cue
+
+import (
+	"net/http"
+
+	"cuelang.org/go/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+)
+
+// impersonationConfig permits admins to act as any other user who isn't also
+// an admin
+const impersonationConfig = `
+import "list"
+
+actor: {
+	Roles: [...string]
+	...
+}
+target: {
+	Roles: [...string]
+	...
+}
+
+#rules: [
+	{set: !list.Contains(actor.Roles, "admin"), allowed: false, reason: "not an admin"},
+	{set: list.Contains(target.Roles, "admin"), allowed: false, reason: "target is an admin"},
+	{set: true, allowed: true, reason: "admin"},
+]
+
+#decision: [ for r in #rules if r.set { r } ][0]
+allowed: #decision.allowed
+reason: #decision.reason
+`
+
+// ImpersonationPolicy evaluates the impersonation config for the actor and
+// target, both must be known users
+func ImpersonationPolicy(users *userstore.Store) authn.ImpersonationPolicy {
+	p, err := newPolicy("impersonation", impersonationConfig)
+	if err != nil {
+		return decisions.RecordImpersonation(engine, func(r *http.Request, actor types.Principal, target string) (bool, string, error) {
+			return false, "", err
+		})
+	}
+
+	return decisions.RecordImpersonation(engine, func(r *http.Request, actor types.Principal, target string) (bool, string, error) {
+		actorUser, ok := users.Get(actor.Name)
+		if !ok {
+			return false, "unknown user", nil
+		}
+		targetUser, ok := users.Get(target)
+		if !ok {
+			return false, "unknown user", nil
+		}
+
+		var allowed bool
+		var reason string
+		err := p.eval([]fill{
+			{"actor", actorUser},
+			{"target", targetUser},
+		}, func(instance *cue.Instance) (err error) {
+			allowed, reason, err = lookupDecision(instance, "impersonation")
+			return err
+		})
+		return allowed, reason, err
+	})
+}
@@ -0,0 +1,63 @@
+package cue
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// SearchHandler returns the entries matching the query in the q parameter,
+// only entries the user is permitted to read are included
+func SearchHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook, index *search.Index) func(w http.ResponseWriter, r *http.Request) {
+	p, err := newPolicy("get_entry", getEntryConfig)
+	if err != nil {
+		return health.Unavailable(engine, "get_entry", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		query := r.URL.Query().Get("q")
+		if strings.TrimSpace(query) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var results []search.Result
+		for _, id := range index.Search(query) {
+			entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, id)
+			if !ok {
+				continue
+			}
+
+			// results are checked with the same policy as the GetEntryHandler
+			decision := decisions.Start(r.Context(), engine, principal, "read_entry", "entries/"+id, []interface{}{principal, entry, notebook})
+			allowed, reason, err := evalAllowed(p, principal, entry, notebook)
+			decision.Finish(allowed, reason, err)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				continue
+			}
+
+			results = append(results, search.NewResult(id, entry, query))
+		}
+
+		search.WriteResults(w, results)
+	}
+}
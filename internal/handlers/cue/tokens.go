@@ -0,0 +1,257 @@
+package cue
+
+import (
+	"net/http"
+
+	"cuelang.org/go/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// manageTokenConfig permits users to issue, see and revoke only their own
+// tokens
+const manageTokenConfig = `
+user: string
+token: {
+	User: string
+	...
+}
+
+#rules: [
+	{set: token.User != user, allowed: false, reason: "token of another user"},
+	{set: true, allowed: true, reason: "owner"},
+]
+
+#decision: [ for r in #rules if r.set { r } ][0]
+allowed: #decision.allowed
+reason: #decision.reason
+`
+
+// revokeTokenConfig permits users to revoke their own tokens, but not admins
+// acting as them
+const revokeTokenConfig = `
+user: string
+impersonator: string
+token: {
+	User: string
+	...
+}
+
+#rules: [
+	{set: impersonator != "", allowed: false, reason: "impersonated"},
+	{set: token.User != user, allowed: false, reason: "token of another user"},
+	{set: true, allowed: true, reason: "owner"},
+]
+
+#decision: [ for r in #rules if r.set { r } ][0]
+allowed: #decision.allowed
+reason: #decision.reason
+`
+
+// issueTokenConfig also stops a scoped token being used to issue a token with
+// scopes it doesn't hold, tokens are only issued to users and not when the
+// principal's risk is elevated by recent failed attempts to authenticate.
+// Admins acting as the user can't issue tokens, which would outlive the
+// impersonation and not record who issued them.
+const issueTokenConfig = `
+import "list"
+
+user: string
+principal_type: "user" | "service_account"
+impersonator: string
+risk: string
+scopes: [...string]
+token: {
+	User: string
+	Scopes: [...string]
+	...
+}
+
+#exceeded: [ for s in token.Scopes if !list.Contains(scopes, s) { s } ]
+
+#rules: [
+	{set: principal_type != "user", allowed: false, reason: "not a user"},
+	{set: token.User != user, allowed: false, reason: "token of another user"},
+	{set: impersonator != "", allowed: false, reason: "impersonated"},
+	{set: risk == "elevated", allowed: false, reason: "elevated risk"},
+	{set: len(#exceeded) > 0, allowed: false, reason: "missing scope \(#exceeded[0])"},
+	{set: true, allowed: true, reason: "owner"},
+]
+
+#decision: [ for r in #rules if r.set { r } ][0]
+allowed: #decision.allowed
+reason: #decision.reason
+`
+
+// canManageToken evaluates the manage token policy for a user and token
+func canManageToken(p *policy, userName string, token types.Token) (allowed bool, reason string, err error) {
+	err = p.eval([]fill{
+		{"user", userName},
+		{"token", token},
+	}, func(instance *cue.Instance) error {
+		allowed, reason, err = lookupDecision(instance, "manage_token")
+		return err
+	})
+	return allowed, reason, err
+}
+
+// canIssueToken evaluates the issue token policy for a principal and token
+func canIssueToken(p *policy, principal types.Principal, token types.Token) (allowed bool, reason string, err error) {
+	err = p.eval([]fill{
+		{"user", principal.Name},
+		{"principal_type", principal.Type},
+		{"impersonator", principal.Impersonator},
+		{"risk", principal.Risk},
+		{"scopes", principal.Scopes},
+		{"token", token},
+	}, func(instance *cue.Instance) error {
+		allowed, reason, err = lookupDecision(instance, "issue_token")
+		return err
+	})
+	return allowed, reason, err
+}
+
+// canRevokeToken evaluates the revoke token policy for a principal and token
+func canRevokeToken(p *policy, principal types.Principal, token types.Token) (allowed bool, reason string, err error) {
+	err = p.eval([]fill{
+		{"user", principal.Name},
+		{"impersonator", principal.Impersonator},
+		{"token", token},
+	}, func(instance *cue.Instance) error {
+		allowed, reason, err = lookupDecision(instance, "revoke_token")
+		return err
+	})
+	return allowed, reason, err
+}
+
+// CreateTokenHandler issues a new token to the user, the secret is returned
+// in the response
+func CreateTokenHandler(tokens *authn.Tokens) func(w http.ResponseWriter, r *http.Request) {
+	p, err := newPolicy("issue_token", issueTokenConfig)
+	if err != nil {
+		return health.Unavailable(engine, "issue_token", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userName := principal.Name
+
+		payload, err := helpers.ReadCreateTokenPayload(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		requested := types.Token{User: userName, Name: payload.Name, Scopes: payload.RequestedScopes()}
+		decision := decisions.Start(r.Context(), engine, principal, "issue_token", "tokens", []interface{}{principal, requested})
+		allowed, reason, err := canIssueToken(p, principal, requested)
+		decision.Finish(allowed, reason, err)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		token, secret, err := tokens.Issue(userName, requested.Name, requested.Scopes, payload.Lifetime())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		helpers.WriteIssuedToken(w, token, secret)
+	}
+}
+
+// ListTokensHandler lists the tokens the user is permitted to manage
+func ListTokensHandler(tokens *authn.Tokens) func(w http.ResponseWriter, r *http.Request) {
+	p, err := newPolicy("manage_token", manageTokenConfig)
+	if err != nil {
+		return health.Unavailable(engine, "manage_token", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userName := principal.Name
+
+		var permitted []types.Token
+		for _, token := range tokens.All() {
+			decision := decisions.Start(r.Context(), engine, principal, "read_token", "tokens/"+token.ID, []interface{}{userName, token})
+			allowed, reason, err := canManageToken(p, userName, token)
+			decision.Finish(allowed, reason, err)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if allowed {
+				permitted = append(permitted, token)
+			}
+		}
+
+		helpers.WriteTokens(w, permitted)
+	}
+}
+
+// RevokeTokenHandler revokes a token, it can't be used from then on
+func RevokeTokenHandler(tokens *authn.Tokens) func(w http.ResponseWriter, r *http.Request) {
+	p, err := newPolicy("revoke_token", revokeTokenConfig)
+	if err != nil {
+		return health.Unavailable(engine, "revoke_token", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		tokenID, ok := mux.Vars(r)["tokenID"]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		token, ok := tokens.Get(tokenID)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		decision := decisions.Start(r.Context(), engine, principal, "revoke_token", "tokens/"+tokenID, []interface{}{principal, token})
+		allowed, reason, err := canRevokeToken(p, principal, token)
+		decision.Finish(allowed, reason, err)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		tokens.Revoke(tokenID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
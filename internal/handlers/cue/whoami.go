@@ -1,33 +1,41 @@
 package cue
 
 import (
-	"fmt"
 	"net/http"
 
 	"cuelang.org/go/cue"
-	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
 )
 
 // WhoAmIHandler is the cue implementation of the first task
-func WhoAmIHandler(users *map[string]types.User) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		const config = `
-import "strings"
-
+func WhoAmIHandler(users *userstore.Store) func(w http.ResponseWriter, r *http.Request) {
+	const config = `
 users: [string]: {
     Token: string
 }
-headers: [string]: [string]
-
-#auth_header_value: *headers.Authorization[0] | ""
-#token: *strings.Split(#auth_header_value, " ")[1] | ""
+principal: {
+    Name: string
+    Type: "user" | "service_account"
+    ...
+}
 
-#matched: [
+// service accounts were checked by their authenticator, users must be known
+#matchedUsers: [
 	for name, user in users
-	if user.Token == #token {
+	if principal.Type == "user" && name == principal.Name {
 		name
 	}
 ]
+#matchedServiceAccounts: [
+	if principal.Type == "service_account" {
+		principal.Name
+	}
+]
+#matched: #matchedUsers + #matchedServiceAccounts
 
 #codes: [
 	{
@@ -35,11 +43,7 @@ headers: [string]: [string]
 		value: 200,
 	},
 	{
-		set: #auth_header_value != "" && #token == "",
-		value: 400,
-	},
-	{
-		set: #auth_header_value == "" || len(#matched) != 1,
+		set: len(#matched) != 1,
 		value: 401,
 	},
 	{
@@ -48,44 +52,75 @@ headers: [string]: [string]
 	},
 ]
 
+#reasons: [
+	{
+		set: len(#matchedServiceAccounts) == 1,
+		value: "service account",
+	},
+	{
+		set: len(#matchedUsers) == 1,
+		value: "known user",
+	},
+	{
+		set: true,
+		value: "unknown user",
+	},
+]
+
 name: *#matched[0] | ""
 code: [ for c in #codes if c.set { c.value } ][0]
+reason: [ for r in #reasons if r.set { r.value } ][0]
 `
 
-		var rt cue.Runtime
+	// the config is compiled once, each request's users and principal are
+	// filled into it
+	p, err := newPolicy("whoami", config)
+	if err != nil {
+		return health.Unavailable(engine, "whoami", err)
+	}
 
-		// first compile the cue code to make sure it's valid
-		instance, err := rt.Compile("whoami", config)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		// next, poplate the list of users and the headers from the request
-		instance, err = instance.Fill(users, "users")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		instance, err = instance.Fill(r.Header, "headers")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
+		decision := decisions.Start(r.Context(), engine, principal, "whoami", "users/"+principal.Name, principal)
+
+		// populate the list of users and the principal from the request, then
 		// load the results from the instance
-		code, err := instance.Lookup("code").Int64()
+		var code int64
+		var name, reason string
+		err := p.eval([]fill{
+			{"users", users.All()},
+			{"principal", principal},
+		}, func(instance *cue.Instance) (err error) {
+			code, err = lookupInt64(instance, "whoami", "code")
+			if err != nil {
+				return err
+			}
+			name, err = lookupString(instance, "whoami", "name")
+			if err != nil {
+				return err
+			}
+			reason, err = lookupString(instance, "whoami", "reason")
+			return err
+		})
 		if err != nil {
+			decision.Finish(false, "", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		name, err := instance.Lookup("name").String()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		decision.Finish(code == http.StatusOK, reason, nil)
+		if code != http.StatusOK {
+			w.WriteHeader(int(code))
 			return
 		}
 
-		w.WriteHeader(int(code))
-		fmt.Fprintf(w, name)
+		helpers.WriteWhoAmI(w, r, name, principal.Type)
 	}
 }
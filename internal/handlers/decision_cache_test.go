@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/metrics"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestDecisionCache(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123", Friends: []string{"Bob"}},
+		"Bob":     {Token: "456", Friends: []string{"Alice", "Charlie"}},
+		"Charlie": {Token: "789", Friends: []string{"Bob"}},
+	})
+
+	registry := metrics.NewRegistry()
+	router := mux.NewRouter()
+	router.Use(decisioncache.Middleware(decisioncache.New(100, registry)))
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+	router.HandleFunc("/golang/friendrequests", golang.CreateFriendRequestHandler(users))
+	router.HandleFunc("/polar/friendrequests", polar.CreateFriendRequestHandler(users))
+	store := mustRegoStore(users)
+	router.HandleFunc("/rego/friendrequests", rego.CreateFriendRequestHandler(store))
+
+	languages := []string{"golang", "rego", "polar"}
+
+	request := func(t *testing.T, language string, want int) {
+		req, err := http.NewRequest("POST", fmt.Sprintf("/%s/friendrequests", language), bytes.NewBufferString(`{"friend":"Charlie"}`))
+		if err != nil {
+			t.Fatalf("failed to build request: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer 123")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if got := w.Code; got != want {
+			t.Fatalf("unexpected response code: got %d want %d", got, want)
+		}
+	}
+
+	scrape := func(t *testing.T, name, language string) float64 {
+		rr := httptest.NewRecorder()
+		metrics.Handler(registry)(rr, httptest.NewRequest("GET", "/metrics", nil))
+		return parseMetrics(t, rr.Body).Samples[fmt.Sprintf(`%s{engine="%s"}`, name, language)]
+	}
+
+	for _, language := range languages {
+		t.Run(fmt.Sprintf("repeated requests are cached %s", language), func(t *testing.T) {
+			request(t, language, http.StatusOK)
+			request(t, language, http.StatusOK)
+
+			if got, want := scrape(t, "authz_decision_cache_misses_total", language), 1.0; got != want {
+				t.Fatalf("unexpected misses: got %v want %v", got, want)
+			}
+			if got, want := scrape(t, "authz_decision_cache_hits_total", language), 1.0; got != want {
+				t.Fatalf("unexpected hits: got %v want %v", got, want)
+			}
+		})
+	}
+
+	// the friendship between bob and charlie is changed through the users
+	// store alone, which every engine reads
+	befriend := func(t *testing.T, friends bool) {
+		bob, _ := users.Get("Bob")
+		charlie, _ := users.Get("Charlie")
+		if friends {
+			bob.Friends, charlie.Friends = []string{"Alice", "Charlie"}, []string{"Bob"}
+		} else {
+			bob.Friends, charlie.Friends = []string{"Alice"}, []string{}
+		}
+		if err := users.Put(context.Background(), "Bob", bob); err != nil {
+			t.Fatalf("failed to update bob: %s", err)
+		}
+		if err := users.Put(context.Background(), "Charlie", charlie); err != nil {
+			t.Fatalf("failed to update charlie: %s", err)
+		}
+	}
+
+	// removing the only mutual friend must be seen by the next request, not
+	// answered with the decision cached before
+	befriend(t, false)
+	for _, language := range languages {
+		t.Run(fmt.Sprintf("revoked friendships aren't cached %s", language), func(t *testing.T) {
+			request(t, language, http.StatusUnauthorized)
+
+			if got, want := scrape(t, "authz_decision_cache_misses_total", language), 2.0; got != want {
+				t.Fatalf("unexpected misses: got %v want %v", got, want)
+			}
+		})
+	}
+
+	// and so must making the friendship again, rather than the denial
+	befriend(t, true)
+	for _, language := range languages {
+		t.Run(fmt.Sprintf("restored friendships aren't cached %s", language), func(t *testing.T) {
+			request(t, language, http.StatusOK)
+
+			if got, want := scrape(t, "authz_decision_cache_misses_total", language), 3.0; got != want {
+				t.Fatalf("unexpected misses: got %v want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecisionCacheEviction(t *testing.T) {
+	cache := decisioncache.New(2, metrics.NewRegistry())
+	principal := types.Principal{Type: types.PrincipalTypeUser, Name: "Alice"}
+
+	var evaluations int
+	check := func(resource string) {
+		key := decisioncache.NewKey("golang", principal, "read_entry", resource)
+		_, _, err := cache.Check(key, func() (bool, string, error) {
+			evaluations++
+			return true, "owner", nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	check("entries/1")
+	check("entries/2")
+	check("entries/1")
+	check("entries/3")
+	if got, want := cache.Len(), 2; got != want {
+		t.Fatalf("unexpected cache size: got %d want %d", got, want)
+	}
+
+	// entries/2 was the least recently used, so it was evicted
+	check("entries/1")
+	check("entries/2")
+	if got, want := evaluations, 4; got != want {
+		t.Fatalf("unexpected evaluations: got %d want %d", got, want)
+	}
+
+	// nothing is cached with a size of zero
+	cache = decisioncache.New(0, metrics.NewRegistry())
+	check("entries/1")
+	check("entries/1")
+	if got, want := cache.Len(), 0; got != want {
+		t.Fatalf("unexpected cache size: got %d want %d", got, want)
+	}
+}
@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestDecisionLog(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123", Roles: []string{"admin"}},
+		"Bob":   {Token: "456", Roles: []string{"member"}},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary"},
+		"2": {User: "Bob", Content: "band camp"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	ring := decisions.NewRing(100)
+	router := newDecisionsRouter(users, entryStore, &notebooks, decisions.NewLog(ring))
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	type expectedDecision struct {
+		Principal    string
+		Impersonator string
+		Action       string
+		Resource     string
+		Result       string
+		Reason       string
+	}
+
+	testCases := []struct {
+		Description       string
+		Token             string
+		ActAs             string
+		Path              string
+		ExpectedStatus    int
+		ExpectedDecisions []expectedDecision
+	}{
+		{
+			Description:    "permitted read is recorded as allowed",
+			Token:          "123",
+			Path:           "/entries/1",
+			ExpectedStatus: http.StatusOK,
+			ExpectedDecisions: []expectedDecision{
+				{Principal: "Alice", Action: "read_entry", Resource: "entries/1", Result: decisions.ResultAllow, Reason: "owner"},
+			},
+		},
+		{
+			Description:    "denied read is recorded as denied",
+			Token:          "456",
+			Path:           "/entries/1",
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedDecisions: []expectedDecision{
+				{Principal: "Bob", Action: "read_entry", Resource: "entries/1", Result: decisions.ResultDeny, Reason: "not shared with the user"},
+			},
+		},
+		{
+			Description:    "missing entry has no decision",
+			Token:          "123",
+			Path:           "/entries/3",
+			ExpectedStatus: http.StatusNotFound,
+		},
+		{
+			Description:    "whoami is recorded",
+			Token:          "456",
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusOK,
+			ExpectedDecisions: []expectedDecision{
+				{Principal: "Bob", Action: "whoami", Resource: "users/Bob", Result: decisions.ResultAllow, Reason: "known user"},
+			},
+		},
+		{
+			Description:    "impersonation is recorded before the decisions made as the target",
+			Token:          "123",
+			ActAs:          "Bob",
+			Path:           "/entries/2",
+			ExpectedStatus: http.StatusOK,
+			ExpectedDecisions: []expectedDecision{
+				{Principal: "Alice", Action: "impersonate", Resource: "users/Bob", Result: decisions.ResultAllow, Reason: "admin"},
+				{Principal: "Bob", Impersonator: "Alice", Action: "read_entry", Resource: "entries/2", Result: decisions.ResultAllow, Reason: "owner"},
+			},
+		},
+		{
+			Description:    "denied impersonation is recorded",
+			Token:          "456",
+			ActAs:          "Alice",
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedDecisions: []expectedDecision{
+				{Principal: "Bob", Action: "impersonate", Resource: "users/Alice", Result: decisions.ResultDeny, Reason: "not an admin"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				before := len(ring.Decisions())
+
+				req, err := http.NewRequest("GET", fmt.Sprintf("/%s%s", language, tc.Path), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Authorization", "Bearer "+tc.Token)
+				if tc.ActAs != "" {
+					req.Header.Set("X-Act-As", tc.ActAs)
+				}
+
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+
+				if rr.Code != tc.ExpectedStatus {
+					t.Fatalf("unexpected response code: got %d want %d", rr.Code, tc.ExpectedStatus)
+				}
+
+				recorded := ring.Decisions()[before:]
+				if len(recorded) != len(tc.ExpectedDecisions) {
+					t.Fatalf("unexpected number of decisions: got %d want %d", len(recorded), len(tc.ExpectedDecisions))
+				}
+
+				for i, expected := range tc.ExpectedDecisions {
+					decision := recorded[i]
+					got := expectedDecision{
+						Principal:    decision.Principal,
+						Impersonator: decision.Impersonator,
+						Action:       decision.Action,
+						Resource:     decision.Resource,
+						Result:       decision.Result,
+						Reason:       decision.Reason,
+					}
+					if got != expected {
+						t.Fatalf("unexpected decision: got %+v want %+v", got, expected)
+					}
+					if decision.Engine != language {
+						t.Fatalf("unexpected engine: got %s want %s", decision.Engine, language)
+					}
+					if !strings.HasPrefix(decision.InputDigest, "sha256:") {
+						t.Fatalf("unexpected input digest: %s", decision.InputDigest)
+					}
+					if decision.Timestamp.IsZero() || decision.LatencyMS < 0 {
+						t.Fatalf("incomplete decision: %+v", decision)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDecisionReasons(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123", Roles: []string{"admin"}},
+		"Bob":     {Token: "456", Roles: []string{"member"}},
+		"Charlie": {Token: "789", Roles: []string{"admin"}},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary", Readers: []string{"Bob"}},
+		"2": {User: "Alice", Content: "meeting notes", Notebook: "work"},
+		"3": {User: "Alice", Content: "plans", Editors: []string{"Bob"}, Notebook: "work"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{
+		"work": {User: "Alice", Readers: []string{"Bob"}},
+	}
+
+	ring := decisions.NewRing(100)
+	router := newDecisionsRouter(users, entryStore, &notebooks, decisions.NewLog(ring))
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description    string
+		Token          string
+		ActAs          string
+		Path           string
+		ExpectedReason string
+	}{
+		{
+			Description:    "reader is recorded",
+			Token:          "456",
+			Path:           "/entries/1",
+			ExpectedReason: "reader",
+		},
+		{
+			Description:    "notebook sharing is recorded",
+			Token:          "456",
+			Path:           "/entries/2",
+			ExpectedReason: "notebook sharing",
+		},
+		{
+			Description:    "entry sharing is preferred to notebook sharing",
+			Token:          "456",
+			Path:           "/entries/3",
+			ExpectedReason: "editor",
+		},
+		{
+			Description:    "impersonating an admin is recorded",
+			Token:          "123",
+			ActAs:          "Charlie",
+			Path:           "/whoami",
+			ExpectedReason: "target is an admin",
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				before := len(ring.Decisions())
+
+				req := httptest.NewRequest("GET", fmt.Sprintf("/%s%s", language, tc.Path), nil)
+				req.Header.Set("Authorization", "Bearer "+tc.Token)
+				if tc.ActAs != "" {
+					req.Header.Set("X-Act-As", tc.ActAs)
+				}
+				router.ServeHTTP(httptest.NewRecorder(), req)
+
+				recorded := ring.Decisions()[before:]
+				if len(recorded) != 1 {
+					t.Fatalf("unexpected number of decisions: got %d want 1", len(recorded))
+				}
+				if recorded[0].Reason != tc.ExpectedReason {
+					t.Fatalf("unexpected reason: got %q want %q", recorded[0].Reason, tc.ExpectedReason)
+				}
+			})
+		}
+	}
+}
+
+func TestDecisionDebugHandler(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123", Roles: []string{"admin"}},
+		"Bob":   {Token: "456", Roles: []string{"member"}},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	ring := decisions.NewRing(2)
+	router := newDecisionsRouter(users, entryStore, &notebooks, decisions.NewLog(ring))
+	router.HandleFunc("/debug/decisions", decisions.DebugHandler(ring))
+
+	// only the last two decisions are kept
+	for _, language := range []string{"golang", "rego", "cue"} {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/%s/entries/1", language), nil)
+		req.Header.Set("Authorization", "Bearer 456")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	testCases := []struct {
+		Description    string
+		Token          string
+		ExpectedStatus int
+		ExpectedEngine []string
+	}{
+		{
+			Description:    "admin can list the recent decisions",
+			Token:          "123",
+			ExpectedStatus: http.StatusOK,
+			ExpectedEngine: []string{"rego", "cue"},
+		},
+		{
+			Description:    "member can't list decisions",
+			Token:          "456",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/debug/decisions", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.Token)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.ExpectedStatus {
+				t.Fatalf("unexpected response code: got %d want %d", rr.Code, tc.ExpectedStatus)
+			}
+			if tc.ExpectedStatus != http.StatusOK {
+				return
+			}
+
+			var listed []decisions.Decision
+			if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil {
+				t.Fatalf("failed to parse decisions: %s", err)
+			}
+			var engines []string
+			for _, decision := range listed {
+				engines = append(engines, decision.Engine)
+			}
+			if fmt.Sprint(engines) != fmt.Sprint(tc.ExpectedEngine) {
+				t.Fatalf("unexpected decisions: got %v want %v", engines, tc.ExpectedEngine)
+			}
+		})
+	}
+}
+
+func TestDecisionSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decisions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stdout bytes.Buffer
+	path := filepath.Join(dir, "decisions.log")
+	// each decision is over 100 bytes, so each file holds a single one
+	file, err := decisions.NewRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	log := decisions.NewLog(decisions.NewWriter(&stdout), file)
+	for _, resource := range []string{"entries/1", "entries/2", "entries/3", "entries/4"} {
+		log.Record(decisions.Decision{Engine: "golang", Principal: "Alice", Action: "read_entry", Resource: resource, Result: decisions.ResultAllow})
+	}
+
+	t.Run("writer has a line per decision", func(t *testing.T) {
+		resources := readDecisionResources(t, &stdout)
+		if fmt.Sprint(resources) != "[entries/1 entries/2 entries/3 entries/4]" {
+			t.Fatalf("unexpected decisions: %v", resources)
+		}
+	})
+
+	t.Run("rotating file keeps the latest decisions and backups", func(t *testing.T) {
+		expected := map[string]string{
+			path:        "[entries/4]",
+			path + ".1": "[entries/3]",
+			path + ".2": "[entries/2]",
+		}
+		for name, want := range expected {
+			f, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resources := readDecisionResources(t, f)
+			f.Close()
+			if fmt.Sprint(resources) != want {
+				t.Fatalf("unexpected decisions in %s: got %v want %s", name, resources, want)
+			}
+		}
+		if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+			t.Fatalf("expected only 2 backups to be kept")
+		}
+	})
+}
+
+func readDecisionResources(t *testing.T, r io.Reader) []string {
+	var resources []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var decision decisions.Decision
+		if err := json.Unmarshal(scanner.Bytes(), &decision); err != nil {
+			t.Fatalf("failed to parse decision line: %s", err)
+		}
+		resources = append(resources, decision.Resource)
+	}
+	return resources
+}
+
+func newDecisionsRouter(users *userstore.Store, entries *entrystore.Store, notebooks *map[string]types.Notebook, log *decisions.Log) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(
+		decisions.Middleware(log),
+		authn.Middleware(authn.BearerToken{Users: users}),
+		authn.Impersonation(map[string]authn.ImpersonationPolicy{
+			"golang": golang.ImpersonationPolicy(users),
+			"rego":   rego.ImpersonationPolicy(users),
+			"cue":    cue.ImpersonationPolicy(users),
+			"polar":  polar.ImpersonationPolicy(users),
+		}, nil),
+		authn.UserRoles(users),
+	)
+	router.HandleFunc("/golang/whoami", golang.WhoAmIHandler(users))
+	router.HandleFunc("/rego/whoami", rego.WhoAmIHandler(mustRegoStore(users)))
+	router.HandleFunc("/cue/whoami", cue.WhoAmIHandler(users))
+	router.HandleFunc("/polar/whoami", polar.WhoAmIHandler(users))
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entries, notebooks))
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entries, notebooks))
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entries, notebooks))
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entries, notebooks))
+	return router
+}
@@ -0,0 +1,333 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+// revisionsTestData returns fresh users and entries for each test since the
+// update endpoints change the entries
+func revisionsTestData() (*userstore.Store, *entrystore.Store) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123"},
+		"Bob":     {Token: "456"},
+		"Charlie": {Token: "789"},
+		"Dennis":  {Token: "101"},
+	})
+	entries := map[string]types.Entry{
+		"1": {
+			User:    "Alice",
+			Content: "Dear diary, third time lucky",
+			Readers: []string{"Charlie"},
+			Editors: []string{"Bob"},
+			Revisions: []types.Revision{
+				{
+					Content:    "Dear diary",
+					ReplacedBy: "Alice",
+					ReplacedAt: time.Date(2021, 5, 1, 9, 0, 0, 0, time.UTC),
+				},
+				{
+					Content:    "Dear diary, again",
+					ReplacedBy: "Bob",
+					ReplacedAt: time.Date(2021, 5, 2, 9, 0, 0, 0, time.UTC),
+				},
+			},
+		},
+	}
+	return users, entrystore.New(entries)
+}
+
+func newRevisionsRouter(users *userstore.Store, entries *entrystore.Store, notebooks *map[string]types.Notebook) *mux.Router {
+	index := search.NewIndex(entries)
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entries, notebooks)).Methods("GET")
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entries, notebooks)).Methods("GET")
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entries, notebooks)).Methods("GET")
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entries, notebooks)).Methods("GET")
+
+	router.HandleFunc("/golang/entries/{entryID}", golang.UpdateEntryHandler(entries, notebooks, index)).Methods("PUT")
+	router.HandleFunc("/rego/entries/{entryID}", rego.UpdateEntryHandler(entries, notebooks, index)).Methods("PUT")
+	router.HandleFunc("/cue/entries/{entryID}", cue.UpdateEntryHandler(entries, notebooks, index)).Methods("PUT")
+	router.HandleFunc("/polar/entries/{entryID}", polar.UpdateEntryHandler(entries, notebooks, index)).Methods("PUT")
+
+	router.HandleFunc("/golang/entries/{entryID}/revisions", golang.ListEntryRevisionsHandler(entries, notebooks))
+	router.HandleFunc("/rego/entries/{entryID}/revisions", rego.ListEntryRevisionsHandler(entries, notebooks))
+	router.HandleFunc("/cue/entries/{entryID}/revisions", cue.ListEntryRevisionsHandler(entries, notebooks))
+	router.HandleFunc("/polar/entries/{entryID}/revisions", polar.ListEntryRevisionsHandler(entries, notebooks))
+
+	router.HandleFunc("/golang/entries/{entryID}/revisions/{revisionID}", golang.GetEntryRevisionHandler(entries, notebooks))
+	router.HandleFunc("/rego/entries/{entryID}/revisions/{revisionID}", rego.GetEntryRevisionHandler(entries, notebooks))
+	router.HandleFunc("/cue/entries/{entryID}/revisions/{revisionID}", cue.GetEntryRevisionHandler(entries, notebooks))
+	router.HandleFunc("/polar/entries/{entryID}/revisions/{revisionID}", polar.GetEntryRevisionHandler(entries, notebooks))
+
+	return router
+}
+
+func TestEntryRevisionsEndpoints(t *testing.T) {
+	users, entries := revisionsTestData()
+	notebooks := map[string]types.Notebook{}
+	router := newRevisionsRouter(users, entries, &notebooks)
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description      string
+		Headers          map[string]string
+		Path             string
+		ExpectedStatus   int
+		ExpectedResponse string
+	}{
+		{
+			Description: "owner can list revisions",
+			Headers: map[string]string{
+				"Authorization": "Bearer 123",
+			},
+			Path:             "/entries/1/revisions",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: `[{"id":1,"replaced_by":"Alice","replaced_at":"2021-05-01T09:00:00Z"},{"id":2,"replaced_by":"Bob","replaced_at":"2021-05-02T09:00:00Z"}]`,
+		},
+		{
+			Description: "editor can list revisions",
+			Headers: map[string]string{
+				"Authorization": "Bearer 456",
+			},
+			Path:             "/entries/1/revisions",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: `[{"id":1,"replaced_by":"Alice","replaced_at":"2021-05-01T09:00:00Z"},{"id":2,"replaced_by":"Bob","replaced_at":"2021-05-02T09:00:00Z"}]`,
+		},
+		{
+			Description: "reader cannot list revisions",
+			Headers: map[string]string{
+				"Authorization": "Bearer 789",
+			},
+			Path:           "/entries/1/revisions",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description: "other user cannot list revisions",
+			Headers: map[string]string{
+				"Authorization": "Bearer 101",
+			},
+			Path:           "/entries/1/revisions",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description: "owner can get a revision",
+			Headers: map[string]string{
+				"Authorization": "Bearer 123",
+			},
+			Path:             "/entries/1/revisions/1",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Dear diary",
+		},
+		{
+			Description: "editor can get a revision",
+			Headers: map[string]string{
+				"Authorization": "Bearer 456",
+			},
+			Path:             "/entries/1/revisions/2",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Dear diary, again",
+		},
+		{
+			Description: "reader cannot get a revision",
+			Headers: map[string]string{
+				"Authorization": "Bearer 789",
+			},
+			Path:           "/entries/1/revisions/1",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description: "reader cannot learn if a revision exists",
+			Headers: map[string]string{
+				"Authorization": "Bearer 789",
+			},
+			Path:           "/entries/1/revisions/3",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description: "revision not found",
+			Headers: map[string]string{
+				"Authorization": "Bearer 123",
+			},
+			Path:           "/entries/1/revisions/3",
+			ExpectedStatus: http.StatusNotFound,
+		},
+		{
+			Description: "entry not found",
+			Headers: map[string]string{
+				"Authorization": "Bearer 123",
+			},
+			Path:           "/entries/2/revisions",
+			ExpectedStatus: http.StatusNotFound,
+		},
+		{
+			Description: "bad request",
+			Headers: map[string]string{
+				"Authorization": "123", // missing bearer
+			},
+			Path:           "/entries/1/revisions",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				req, err := http.NewRequest("GET", fmt.Sprintf("/%s%s", language, tc.Path), nil)
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+
+				for k, v := range tc.Headers {
+					req.Header.Set(k, v)
+				}
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				body, err := ioutil.ReadAll(w.Body)
+				if err != nil {
+					t.Fatalf("failed to read request: %s", err)
+				}
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+
+				if got, want := string(body), tc.ExpectedResponse; got != want {
+					t.Fatalf("unexpected body: got %s want %s", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestUpdateEntryEndpoints(t *testing.T) {
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description    string
+		Token          string
+		ExpectedStatus int
+		// ExpectedRevisions is the number of revisions after the update
+		ExpectedRevisions int
+	}{
+		{
+			Description:       "owner can update an entry",
+			Token:             "123",
+			ExpectedStatus:    http.StatusOK,
+			ExpectedRevisions: 3,
+		},
+		{
+			Description:       "editor can update an entry",
+			Token:             "456",
+			ExpectedStatus:    http.StatusOK,
+			ExpectedRevisions: 3,
+		},
+		{
+			Description:       "reader cannot update an entry",
+			Token:             "789",
+			ExpectedStatus:    http.StatusUnauthorized,
+			ExpectedRevisions: 2,
+		},
+		{
+			Description:       "other user cannot update an entry",
+			Token:             "101",
+			ExpectedStatus:    http.StatusUnauthorized,
+			ExpectedRevisions: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				users, entries := revisionsTestData()
+				notebooks := map[string]types.Notebook{}
+				router := newRevisionsRouter(users, entries, &notebooks)
+				original, _ := entries.Get("1")
+
+				req, err := http.NewRequest("PUT", fmt.Sprintf("/%s/entries/1", language), bytes.NewReader([]byte(`{"content": "Dear diary, once more"}`)))
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				req.Header.Set("Authorization", "Bearer "+tc.Token)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+
+				entry, _ := entries.Get("1")
+				if got, want := len(entry.Revisions), tc.ExpectedRevisions; got != want {
+					t.Fatalf("unexpected number of revisions: got %d want %d", got, want)
+				}
+				if tc.ExpectedStatus != http.StatusOK {
+					if got, want := entry.Content, original.Content; got != want {
+						t.Fatalf("unexpected content: got %s want %s", got, want)
+					}
+					return
+				}
+
+				// the replaced content must be available as the latest revision
+				req, err = http.NewRequest("GET", fmt.Sprintf("/%s/entries/1/revisions/%d", language, tc.ExpectedRevisions), nil)
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				req.Header.Set("Authorization", "Bearer "+tc.Token)
+
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				body, err := ioutil.ReadAll(w.Body)
+				if err != nil {
+					t.Fatalf("failed to read request: %s", err)
+				}
+				if got, want := w.Code, http.StatusOK; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+				if got, want := string(body), original.Content; got != want {
+					t.Fatalf("unexpected body: got %s want %s", got, want)
+				}
+
+				// readers see the new content
+				req, err = http.NewRequest("GET", fmt.Sprintf("/%s/entries/1", language), nil)
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				req.Header.Set("Authorization", "Bearer 789")
+
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				body, err = ioutil.ReadAll(w.Body)
+				if err != nil {
+					t.Fatalf("failed to read request: %s", err)
+				}
+				if got, want := string(body), "Dear diary, once more"; got != want {
+					t.Fatalf("unexpected body: got %s want %s", got, want)
+				}
+			})
+		}
+	}
+}
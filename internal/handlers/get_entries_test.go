@@ -7,29 +7,37 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
 	"github.com/gorilla/mux"
 )
 
 func TestGetEntriesEndpoints(t *testing.T) {
-	var users = map[string]types.User{
-		"Alice": {Token: "123"},
-		"Bob":   {Token: "456"},
-	}
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123"},
+		"Bob":     {Token: "456"},
+		"Charlie": {Token: "789"},
+		"Dennis":  {Token: "101"},
+	})
 	var entries = map[string]types.Entry{
 		"1": {User: "Alice", Content: "Dear diary..."},
-		"2": {User: "Bob", Content: "I have a secret to tell..."},
+		"2": {User: "Bob", Content: "I have a secret to tell...", Readers: []string{"Charlie"}, Editors: []string{"Dennis"}},
 	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
 
 	router := mux.NewRouter()
-	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(&users, &entries))
-	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(&users, &entries))
-	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(&users, &entries))
-	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(&users, &entries))
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks))
 
 	languages := []string{"golang", "rego", "cue", "polar"}
 
@@ -66,6 +74,32 @@ func TestGetEntriesEndpoints(t *testing.T) {
 			EntryID:        2,
 			ExpectedStatus: http.StatusUnauthorized,
 		},
+		{
+			Description: "permitted request for a reader of a shared entry",
+			Headers: map[string]string{
+				"Authorization": "Bearer 789",
+			},
+			EntryID:          2,
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "I have a secret to tell...",
+		},
+		{
+			Description: "permitted request for an editor of a shared entry",
+			Headers: map[string]string{
+				"Authorization": "Bearer 101",
+			},
+			EntryID:          2,
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "I have a secret to tell...",
+		},
+		{
+			Description: "denied request for an entry shared with others",
+			Headers: map[string]string{
+				"Authorization": "Bearer 789",
+			},
+			EntryID:        1,
+			ExpectedStatus: http.StatusUnauthorized,
+		},
 		{
 			Description: "not found",
 			Headers: map[string]string{
@@ -4,40 +4,23 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
-	"strings"
 
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
 )
 
 // CreateFriendRequestHandler will create a new friend request between two
 // users, if permitted
-func CreateFriendRequestHandler(users *map[string]types.User) func(w http.ResponseWriter, r *http.Request) {
+func CreateFriendRequestHandler(users *userstore.Store) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// extract the token if supplied
-		auth := r.Header.Get("Authorization")
-		if auth == "" {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		if !strings.HasPrefix(auth, "Bearer ") {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		token := strings.TrimSpace(strings.Replace(auth, "Bearer ", "", 1))
-
-		// look up requesting user
-		var requestingUsername string
-		var requestingUser *types.User
-		for name, user := range *users {
-			if user.Token == token {
-				requestingUser = &user
-				requestingUsername = name
-				break
-			}
-		}
-
-		// token matched no user
-		if requestingUsername == "" {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
@@ -57,67 +40,108 @@ func CreateFriendRequestHandler(users *map[string]types.User) func(w http.Respon
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		var friendUsername string
-		var friendUser *types.User
-		for name, user := range *users {
-			if name == payload.Friend {
-				friendUser = &user
-				friendUsername = name
-				break
-			}
-		}
+		friendUsername := payload.Friend
+		friendUser, ok := helpers.LoadUser(r.Context(), users, friendUsername)
 
 		// no user exists, retrun 404
-		if friendUsername == "" {
+		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		// find path of mutual friends
-		var reachedFriends []string
-		var unexploredFriends []string
-		for _, existingFriend := range requestingUser.Friends {
-			unexploredFriends = append(unexploredFriends, existingFriend)
+		decision := decisions.Start(r.Context(), engine, principal, "create_friend_request", "friend_requests", principal)
+
+		// friend requests can't be made with tokens which lack the scope,
+		// whatever the user's friendships are. Service accounts aren't in the
+		// friend graph at all.
+		if !contains(principal.Scopes, types.ScopeFriendsWrite) {
+			decision.Finish(false, "missing scope friends:write", nil)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if principal.Type != types.PrincipalTypeUser {
+			decision.Finish(false, "not a user", nil)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// look up requesting user
+		requestingUsername := principal.Name
+		requestingUser, ok := helpers.LoadUser(r.Context(), users, requestingUsername)
+		if !ok {
+			decision.Finish(false, "unknown user", nil)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
 		}
 
-		// naive loop though all the friends aggregating potential new connections as we find them
-		for {
-			// no more work to do, a connection was not found :(
-			if len(unexploredFriends) == 0 {
-				break
+		// the path of mutual friends is only searched for when the decision
+		// for this request isn't cached
+		key := decisioncache.NewKey(engine, principal, "create_friend_request", "users/"+friendUsername)
+		allowed, reason, err := decisioncache.Check(r.Context(), key, func() (bool, string, error) {
+			if connected(users, &requestingUser, friendUsername) {
+				return true, "connected through friends", nil
 			}
+			return false, "not connected through friends", nil
+		})
+		if err != nil {
+			decision.Finish(false, "", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		decision.Finish(allowed, reason, nil)
 
-			currentFriend := unexploredFriends[0]
-			unexploredFriends = unexploredFriends[1:]
-			reachedFriends = append(reachedFriends, currentFriend)
-
-			currentFriendUser, _ := (*users)[currentFriend]
-			for _, friend := range currentFriendUser.Friends {
-				alreadyReached := false
-				for _, reachedFriend := range reachedFriends {
-					if friend == reachedFriend {
-						alreadyReached = true
-						break
-					}
-				}
-				if !alreadyReached {
-					unexploredFriends = append(unexploredFriends, friend)
-				}
+		// return 401 if there was no connection found
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 
-				// if the friend was found, and matches the requested friend then we allow the request
-				if friend == friendUsername {
-					// update the target user's list of FriendRequests
-					friendUser.FriendRequests = append(friendUser.FriendRequests, requestingUsername)
+		// update the target user's list of FriendRequests
+		friendUser.FriendRequests = append(friendUser.FriendRequests, requestingUsername)
 
-					// just return 200 ok if allowed, don't bother to update the state
-					// since not a real application
-					w.WriteHeader(http.StatusOK)
-					return
+		// just return 200 ok if allowed, don't bother to update the state
+		// since not a real application
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// connected finds if there's a path of mutual friends from the requesting user
+// to the friend
+func connected(users *userstore.Store, requestingUser *types.User, friendUsername string) bool {
+	var reachedFriends []string
+	var unexploredFriends []string
+	for _, existingFriend := range requestingUser.Friends {
+		unexploredFriends = append(unexploredFriends, existingFriend)
+	}
+
+	// naive loop though all the friends aggregating potential new connections as we find them
+	for {
+		// no more work to do, a connection was not found :(
+		if len(unexploredFriends) == 0 {
+			return false
+		}
+
+		currentFriend := unexploredFriends[0]
+		unexploredFriends = unexploredFriends[1:]
+		reachedFriends = append(reachedFriends, currentFriend)
+
+		currentFriendUser, _ := users.Get(currentFriend)
+		for _, friend := range currentFriendUser.Friends {
+			alreadyReached := false
+			for _, reachedFriend := range reachedFriends {
+				if friend == reachedFriend {
+					alreadyReached = true
+					break
 				}
 			}
-		}
+			if !alreadyReached {
+				unexploredFriends = append(unexploredFriends, friend)
+			}
 
-		// return 401 if there was no connection found
-		w.WriteHeader(http.StatusUnauthorized)
+			// if the friend was found, and matches the requested friend then we allow the request
+			if friend == friendUsername {
+				return true
+			}
+		}
 	}
 }
@@ -0,0 +1,5 @@
+package golang
+
+// engine is the name decisions made by this package's policies are recorded
+// under
+const engine = "golang"
@@ -0,0 +1,151 @@
+package golang
+
+import "github.com/charlieegan3/go-authz-dsls/internal/types"
+
+// canReadEntry is true for the owner of the entry and anyone it has been
+// shared with, either as a reader or an editor, or through a group in their
+// verified JWT claims or client certificate. Sharing is inherited from the
+// notebook unless the entry overrides it. Reported entries can also be read by
+// roles permitted to read them. Service accounts need the read_all_entries
+// grant instead. The principal must also hold the entries:read scope. The
+// reason is the first rule which permitted reading, or why none did.
+func canReadEntry(principal types.Principal, entry types.Entry, notebook types.Notebook) (bool, string) {
+	if !contains(principal.Scopes, types.ScopeEntriesRead) {
+		return false, "missing scope entries:read"
+	}
+
+	// service accounts aren't part of any sharing, only their grants apply
+	if principal.Type == types.PrincipalTypeServiceAccount {
+		if contains(principal.Grants, types.GrantReadAllEntries) {
+			return true, "grant read_all_entries"
+		}
+		return false, "missing grant read_all_entries"
+	}
+
+	userName := principal.Name
+	switch {
+	case entry.User == userName:
+		return true, "owner"
+	case contains(entry.Readers, userName):
+		return true, "reader"
+	case contains(entry.Editors, userName):
+		return true, "editor"
+	}
+
+	// groups are only trusted for users with a verified email
+	if verified, _ := principal.Claims["email_verified"].(bool); verified {
+		groups, _ := principal.Claims["groups"].([]interface{})
+		for _, group := range groups {
+			if name, ok := group.(string); ok && contains(entry.Groups, name) {
+				return true, "group"
+			}
+		}
+	}
+
+	// the organizational units of a verified client certificate are treated
+	// as groups too
+	if principal.Certificate != nil {
+		for _, unit := range principal.Certificate.OrganizationalUnit {
+			if contains(entry.Groups, unit) {
+				return true, "certificate group"
+			}
+		}
+	}
+
+	// moderators and admins can read reported entries, but only the right
+	// permission allows reading private ones
+	if entry.Reported {
+		if hasPermission(principal, types.PermissionReadPrivateReported) {
+			return true, "permission read_private_reported_entries"
+		}
+		if !entry.Private && hasPermission(principal, types.PermissionReadReported) {
+			return true, "permission read_reported_entries"
+		}
+	}
+
+	if inheritsSharing(entry) &&
+		(notebook.User == userName ||
+			contains(notebook.Readers, userName) ||
+			contains(notebook.Editors, userName)) {
+		return true, "notebook sharing"
+	}
+
+	return false, "not shared with the user"
+}
+
+// canUpdateEntry is true for the owner of the entry and the editors it has
+// been shared with, including editors of its notebook, when they hold the
+// entries:write scope. Service accounts can't update entries.
+func canUpdateEntry(principal types.Principal, entry types.Entry, notebook types.Notebook) (bool, string) {
+	if !contains(principal.Scopes, types.ScopeEntriesWrite) {
+		return false, "missing scope entries:write"
+	}
+	if principal.Type != types.PrincipalTypeUser {
+		return false, "not a user"
+	}
+
+	userName := principal.Name
+	switch {
+	case entry.User == userName:
+		return true, "owner"
+	case contains(entry.Editors, userName):
+		return true, "editor"
+	case inheritsSharing(entry) &&
+		(notebook.User == userName || contains(notebook.Editors, userName)):
+		return true, "notebook sharing"
+	}
+
+	return false, "not an editor"
+}
+
+// canSeeEntryHistory is kept separate from canUpdateEntry even though the
+// rules are currently the same, readers must never see old revisions since
+// they may contain content that was removed for a reason. Reading history
+// only needs the entries:read scope. Service accounts can't see history.
+func canSeeEntryHistory(principal types.Principal, entry types.Entry, notebook types.Notebook) (bool, string) {
+	if !contains(principal.Scopes, types.ScopeEntriesRead) {
+		return false, "missing scope entries:read"
+	}
+	if principal.Type != types.PrincipalTypeUser {
+		return false, "not a user"
+	}
+
+	userName := principal.Name
+	switch {
+	case entry.User == userName:
+		return true, "owner"
+	case contains(entry.Editors, userName):
+		return true, "editor"
+	case inheritsSharing(entry) &&
+		(notebook.User == userName || contains(notebook.Editors, userName)):
+		return true, "notebook sharing"
+	}
+
+	return false, "not an editor"
+}
+
+// hasPermission is true when one of the principal's roles grants the
+// permission in types.RolePermissions
+func hasPermission(principal types.Principal, permission string) bool {
+	for _, role := range principal.Roles {
+		if contains(types.RolePermissions[role], permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// inheritsSharing is true when the entry is in a notebook and hasn't
+// overridden its sharing
+func inheritsSharing(entry types.Entry) bool {
+	return entry.Notebook != "" && !entry.OverrideSharing
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package golang
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// ListEntryRevisionsHandler lists the past revisions of an entry for users
+// permitted to see its history
+func ListEntryRevisionsHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		entryID, ok := mux.Vars(r)["entryID"]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, entryID)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		decision := decisions.Start(r.Context(), engine, principal, "read_entry_history", "entries/"+entryID, []interface{}{principal, entry, notebook})
+		allowed, reason := canSeeEntryHistory(principal, entry, notebook)
+		decision.Finish(allowed, reason, nil)
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		helpers.WriteRevisions(w, entry.Revisions)
+	}
+}
+
+// GetEntryRevisionHandler returns the content of a single past revision of an
+// entry for users permitted to see its history
+func GetEntryRevisionHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		entryID, ok := vars["entryID"]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, entryID)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// the history check comes before the revision lookup so that the
+		// number of revisions isn't leaked to those who can't see them
+		decision := decisions.Start(r.Context(), engine, principal, "read_entry_history", "entries/"+entryID, []interface{}{principal, entry, notebook})
+		allowed, reason := canSeeEntryHistory(principal, entry, notebook)
+		decision.Finish(allowed, reason, nil)
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		revision, ok := helpers.LookupRevision(entry, vars["revisionID"])
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, revision.Content)
+	}
+}
@@ -4,18 +4,22 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
 	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
 	"github.com/gorilla/mux"
 )
 
-func GetEntryHandler(users *map[string]types.User, entries *map[string]types.Entry) func(w http.ResponseWriter, r *http.Request) {
+func GetEntryHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// we're using a bearer token, we have a helper to look up the user
-		// from using the data in the headers
-		userName, responseCode := helpers.AuthnUser(&r.Header, users)
-		if responseCode > 0 {
-			w.WriteHeader(responseCode)
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
@@ -27,14 +31,27 @@ func GetEntryHandler(users *map[string]types.User, entries *map[string]types.Ent
 		}
 
 		// check that the entry exists
-		entry, ok := (*entries)[entryID]
+		entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, entryID)
 		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		// check that the existing entry has the same name as the current user
-		if entry.User != userName {
+		// check that the current user owns the entry, or that it has been
+		// shared with them
+		decision := decisions.Start(r.Context(), engine, principal, "read_entry", "entries/"+entryID, []interface{}{principal, entry, notebook})
+		key := decisioncache.NewKey(engine, principal, "read_entry", "entries/"+entryID)
+		allowed, reason, err := decisioncache.Check(r.Context(), key, func() (bool, string, error) {
+			allowed, reason := canReadEntry(principal, entry, notebook)
+			return allowed, reason, nil
+		})
+		if err != nil {
+			decision.Finish(false, "", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		decision.Finish(allowed, reason, nil)
+		if !allowed {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
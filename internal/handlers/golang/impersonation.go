@@ -0,0 +1,33 @@
+package golang
+
+import (
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+)
+
+// ImpersonationPolicy permits admins to act as any other user who isn't also
+// an admin
+func ImpersonationPolicy(users *userstore.Store) authn.ImpersonationPolicy {
+	return decisions.RecordImpersonation(engine, func(r *http.Request, actor types.Principal, target string) (bool, string, error) {
+		actorUser, ok := users.Get(actor.Name)
+		if !ok {
+			return false, "unknown user", nil
+		}
+		targetUser, ok := users.Get(target)
+		if !ok {
+			return false, "unknown user", nil
+		}
+
+		switch {
+		case !contains(actorUser.Roles, "admin"):
+			return false, "not an admin", nil
+		case contains(targetUser.Roles, "admin"):
+			return false, "target is an admin", nil
+		}
+		return true, "admin", nil
+	})
+}
@@ -0,0 +1,52 @@
+package golang
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// SearchHandler returns the entries matching the query in the q parameter,
+// only entries the user is permitted to read are included
+func SearchHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook, index *search.Index) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		query := r.URL.Query().Get("q")
+		if strings.TrimSpace(query) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// the index has no idea who can read what, so each match is checked
+		// with the same rules as the GetEntryHandler before it's included
+		var results []search.Result
+		for _, id := range index.Search(query) {
+			entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, id)
+			if !ok {
+				continue
+			}
+			decision := decisions.Start(r.Context(), engine, principal, "read_entry", "entries/"+id, []interface{}{principal, entry, notebook})
+			allowed, reason := canReadEntry(principal, entry, notebook)
+			decision.Finish(allowed, reason, nil)
+			if !allowed {
+				continue
+			}
+			results = append(results, search.NewResult(id, entry, query))
+		}
+
+		search.WriteResults(w, results)
+	}
+}
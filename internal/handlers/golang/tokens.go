@@ -0,0 +1,161 @@
+package golang
+
+import (
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// canManageToken is true when the token belongs to the user, users can only
+// issue, see and revoke their own tokens
+func canManageToken(userName string, token types.Token) (bool, string) {
+	if token.User != userName {
+		return false, "token of another user"
+	}
+	return true, "owner"
+}
+
+// canIssueToken is true when the user can manage the token and it doesn't
+// have any scopes the principal doesn't hold, so a scoped token can't be used
+// to issue one with more access. Tokens can only be issued to users, and not
+// after recent failed attempts to authenticate since the credentials may have
+// been guessed. Admins acting as the user can't issue tokens, which would
+// outlive the impersonation and not record who issued them.
+func canIssueToken(principal types.Principal, token types.Token) (bool, string) {
+	if principal.Type != types.PrincipalTypeUser {
+		return false, "not a user"
+	}
+	if allowed, reason := canManageToken(principal.Name, token); !allowed {
+		return false, reason
+	}
+
+	if principal.Impersonator != "" {
+		return false, "impersonated"
+	}
+
+	if principal.Risk == types.RiskElevated {
+		return false, "elevated risk"
+	}
+
+	for _, scope := range token.Scopes {
+		if !contains(principal.Scopes, scope) {
+			return false, "missing scope " + scope
+		}
+	}
+
+	return true, "owner"
+}
+
+// canRevokeToken is true when the user can manage the token, unless an admin
+// is acting as them
+func canRevokeToken(principal types.Principal, token types.Token) (bool, string) {
+	if principal.Impersonator != "" {
+		return false, "impersonated"
+	}
+	return canManageToken(principal.Name, token)
+}
+
+// CreateTokenHandler issues a new token to the user, the secret is returned
+// in the response
+func CreateTokenHandler(tokens *authn.Tokens) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userName := principal.Name
+
+		payload, err := helpers.ReadCreateTokenPayload(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		requested := types.Token{User: userName, Name: payload.Name, Scopes: payload.RequestedScopes()}
+		decision := decisions.Start(r.Context(), engine, principal, "issue_token", "tokens", []interface{}{principal, requested})
+		allowed, reason := canIssueToken(principal, requested)
+		decision.Finish(allowed, reason, nil)
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		token, secret, err := tokens.Issue(userName, requested.Name, requested.Scopes, payload.Lifetime())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		helpers.WriteIssuedToken(w, token, secret)
+	}
+}
+
+// ListTokensHandler lists the tokens the user is permitted to manage
+func ListTokensHandler(tokens *authn.Tokens) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userName := principal.Name
+
+		var permitted []types.Token
+		for _, token := range tokens.All() {
+			decision := decisions.Start(r.Context(), engine, principal, "read_token", "tokens/"+token.ID, []interface{}{userName, token})
+			allowed, reason := canManageToken(userName, token)
+			decision.Finish(allowed, reason, nil)
+			if allowed {
+				permitted = append(permitted, token)
+			}
+		}
+
+		helpers.WriteTokens(w, permitted)
+	}
+}
+
+// RevokeTokenHandler revokes a token, it can't be used from then on
+func RevokeTokenHandler(tokens *authn.Tokens) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		tokenID, ok := mux.Vars(r)["tokenID"]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		token, ok := tokens.Get(tokenID)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		decision := decisions.Start(r.Context(), engine, principal, "revoke_token", "tokens/"+tokenID, []interface{}{principal, token})
+		allowed, reason := canRevokeToken(principal, token)
+		decision.Finish(allowed, reason, nil)
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		tokens.Revoke(tokenID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
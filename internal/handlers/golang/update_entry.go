@@ -0,0 +1,80 @@
+package golang
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// UpdateEntryHandler will overwrite the content of an entry, if permitted. The
+// replaced content is kept as a revision and the search index is updated
+func UpdateEntryHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook, index *search.Index) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userName := principal.Name
+
+		// get the entryID from the request vars set for us by go mux
+		entryID, ok := mux.Vars(r)["entryID"]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// check that the entry exists
+		entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, entryID)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// only the owner and editors can change the content
+		decision := decisions.Start(r.Context(), engine, principal, "update_entry", "entries/"+entryID, []interface{}{principal, entry, notebook})
+		allowed, reason := canUpdateEntry(principal, entry, notebook)
+		decision.Finish(allowed, reason, nil)
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		payloadBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var payload helpers.UpdateEntryPayload
+		err = json.Unmarshal(payloadBytes, &payload)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// the entry is revised as it's stored now, another update may have
+		// been made since it was authorized. It's indexed before the store is
+		// unlocked so that the index matches the latest content.
+		_, ok = entries.Update(entryID, func(current types.Entry) types.Entry {
+			revised := helpers.ReviseEntry(current, userName, payload.Content)
+			index.Put(entryID, revised.Content)
+			return revised
+		})
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -1,46 +1,45 @@
 package golang
 
 import (
-	"fmt"
 	"net/http"
-	"strings"
 
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
 )
 
 // WhoAmIHandler is the go implementation of the first task
-func WhoAmIHandler(users *map[string]types.User) func(w http.ResponseWriter, r *http.Request) {
+func WhoAmIHandler(users *userstore.Store) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// extract the token if supplied
-		auth := r.Header.Get("Authorization")
-		if auth == "" {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		if !strings.HasPrefix(auth, "Bearer ") {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		token := strings.TrimSpace(strings.Replace(auth, "Bearer ", "", 1))
 
-		// naively look up the user
-		var userName string
-		var found bool
-		for name, user := range *users {
-			if user.Token == token {
-				found = true
-				userName = name
+		// return 401 when the principal isn't a user we know about, service
+		// accounts have already been checked by their authenticator
+		decision := decisions.Start(r.Context(), engine, principal, "whoami", "users/"+principal.Name, principal)
+		known, reason := false, "unknown user"
+		switch principal.Type {
+		case types.PrincipalTypeServiceAccount:
+			known, reason = true, "service account"
+		case types.PrincipalTypeUser:
+			if _, ok := helpers.LoadUser(r.Context(), users, principal.Name); ok {
+				known, reason = true, "known user"
 			}
 		}
-
-		// return 401 when we can't find a user
-		if !found {
+		decision.Finish(known, reason, nil)
+		if !known {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
 		// report back the to the user who they are
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, userName)
+		helpers.WriteWhoAmI(w, r, principal.Name, principal.Type)
 	}
 }
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestPolicyHealth(t *testing.T) {
+	users := userstore.New(map[string]types.User{})
+	var entries = map[string]types.Entry{}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+	index := search.NewIndex(entryStore)
+	tokens := authn.NewTokens()
+
+	// creating the handlers compiles every policy, no requests are needed
+	rego.WhoAmIHandler(mustRegoStore(users))
+	rego.GetEntryHandler(entryStore, &notebooks)
+	rego.UpdateEntryHandler(entryStore, &notebooks, index)
+	rego.ListEntryRevisionsHandler(entryStore, &notebooks)
+	rego.CreateTokenHandler(tokens)
+	rego.ListTokensHandler(tokens)
+	rego.CreateFriendRequestHandler(mustRegoStore(users))
+	rego.ImpersonationPolicy(users)
+
+	polar.WhoAmIHandler(users)
+	polar.GetEntryHandler(entryStore, &notebooks)
+	polar.UpdateEntryHandler(entryStore, &notebooks, index)
+	polar.ListEntryRevisionsHandler(entryStore, &notebooks)
+	polar.ListTokensHandler(tokens)
+	polar.ImpersonationPolicy(users)
+
+	cue.WhoAmIHandler(users)
+	cue.GetEntryHandler(entryStore, &notebooks)
+	cue.UpdateEntryHandler(entryStore, &notebooks, index)
+	cue.ListEntryRevisionsHandler(entryStore, &notebooks)
+	cue.CreateTokenHandler(tokens)
+	cue.ListTokensHandler(tokens)
+	cue.ImpersonationPolicy(users)
+
+	report := health.Default.Report()
+
+	expected := map[string][]string{
+		"rego": {
+			"whoami.rego", "get_entry.rego", "update_entry.rego", "entry_history.rego",
+			"issue_token.rego", "manage_token.rego", "create_friend_request.rego", "impersonation.rego",
+		},
+		"polar": {"whoami", "get_entry", "update_entry", "entry_history", "tokens", "impersonation"},
+		"cue":   {"whoami", "get_entry", "update_entry", "entry_history", "issue_token", "manage_token", "impersonation"},
+	}
+	for engine, policies := range expected {
+		for _, policy := range policies {
+			t.Run(engine+" "+policy, func(t *testing.T) {
+				status, ok := report.Engines[engine].Policies[policy]
+				if !ok {
+					t.Fatalf("missing policy status")
+				}
+				if status.State != health.StateCompiled {
+					t.Fatalf("unexpected state: got %s want %s (%s)", status.State, health.StateCompiled, status.LastError)
+				}
+			})
+		}
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	checker := health.NewChecker()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/healthz", health.LivenessHandler(checker))
+	router.HandleFunc("/readyz", health.ReadinessHandler(checker))
+
+	get := func(path string) (int, health.Report) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+
+		var report health.Report
+		if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+			t.Fatalf("failed to parse report: %s", err)
+		}
+		return rr.Code, report
+	}
+
+	testCases := []struct {
+		Description     string
+		Change          func()
+		ExpectedReadyz  int
+		ExpectedState   string
+		ExpectedLastErr string
+	}{
+		{
+			Description:    "enabled engines which haven't loaded aren't ready",
+			Change:         func() { checker.Enable("rego", "cue") },
+			ExpectedReadyz: http.StatusServiceUnavailable,
+		},
+		{
+			Description: "some engines loaded isn't ready",
+			Change: func() {
+				checker.ObservePolicy("rego", "get_entry.rego", nil)
+				checker.Loaded("rego")
+			},
+			ExpectedReadyz: http.StatusServiceUnavailable,
+		},
+		{
+			Description: "all engines loaded is ready",
+			Change: func() {
+				checker.ObservePolicy("cue", "get_entry", nil)
+				checker.Loaded("cue")
+			},
+			ExpectedReadyz: http.StatusOK,
+			ExpectedState:  health.StateCompiled,
+		},
+		{
+			Description: "failing policy isn't ready",
+			Change: func() {
+				checker.ObservePolicy("cue", "get_entry", errors.New("expected operand, found '}'"))
+			},
+			ExpectedReadyz:  http.StatusServiceUnavailable,
+			ExpectedState:   health.StateFailed,
+			ExpectedLastErr: "expected operand, found '}'",
+		},
+		{
+			Description: "recompiled policy is ready and keeps its last error",
+			Change: func() {
+				checker.ObservePolicy("cue", "get_entry", nil)
+			},
+			ExpectedReadyz:  http.StatusOK,
+			ExpectedState:   health.StateCompiled,
+			ExpectedLastErr: "expected operand, found '}'",
+		},
+		{
+			Description: "failing policy of an engine which isn't enabled is only reported",
+			Change: func() {
+				checker.ObservePolicy("polar", "get_entry", errors.New("unexpected token"))
+			},
+			ExpectedReadyz:  http.StatusOK,
+			ExpectedState:   health.StateCompiled,
+			ExpectedLastErr: "expected operand, found '}'",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			tc.Change()
+
+			code, report := get("/readyz")
+			if code != tc.ExpectedReadyz {
+				t.Fatalf("unexpected response code: got %d want %d", code, tc.ExpectedReadyz)
+			}
+			if report.Ready != (tc.ExpectedReadyz == http.StatusOK) {
+				t.Fatalf("unexpected readiness in report: %+v", report)
+			}
+
+			// the server is alive whether or not it's ready
+			code, liveness := get("/healthz")
+			if code != http.StatusOK {
+				t.Fatalf("unexpected response code: got %d want %d", code, http.StatusOK)
+			}
+			if liveness.Ready != report.Ready {
+				t.Fatalf("liveness and readiness reports differ: %+v %+v", liveness, report)
+			}
+
+			if tc.ExpectedState == "" {
+				return
+			}
+			status := report.Engines["cue"].Policies["get_entry"]
+			if status.State != tc.ExpectedState {
+				t.Fatalf("unexpected state: got %s want %s", status.State, tc.ExpectedState)
+			}
+			if status.LastError != tc.ExpectedLastErr {
+				t.Fatalf("unexpected last error: got %q want %q", status.LastError, tc.ExpectedLastErr)
+			}
+		})
+	}
+
+	t.Run("handler of a failed policy is unavailable", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		health.Unavailable("rego", "get_entry.rego", errors.New("rego_parse_error"))(rr, httptest.NewRequest("GET", "/rego/entries/1", nil))
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Fatalf("unexpected response code: got %d want %d", rr.Code, http.StatusServiceUnavailable)
+		}
+	})
+}
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestImpersonation(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123", Roles: []string{"admin"}},
+		"Bob":     {Token: "456", Roles: []string{"admin"}},
+		"Charlie": {Token: "789", Roles: []string{"member"}},
+		"Dennis":  {Token: "101"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Charlie", Content: "Charlie's diary"},
+		"2": {User: "Alice", Content: "Admin notes"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description      string
+		Token            string
+		ActAs            string
+		Path             string
+		ExpectedStatus   int
+		ExpectedResponse string
+		ExpectedLog      string
+	}{
+		{
+			Description:      "admin acting as a member is identified as the member",
+			Token:            "123",
+			ActAs:            "Charlie",
+			Path:             "/whoami",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Charlie",
+			ExpectedLog:      "impersonation: Alice as Charlie: GET /%s/whoami 200",
+		},
+		{
+			Description:      "admin acting as a user without roles",
+			Token:            "123",
+			ActAs:            "Dennis",
+			Path:             "/whoami",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Dennis",
+			ExpectedLog:      "impersonation: Alice as Dennis: GET /%s/whoami 200",
+		},
+		{
+			Description:      "admin sees what the member sees",
+			Token:            "123",
+			ActAs:            "Charlie",
+			Path:             "/entries/1",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Charlie's diary",
+			ExpectedLog:      "impersonation: Alice as Charlie: GET /%s/entries/1 200",
+		},
+		{
+			Description:    "admin does not keep their own access while acting as a member",
+			Token:          "123",
+			ActAs:          "Charlie",
+			Path:           "/entries/2",
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedLog:    "impersonation: Alice as Charlie: GET /%s/entries/2 401",
+		},
+		{
+			Description:    "admin cannot act as another admin",
+			Token:          "123",
+			ActAs:          "Bob",
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedLog:    "impersonation denied: Alice as Bob: GET /%s/whoami",
+		},
+		{
+			Description:    "member cannot act as another user",
+			Token:          "789",
+			ActAs:          "Dennis",
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedLog:    "impersonation denied: Charlie as Dennis: GET /%s/whoami",
+		},
+		{
+			Description:    "admin cannot act as an unknown user",
+			Token:          "123",
+			ActAs:          "Mallory",
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedLog:    "impersonation denied: Alice as Mallory: GET /%s/whoami",
+		},
+		{
+			Description:    "acting as a user without credentials",
+			ActAs:          "Charlie",
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:      "requests without the header are unaffected",
+			Token:            "123",
+			Path:             "/entries/2",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Admin notes",
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				var logs bytes.Buffer
+
+				router := mux.NewRouter()
+				router.Use(
+					authn.Middleware(authn.BearerToken{Users: users}),
+					authn.Impersonation(map[string]authn.ImpersonationPolicy{
+						"golang": golang.ImpersonationPolicy(users),
+						"rego":   rego.ImpersonationPolicy(users),
+						"cue":    cue.ImpersonationPolicy(users),
+						"polar":  polar.ImpersonationPolicy(users),
+					}, log.New(&logs, "", 0)),
+				)
+				router.HandleFunc("/golang/whoami", golang.WhoAmIHandler(users))
+				router.HandleFunc("/rego/whoami", rego.WhoAmIHandler(mustRegoStore(users)))
+				router.HandleFunc("/cue/whoami", cue.WhoAmIHandler(users))
+				router.HandleFunc("/polar/whoami", polar.WhoAmIHandler(users))
+				router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks))
+				router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks))
+				router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks))
+				router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks))
+
+				req, err := http.NewRequest("GET", fmt.Sprintf("/%s%s", language, tc.Path), nil)
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				if tc.Token != "" {
+					req.Header.Set("Authorization", "Bearer "+tc.Token)
+				}
+				if tc.ActAs != "" {
+					req.Header.Set(authn.ActAsHeader, tc.ActAs)
+				}
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				body, err := ioutil.ReadAll(w.Body)
+				if err != nil {
+					t.Fatalf("failed to read request: %s", err)
+				}
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+
+				if got, want := string(body), tc.ExpectedResponse; got != want {
+					t.Fatalf("unexpected body: got %s want %s", got, want)
+				}
+
+				// both identities are recorded when impersonating
+				if got, want := strings.TrimSpace(logs.String()), strings.Replace(tc.ExpectedLog, "%s", language, 1); got != want {
+					t.Fatalf("unexpected log: got %q want %q", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestImpersonationTokens(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123", Roles: []string{"admin"}},
+		"Charlie": {Token: "789", Roles: []string{"member"}},
+	})
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description    string
+		ActAs          string
+		Method         string
+		Path           string
+		Body           string
+		ExpectedStatus int
+		ExpectedTokens int
+	}{
+		{
+			Description:    "admin cannot issue a token while acting as a member",
+			ActAs:          "Charlie",
+			Method:         "POST",
+			Path:           "/tokens",
+			Body:           `{"name": "laptop"}`,
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedTokens: 1,
+		},
+		{
+			Description:    "admin cannot revoke a token while acting as a member",
+			ActAs:          "Charlie",
+			Method:         "DELETE",
+			Path:           "/tokens/%s",
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedTokens: 1,
+		},
+		{
+			Description:    "admin can list the member's tokens while acting as them",
+			ActAs:          "Charlie",
+			Method:         "GET",
+			Path:           "/tokens",
+			ExpectedStatus: http.StatusOK,
+			ExpectedTokens: 1,
+		},
+		{
+			Description:    "admin can issue their own tokens",
+			Method:         "POST",
+			Path:           "/tokens",
+			Body:           `{"name": "laptop"}`,
+			ExpectedStatus: http.StatusCreated,
+			ExpectedTokens: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				tokens := authn.NewTokens()
+				existing, _, err := tokens.Issue("Charlie", "phone", types.AllScopes, time.Hour)
+				if err != nil {
+					t.Fatalf("failed to issue token: %s", err)
+				}
+
+				router := mux.NewRouter()
+				router.Use(
+					authn.Middleware(authn.BearerToken{Users: users}),
+					authn.Impersonation(map[string]authn.ImpersonationPolicy{
+						"golang": golang.ImpersonationPolicy(users),
+						"rego":   rego.ImpersonationPolicy(users),
+						"cue":    cue.ImpersonationPolicy(users),
+						"polar":  polar.ImpersonationPolicy(users),
+					}, log.New(ioutil.Discard, "", 0)),
+				)
+				router.HandleFunc("/golang/tokens", golang.CreateTokenHandler(tokens)).Methods("POST")
+				router.HandleFunc("/rego/tokens", rego.CreateTokenHandler(tokens)).Methods("POST")
+				router.HandleFunc("/cue/tokens", cue.CreateTokenHandler(tokens)).Methods("POST")
+				router.HandleFunc("/polar/tokens", polar.CreateTokenHandler(tokens)).Methods("POST")
+				router.HandleFunc("/golang/tokens", golang.ListTokensHandler(tokens)).Methods("GET")
+				router.HandleFunc("/rego/tokens", rego.ListTokensHandler(tokens)).Methods("GET")
+				router.HandleFunc("/cue/tokens", cue.ListTokensHandler(tokens)).Methods("GET")
+				router.HandleFunc("/polar/tokens", polar.ListTokensHandler(tokens)).Methods("GET")
+				router.HandleFunc("/golang/tokens/{tokenID}", golang.RevokeTokenHandler(tokens)).Methods("DELETE")
+				router.HandleFunc("/rego/tokens/{tokenID}", rego.RevokeTokenHandler(tokens)).Methods("DELETE")
+				router.HandleFunc("/cue/tokens/{tokenID}", cue.RevokeTokenHandler(tokens)).Methods("DELETE")
+				router.HandleFunc("/polar/tokens/{tokenID}", polar.RevokeTokenHandler(tokens)).Methods("DELETE")
+
+				path := fmt.Sprintf("/%s%s", language, tc.Path)
+				if strings.Contains(path, "%s") {
+					path = fmt.Sprintf(path, existing.ID)
+				}
+				req, err := http.NewRequest(tc.Method, path, strings.NewReader(tc.Body))
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				req.Header.Set("Authorization", "Bearer 123")
+				if tc.ActAs != "" {
+					req.Header.Set(authn.ActAsHeader, tc.ActAs)
+				}
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+
+				// tokens aren't issued or revoked when the request is denied
+				if got, want := len(tokens.All()), tc.ExpectedTokens; got != want {
+					t.Fatalf("unexpected number of tokens: got %d want %d", got, want)
+				}
+			})
+		}
+	}
+}
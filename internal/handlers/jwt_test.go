@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+// signJWT creates a token for the tests, key is the HMAC secret or the
+// private key for the alg
+func signJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatalf("failed to marshal header: %s", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to marshal claims: %s", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign: %s", err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign: %s", err)
+		}
+		// r and s are padded to 32 bytes each
+		signature = make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+	case "none":
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// writePublicKeyPEM writes the public key to a file so that it can be loaded
+// in the same way as the server would
+func writePublicKeyPEM(t *testing.T, dir string, key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %s", err)
+	}
+	file, err := ioutil.TempFile(dir, "*.pem")
+	if err != nil {
+		t.Fatalf("failed to create key file: %s", err)
+	}
+	defer file.Close()
+
+	err = pem.Encode(file, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err != nil {
+		t.Fatalf("failed to write key file: %s", err)
+	}
+	return file.Name()
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+		"Bob":   {Token: "456"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "Team plans", Groups: []string{"team"}},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hmacSecret := []byte("super-secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	otherECDSAKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	rsaPublicKey, err := authn.LoadPublicKey(writePublicKeyPEM(t, dir, &rsaKey.PublicKey))
+	if err != nil {
+		t.Fatalf("failed to load key: %s", err)
+	}
+	ecdsaPublicKey, err := authn.LoadPublicKey(writePublicKeyPEM(t, dir, &ecdsaKey.PublicKey))
+	if err != nil {
+		t.Fatalf("failed to load key: %s", err)
+	}
+
+	now := time.Date(2021, 5, 8, 12, 0, 0, 0, time.UTC)
+	verifiers := map[string]authn.JWT{
+		"HS256": {Algorithm: "HS256", Key: hmacSecret},
+		"RS256": {Algorithm: "RS256", Key: rsaPublicKey},
+		"ES256": {Algorithm: "ES256", Key: ecdsaPublicKey},
+	}
+
+	routers := map[string]*mux.Router{}
+	for alg, verifier := range verifiers {
+		verifier.Issuer = "https://issuer.example.com"
+		verifier.Audience = "diary"
+		verifier.Now = func() time.Time { return now }
+
+		router := mux.NewRouter()
+		router.Use(authn.Middleware(verifier, authn.BearerToken{Users: users}))
+		router.HandleFunc("/golang/whoami", golang.WhoAmIHandler(users))
+		router.HandleFunc("/rego/whoami", rego.WhoAmIHandler(mustRegoStore(users)))
+		router.HandleFunc("/cue/whoami", cue.WhoAmIHandler(users))
+		router.HandleFunc("/polar/whoami", polar.WhoAmIHandler(users))
+		router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks))
+		router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks))
+		router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks))
+		router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks))
+		routers[alg] = router
+	}
+
+	// claims returns valid claims for the subject with any overrides
+	claims := func(sub string, overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": sub,
+			"iss": "https://issuer.example.com",
+			"aud": "diary",
+			"exp": now.Add(time.Hour).Unix(),
+			"nbf": now.Add(-time.Minute).Unix(),
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description      string
+		Algorithm        string
+		Token            string
+		Path             string
+		ExpectedStatus   int
+		ExpectedResponse string
+	}{
+		{
+			Description:      "valid HS256 token",
+			Algorithm:        "HS256",
+			Token:            signJWT(t, "HS256", hmacSecret, claims("Alice", nil)),
+			Path:             "/whoami",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Alice",
+		},
+		{
+			Description:      "valid RS256 token",
+			Algorithm:        "RS256",
+			Token:            signJWT(t, "RS256", rsaKey, claims("Bob", nil)),
+			Path:             "/whoami",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Bob",
+		},
+		{
+			Description:      "valid ES256 token with a list audience",
+			Algorithm:        "ES256",
+			Token:            signJWT(t, "ES256", ecdsaKey, claims("Alice", map[string]interface{}{"aud": []string{"other", "diary"}})),
+			Path:             "/whoami",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Alice",
+		},
+		{
+			Description:      "static tokens are still accepted",
+			Algorithm:        "HS256",
+			Token:            "456",
+			Path:             "/whoami",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Bob",
+		},
+		{
+			Description:    "expired token",
+			Algorithm:      "HS256",
+			Token:          signJWT(t, "HS256", hmacSecret, claims("Alice", map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})),
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "token missing exp",
+			Algorithm:      "HS256",
+			Token:          signJWT(t, "HS256", hmacSecret, claims("Alice", map[string]interface{}{"exp": nil})),
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "token not yet valid",
+			Algorithm:      "RS256",
+			Token:          signJWT(t, "RS256", rsaKey, claims("Alice", map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})),
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "HS256 token signed with the wrong secret",
+			Algorithm:      "HS256",
+			Token:          signJWT(t, "HS256", []byte("guessed"), claims("Alice", nil)),
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "ES256 token signed with the wrong key",
+			Algorithm:      "ES256",
+			Token:          signJWT(t, "ES256", otherECDSAKey, claims("Alice", nil)),
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "HS256 token when RS256 is expected",
+			Algorithm:      "RS256",
+			Token:          signJWT(t, "HS256", hmacSecret, claims("Alice", nil)),
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "unsigned token",
+			Algorithm:      "HS256",
+			Token:          signJWT(t, "none", nil, claims("Alice", nil)),
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "audience mismatch",
+			Algorithm:      "RS256",
+			Token:          signJWT(t, "RS256", rsaKey, claims("Alice", map[string]interface{}{"aud": "billing"})),
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "issuer mismatch",
+			Algorithm:      "ES256",
+			Token:          signJWT(t, "ES256", ecdsaKey, claims("Alice", map[string]interface{}{"iss": "https://evil.example.com"})),
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "malformed token",
+			Algorithm:      "HS256",
+			Token:          "not.a.jwt",
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Description:    "subject is not a known user",
+			Algorithm:      "HS256",
+			Token:          signJWT(t, "HS256", hmacSecret, claims("Mallory", nil)),
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:      "groups claim grants access to a shared entry",
+			Algorithm:        "HS256",
+			Token:            signJWT(t, "HS256", hmacSecret, claims("Bob", map[string]interface{}{"groups": []string{"team"}, "email_verified": true})),
+			Path:             "/entries/1",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Team plans",
+		},
+		{
+			Description:    "groups claim is ignored without a verified email",
+			Algorithm:      "ES256",
+			Token:          signJWT(t, "ES256", ecdsaKey, claims("Bob", map[string]interface{}{"groups": []string{"team"}, "email_verified": false})),
+			Path:           "/entries/1",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "groups claim for another group",
+			Algorithm:      "RS256",
+			Token:          signJWT(t, "RS256", rsaKey, claims("Bob", map[string]interface{}{"groups": []string{"finance"}, "email_verified": true})),
+			Path:           "/entries/1",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "scope claim without entries:read",
+			Algorithm:      "HS256",
+			Token:          signJWT(t, "HS256", hmacSecret, claims("Bob", map[string]interface{}{"groups": []string{"team"}, "email_verified": true, "scope": "friends:write"})),
+			Path:           "/entries/1",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:      "scope claim with entries:read",
+			Algorithm:        "HS256",
+			Token:            signJWT(t, "HS256", hmacSecret, claims("Bob", map[string]interface{}{"groups": []string{"team"}, "email_verified": true, "scope": "openid entries:read"})),
+			Path:             "/entries/1",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Team plans",
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				req, err := http.NewRequest("GET", fmt.Sprintf("/%s%s", language, tc.Path), nil)
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				req.Header.Set("Authorization", "Bearer "+tc.Token)
+
+				w := httptest.NewRecorder()
+				routers[tc.Algorithm].ServeHTTP(w, req)
+
+				body, err := ioutil.ReadAll(w.Body)
+				if err != nil {
+					t.Fatalf("failed to read request: %s", err)
+				}
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+
+				if got, want := string(body), tc.ExpectedResponse; got != want {
+					t.Fatalf("unexpected body: got %s want %s", got, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func newLoginRouter(users *userstore.Store, entries *entrystore.Store, sessions *authn.Sessions) *mux.Router {
+	var notebooks = map[string]types.Notebook{}
+	cookieSession := authn.CookieSession{Sessions: sessions}
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(
+		authn.BearerSession{Sessions: sessions},
+		authn.BearerToken{Users: users},
+		cookieSession,
+	))
+	router.HandleFunc("/login", authn.LoginHandler(users, sessions, cookieSession)).Methods("POST")
+	router.HandleFunc("/logout", authn.LogoutHandler(sessions, cookieSession)).Methods("POST")
+	router.HandleFunc("/golang/whoami", golang.WhoAmIHandler(users))
+	router.HandleFunc("/rego/whoami", rego.WhoAmIHandler(mustRegoStore(users)))
+	router.HandleFunc("/cue/whoami", cue.WhoAmIHandler(users))
+	router.HandleFunc("/polar/whoami", polar.WhoAmIHandler(users))
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entries, &notebooks))
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entries, &notebooks))
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entries, &notebooks))
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entries, &notebooks))
+
+	return router
+}
+
+func login(t *testing.T, router *mux.Router, body string) (*httptest.ResponseRecorder, string) {
+	req, err := http.NewRequest("POST", "/login", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("failed to build request: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var response struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+
+	return w, response.Token
+}
+
+func TestLoginSessions(t *testing.T) {
+	hash, err := authn.HashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("failed to hash password: %s", err)
+	}
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	for _, language := range languages {
+		t.Run(language, func(t *testing.T) {
+			users := userstore.New(map[string]types.User{
+				"Alice": {Token: "123", PasswordHash: hash},
+			})
+			var entries = map[string]types.Entry{
+				"1": {User: "Alice", Content: "Dear diary..."},
+			}
+			entryStore := entrystore.New(entries)
+			sessions := authn.NewSessions()
+			router := newLoginRouter(users, entryStore, sessions)
+
+			w, token := login(t, router, `{"user": "Alice", "password": "hunter2"}`)
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+			if token == "" {
+				t.Fatalf("no session token in response: %s", w.Body.String())
+			}
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].Value != token {
+				t.Fatalf("unexpected cookies: %v", cookies)
+			}
+
+			do := func(method, path string, setup func(r *http.Request)) *httptest.ResponseRecorder {
+				req, err := http.NewRequest(method, path, nil)
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				setup(req)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+			withBearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+			withCookie := func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: token}) }
+
+			// the session is used as a bearer token and as a cookie
+			w = do("GET", fmt.Sprintf("/%s/whoami", language), withBearer)
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+			if got, want := w.Body.String(), "Alice"; got != want {
+				t.Fatalf("unexpected body: got %s want %s", got, want)
+			}
+			w = do("GET", fmt.Sprintf("/%s/entries/1", language), withCookie)
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+
+			w = do("POST", "/logout", withBearer)
+			if got, want := w.Code, http.StatusNoContent; got != want {
+				t.Fatalf("unexpected logout response code: got %d want %d", got, want)
+			}
+
+			// the session has ended for both ways of sending it
+			for _, setup := range []func(r *http.Request){withBearer, withCookie} {
+				w = do("GET", fmt.Sprintf("/%s/entries/1", language), setup)
+				if got, want := w.Code, http.StatusUnauthorized; got != want {
+					t.Fatalf("unexpected response code after logout: got %d want %d", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	hash, err := authn.HashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("failed to hash password: %s", err)
+	}
+
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123", PasswordHash: hash},
+		"Bob":   {Token: "456"},
+	})
+	var entries = map[string]types.Entry{}
+	entryStore := entrystore.New(entries)
+	router := newLoginRouter(users, entryStore, authn.NewSessions())
+
+	testCases := []struct {
+		Description    string
+		Body           string
+		ExpectedStatus int
+	}{
+		{
+			Description:    "correct password",
+			Body:           `{"user": "Alice", "password": "hunter2"}`,
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "wrong password",
+			Body:           `{"user": "Alice", "password": "hunter3"}`,
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "token is not a password",
+			Body:           `{"user": "Alice", "password": "123"}`,
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "user without a password",
+			Body:           `{"user": "Bob", "password": ""}`,
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "unknown user",
+			Body:           `{"user": "Mallory", "password": "hunter2"}`,
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "malformed body",
+			Body:           `user=Alice&password=hunter2`,
+			ExpectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			w, token := login(t, router, tc.Body)
+
+			if got, want := w.Code, tc.ExpectedStatus; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+			if w.Code != http.StatusOK && token != "" {
+				t.Fatalf("unexpected token for failed login: %s", token)
+			}
+		})
+	}
+}
+
+func TestSessionSlidingExpiry(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+	})
+	var entries = map[string]types.Entry{}
+	entryStore := entrystore.New(entries)
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	sessions := authn.NewSessions()
+	sessions.TTL = 10 * time.Minute
+	sessions.Now = func() time.Time { return now }
+	router := newLoginRouter(users, entryStore, sessions)
+
+	id, err := sessions.Create("Alice")
+	if err != nil {
+		t.Fatalf("failed to create session: %s", err)
+	}
+
+	steps := []struct {
+		Elapsed        time.Duration
+		ExpectedStatus int
+	}{
+		// each use extends the session by the TTL
+		{Elapsed: 8 * time.Minute, ExpectedStatus: http.StatusOK},
+		{Elapsed: 8 * time.Minute, ExpectedStatus: http.StatusOK},
+		{Elapsed: 9 * time.Minute, ExpectedStatus: http.StatusOK},
+		// but it expires once it's left unused for longer
+		{Elapsed: 11 * time.Minute, ExpectedStatus: http.StatusUnauthorized},
+		{Elapsed: time.Minute, ExpectedStatus: http.StatusUnauthorized},
+	}
+
+	for i, step := range steps {
+		now = now.Add(step.Elapsed)
+
+		req, err := http.NewRequest("GET", "/golang/whoami", nil)
+		if err != nil {
+			t.Fatalf("failed to build request: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+id)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if got, want := w.Code, step.ExpectedStatus; got != want {
+			t.Fatalf("unexpected response code at step %d: got %d want %d", i, got, want)
+		}
+	}
+}
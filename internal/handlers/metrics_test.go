@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/metrics"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestDecisionMetrics(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+		"Bob":   {Token: "456"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	registry := metrics.NewRegistry()
+
+	router := mux.NewRouter()
+	router.Use(
+		decisions.Middleware(decisions.NewLog(metrics.NewDecisions(registry))),
+		authn.Middleware(authn.BearerToken{Users: users}),
+	)
+	router.HandleFunc("/metrics", metrics.Handler(registry))
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks))
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	// Alice reads her entry twice and Bob is denied once
+	for _, language := range languages {
+		for _, token := range []string{"123", "123", "456"} {
+			req := httptest.NewRequest("GET", fmt.Sprintf("/%s/entries/1", language), nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected response code: got %d want %d", rr.Code, http.StatusOK)
+	}
+	if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type: %s", contentType)
+	}
+
+	scrape := parseMetrics(t, rr.Body)
+
+	for _, language := range languages {
+		t.Run(language, func(t *testing.T) {
+			endpoint := fmt.Sprintf("/%s/entries/{entryID}", language)
+			labels := fmt.Sprintf(`endpoint="%s",engine="%s"`, endpoint, language)
+
+			expected := map[string]float64{
+				fmt.Sprintf(`authz_decisions_total{%s,result="allow"}`, labels):             2,
+				fmt.Sprintf(`authz_decisions_total{%s,result="deny"}`, labels):              1,
+				fmt.Sprintf(`authz_decision_duration_seconds_count{%s}`, labels):            3,
+				fmt.Sprintf(`authz_decision_duration_seconds_bucket{%s,le="+Inf"}`, labels): 3,
+			}
+			for series, want := range expected {
+				got, ok := scrape.Samples[series]
+				if !ok {
+					t.Fatalf("missing series %s", series)
+				}
+				if got != want {
+					t.Fatalf("unexpected value for %s: got %v want %v", series, got, want)
+				}
+			}
+
+			// buckets are cumulative
+			buckets := scrape.Buckets(fmt.Sprintf(`authz_decision_duration_seconds_bucket{%s,`, labels))
+			for i := 1; i < len(buckets); i++ {
+				if buckets[i] < buckets[i-1] {
+					t.Fatalf("buckets aren't cumulative: %v", buckets)
+				}
+			}
+		})
+	}
+
+	expectedTypes := map[string]string{
+		"authz_decisions_total":           "counter",
+		"authz_decision_duration_seconds": "histogram",
+	}
+	for name, want := range expectedTypes {
+		if got := scrape.Types[name]; got != want {
+			t.Fatalf("unexpected type for %s: got %q want %q", name, got, want)
+		}
+	}
+}
+
+func TestPolicyCompileMetrics(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	// rego and polar policies are compiled when the handler is created, cue
+	// configs when a request is handled
+	rego.GetEntryHandler(entryStore, &notebooks)
+	polar.GetEntryHandler(entryStore, &notebooks)
+	handler := cue.GetEntryHandler(entryStore, &notebooks)
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+	router.HandleFunc("/cue/entries/{entryID}", handler)
+	req := httptest.NewRequest("GET", "/cue/entries/1", nil)
+	req.Header.Set("Authorization", "Bearer 123")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	metrics.ObservePolicyCompile("test", "broken", 0, errors.New("syntax error"))
+
+	rr := httptest.NewRecorder()
+	metrics.Handler(metrics.Default)(rr, httptest.NewRequest("GET", "/metrics", nil))
+	scrape := parseMetrics(t, rr.Body)
+
+	testCases := []struct {
+		Description string
+		Series      string
+		Minimum     float64
+	}{
+		{
+			Description: "rego compile is observed",
+			Series:      `authz_policy_compile_duration_seconds_count{engine="rego",policy="get_entry.rego"}`,
+			Minimum:     1,
+		},
+		{
+			Description: "polar compile is observed",
+			Series:      `authz_policy_compile_duration_seconds_count{engine="polar",policy="get_entry"}`,
+			Minimum:     1,
+		},
+		{
+			Description: "cue compile is observed",
+			Series:      `authz_policy_compile_duration_seconds_count{engine="cue",policy="get_entry"}`,
+			Minimum:     1,
+		},
+		{
+			Description: "failed compile is counted",
+			Series:      `authz_policy_compile_failures_total{engine="test",policy="broken"}`,
+			Minimum:     1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			got, ok := scrape.Samples[tc.Series]
+			if !ok {
+				t.Fatalf("missing series %s", tc.Series)
+			}
+			if got < tc.Minimum {
+				t.Fatalf("unexpected value for %s: got %v want at least %v", tc.Series, got, tc.Minimum)
+			}
+		})
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := registry.NewCounter("escaped_total", "Help with a \\ backslash.", "value")
+	counter.Inc("a \"quoted\"\nmulti-line \\ value")
+
+	rr := httptest.NewRecorder()
+	metrics.Handler(registry)(rr, httptest.NewRequest("GET", "/metrics", nil))
+	scrape := parseMetrics(t, rr.Body)
+
+	series := `escaped_total{value="a \"quoted\"\nmulti-line \\ value"}`
+	if got := scrape.Samples[series]; got != 1 {
+		t.Fatalf("unexpected value for %s: got %v want 1\n%s", series, got, rr.Body.String())
+	}
+}
+
+// scrapedMetrics are the samples parsed from the Prometheus text format, keyed
+// by the series name and its labels sorted by name
+type scrapedMetrics struct {
+	Types   map[string]string
+	Samples map[string]float64
+}
+
+// Buckets returns the values of the series starting with prefix, ordered by
+// their le label
+func (s scrapedMetrics) Buckets(prefix string) []float64 {
+	type bucket struct {
+		le    float64
+		value float64
+	}
+	var buckets []bucket
+	for series, value := range s.Samples {
+		if !strings.HasPrefix(series, prefix) {
+			continue
+		}
+		match := regexp.MustCompile(`le="([^"]+)"`).FindStringSubmatch(series)
+		le, _ := strconv.ParseFloat(strings.TrimPrefix(match[1], "+"), 64)
+		buckets = append(buckets, bucket{le: le, value: value})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].le < buckets[j].le })
+
+	var values []float64
+	for _, b := range buckets {
+		values = append(values, b.value)
+	}
+	return values
+}
+
+var (
+	metricCommentPattern = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.*)$`)
+	metricSamplePattern  = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{.*\})? (\S+)$`)
+	metricLabelPattern   = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\]|\\[\\"n])*)"(,|$)`)
+)
+
+// parseMetrics parses the Prometheus text format, failing the test on any
+// line which isn't valid
+func parseMetrics(t *testing.T, r io.Reader) scrapedMetrics {
+	scrape := scrapedMetrics{Types: map[string]string{}, Samples: map[string]float64{}}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			match := metricCommentPattern.FindStringSubmatch(line)
+			if match == nil {
+				t.Fatalf("invalid comment line: %q", line)
+			}
+			if match[1] == "TYPE" {
+				scrape.Types[match[2]] = match[3]
+			}
+			continue
+		}
+
+		match := metricSamplePattern.FindStringSubmatch(line)
+		if match == nil {
+			t.Fatalf("invalid sample line: %q", line)
+		}
+		value, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			t.Fatalf("invalid sample value in %q: %s", line, err)
+		}
+
+		var labels []string
+		if match[2] != "" {
+			rest := strings.TrimSuffix(strings.TrimPrefix(match[2], "{"), "}")
+			for rest != "" {
+				label := metricLabelPattern.FindStringSubmatch(rest)
+				if label == nil {
+					t.Fatalf("invalid labels in %q", line)
+				}
+				labels = append(labels, fmt.Sprintf(`%s="%s"`, label[1], label[2]))
+				rest = rest[len(label[0]):]
+			}
+		}
+		sort.Strings(labels)
+
+		series := match[1]
+		if len(labels) > 0 {
+			series += "{" + strings.Join(labels, ",") + "}"
+		}
+		if _, ok := scrape.Samples[series]; ok {
+			t.Fatalf("duplicate series %s", series)
+		}
+		scrape.Samples[series] = value
+	}
+
+	return scrape
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestNotebookInheritedPermissions(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123"},
+		"Bob":     {Token: "456"},
+		"Charlie": {Token: "789"},
+		"Dennis":  {Token: "101"},
+		"Edward":  {Token: "112"},
+	})
+	var notebooks = map[string]types.Notebook{
+		"work": {User: "Alice", Readers: []string{"Charlie"}, Editors: []string{"Bob"}},
+	}
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description    string
+		Token          string
+		Method         string
+		Path           string
+		ExpectedStatus int
+	}{
+		{
+			Description:    "notebook reader can read an entry in the notebook",
+			Token:          "789",
+			Method:         "GET",
+			Path:           "/entries/1",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "notebook reader cannot read an entry overriding the sharing",
+			Token:          "789",
+			Method:         "GET",
+			Path:           "/entries/2",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "entry reader can read an entry overriding the sharing",
+			Token:          "101",
+			Method:         "GET",
+			Path:           "/entries/2",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "notebook reader cannot read an entry outside the notebook",
+			Token:          "789",
+			Method:         "GET",
+			Path:           "/entries/3",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "notebook owner can read another user's entry in the notebook",
+			Token:          "123",
+			Method:         "GET",
+			Path:           "/entries/4",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "notebook owner cannot read another user's entry overriding the sharing",
+			Token:          "123",
+			Method:         "GET",
+			Path:           "/entries/5",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "notebook editor can update an entry in the notebook",
+			Token:          "456",
+			Method:         "PUT",
+			Path:           "/entries/1",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "notebook editor cannot update an entry overriding the sharing",
+			Token:          "456",
+			Method:         "PUT",
+			Path:           "/entries/2",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "notebook reader cannot update an entry in the notebook",
+			Token:          "789",
+			Method:         "PUT",
+			Path:           "/entries/1",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "notebook editor can see the history of an entry in the notebook",
+			Token:          "456",
+			Method:         "GET",
+			Path:           "/entries/1/revisions",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "notebook reader cannot see the history of an entry in the notebook",
+			Token:          "789",
+			Method:         "GET",
+			Path:           "/entries/1/revisions",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "notebook editor cannot see the history of an entry overriding the sharing",
+			Token:          "456",
+			Method:         "GET",
+			Path:           "/entries/2/revisions",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				var entries = map[string]types.Entry{
+					"1": {User: "Alice", Content: "Meeting notes", Notebook: "work"},
+					"2": {User: "Alice", Content: "Performance review", Notebook: "work", OverrideSharing: true, Readers: []string{"Dennis"}},
+					"3": {User: "Alice", Content: "Shopping list"},
+					"4": {User: "Edward", Content: "Project plan", Notebook: "work"},
+					"5": {User: "Edward", Content: "Resignation letter", Notebook: "work", OverrideSharing: true},
+				}
+				entryStore := entrystore.New(entries)
+				router := newRevisionsRouter(users, entryStore, &notebooks)
+
+				req, err := http.NewRequest(tc.Method, fmt.Sprintf("/%s%s", language, tc.Path), bytes.NewReader([]byte(`{"content": "updated"}`)))
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				req.Header.Set("Authorization", "Bearer "+tc.Token)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestNotebookInheritedSearch(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Charlie": {Token: "789"},
+	})
+	var notebooks = map[string]types.Notebook{
+		"work": {User: "Alice", Readers: []string{"Charlie"}},
+	}
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "Meeting notes", Notebook: "work"},
+		"2": {User: "Alice", Content: "Meeting with HR", Notebook: "work", OverrideSharing: true},
+		"3": {User: "Alice", Content: "Meeting the in-laws"},
+	}
+	entryStore := entrystore.New(entries)
+	index := search.NewIndex(entryStore)
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+	router.HandleFunc("/golang/search", golang.SearchHandler(entryStore, &notebooks, index))
+	router.HandleFunc("/rego/search", rego.SearchHandler(entryStore, &notebooks, index))
+	router.HandleFunc("/cue/search", cue.SearchHandler(entryStore, &notebooks, index))
+	router.HandleFunc("/polar/search", polar.SearchHandler(entryStore, &notebooks, index))
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	for _, language := range languages {
+		t.Run(language, func(t *testing.T) {
+			req, err := http.NewRequest("GET", fmt.Sprintf("/%s/search?q=meeting", language), nil)
+			if err != nil {
+				t.Fatalf("failed to build request: %s", err)
+			}
+			req.Header.Set("Authorization", "Bearer 789")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+			if got, want := w.Body.String(), `{"count":1,"results":[{"id":"1","snippet":"Meeting notes"}]}`; got != want {
+				t.Fatalf("unexpected body: got %s want %s", got, want)
+			}
+		})
+	}
+}
@@ -1,43 +1,155 @@
 package polar
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strings"
-
+	"reflect"
+	"sync"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/requestid"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
-	"github.com/osohq/go-oso"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
 )
 
-func CreateFriendRequestHandler(users *map[string]types.User) func(w http.ResponseWriter, r *http.Request) {
-	var o oso.Oso
+// friendGraph exposes the current friendships to the policy. They go both
+// ways whichever of the users lists the other as a friend, so they're indexed
+// from the users rather than read from their friend lists, and the index is
+// rebuilt when the users change rather than for each query. The users store's
+// version is what's used to tell. Polar calls methods on a copy of the graph,
+// so the index is shared by pointer.
+type friendGraph struct {
+	users *userstore.Store
+	built *friendIndex
+}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		// extract the token if supplied
-		auth := r.Header.Get("Authorization")
-		if auth == "" {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+// friendIndex is the friends of every user as of a version of the users
+type friendIndex struct {
+	mu      sync.Mutex
+	version uint64
+	friends map[string][]string
+}
+
+func newFriendGraph(users *userstore.Store) friendGraph {
+	return friendGraph{users: users, built: &friendIndex{}}
+}
+
+// index returns the friends of every user, rebuilding it if the users have
+// changed since it was built. The version is read before the users, so that
+// an index built while they change is rebuilt by the next query.
+func (g friendGraph) index() map[string][]string {
+	g.built.mu.Lock()
+	defer g.built.mu.Unlock()
+
+	version := g.users.Version()
+	if g.built.friends != nil && g.built.version == version {
+		return g.built.friends
+	}
+
+	linked := make(map[string]map[string]bool)
+	link := func(a, b string) {
+		if linked[a] == nil {
+			linked[a] = make(map[string]bool)
 		}
-		if !strings.HasPrefix(auth, "Bearer ") {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+		linked[a][b] = true
+	}
+	g.users.Range(func(name string, user types.User) {
+		for _, friend := range user.Friends {
+			link(name, friend)
+			link(friend, name)
 		}
-		token := strings.TrimSpace(strings.Replace(auth, "Bearer ", "", 1))
+	})
 
-		// look up requesting user
-		var requestingUsername string
-		for name, user := range *users {
-			if user.Token == token {
-				requestingUsername = name
-				break
+	index := make(map[string][]string, len(linked))
+	for name, friends := range linked {
+		for friend := range friends {
+			index[name] = append(index[name], friend)
+		}
+	}
+	g.built.friends, g.built.version = index, version
+	return index
+}
+
+// Friends returns the names of the user's friends, in either direction
+func (g friendGraph) Friends(name string) []string {
+	return g.index()[name]
+}
+
+// Connected reports if there's a path of friendships between the users. The
+// search is made from both users at once, a step at a time from whichever has
+// fewer users to visit next, so it goes no deeper than needed for the paths
+// to meet. When there's no path, it stops once either user's friends of
+// friends have all been visited.
+func (g friendGraph) Connected(from, to string) bool {
+	if from == to {
+		return false
+	}
+	friends := g.index()
+
+	// each side records the users it has reached, and those reached in its
+	// last step which it hasn't searched from yet
+	reached := [2]map[string]bool{{from: true}, {to: true}}
+	frontier := [2][]string{{from}, {to}}
+	for len(frontier[0]) > 0 && len(frontier[1]) > 0 {
+		side := 0
+		if len(frontier[1]) < len(frontier[0]) {
+			side = 1
+		}
+		other := 1 - side
+
+		var next []string
+		for _, current := range frontier[side] {
+			for _, friend := range friends[current] {
+				if reached[other][friend] {
+					return true
+				}
+				if !reached[side][friend] {
+					reached[side][friend] = true
+					next = append(next, friend)
+				}
 			}
 		}
+		frontier[side] = next
+	}
+	return false
+}
 
-		// token matched no user
-		if requestingUsername == "" {
+// CreateFriendRequestHandler will create a new friend request between two
+// users, if permitted
+func CreateFriendRequestHandler(users *userstore.Store) func(w http.ResponseWriter, r *http.Request) {
+	o, err := newOso("create_friend_request", reflect.TypeOf(types.Principal{}))
+	if err != nil {
+		return health.Unavailable(engine, "create_friend_request", err)
+	}
+	// policy code which permits requests between users connected by mutual
+	// friendships, the friendships are queried from the graph
+	err = loadPolicy(context.Background(), o, "create_friend_request", `
+	    # service accounts aren't in the friend graph
+	    allow(principal: Principal { Type: "user" }, friend, graph, "connected through friends") if
+	        "friends:write" in principal.Scopes and
+	        graph.Connected(principal.Name, friend);
+
+	    deny(principal: Principal, _, _, reason) if
+	        (not "friends:write" in principal.Scopes and reason = "missing scope friends:write") or
+	        (principal.Type != "user" and reason = "not a user") or
+	        reason = "not connected through friends";`)
+	if err != nil {
+		return health.Unavailable(engine, "create_friend_request", err)
+	}
+
+	graph := newFriendGraph(users)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
@@ -57,65 +169,44 @@ func CreateFriendRequestHandler(users *map[string]types.User) func(w http.Respon
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		var friendUsername string
-		for name := range *users {
-			if name == payload.Friend {
-				friendUsername = name
-				break
-			}
-		}
 
-		// no user exists, retrun 404
-		if friendUsername == "" {
+		// no user exists, return 404
+		if _, ok := helpers.LoadUser(r.Context(), users, payload.Friend); !ok {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		// configure a new Oso instance
-		o, _ = oso.NewOso()
-
-		// load in the current friendships
-		for k, v := range *users {
-			for _, f := range v.Friends {
-				// sort names of pair and only add when ordered to avoid cycles
-				// bit of a hack, but simple
-				if k > f {
-					o.LoadString(fmt.Sprintf("friends(\"%s\", \"%s\");", k, f))
-				}
-			}
-		}
+		decision := decisions.Start(r.Context(), engine, principal, "create_friend_request", "friend_requests", principal)
 
-		// policy code which determines mutual friendships logically (in either
-		// direction)
-		o.LoadString(`
-        connected(x, y) if friends(x, y) or friends(y, x);
-        connected(x, y) if friends(x, p) and connected(p, y);
-        connected(x, y) if friends(y, p) and connected(p, x);
-
-	    allow(user, friend) if connected(user, friend);
-	    `)
-
-		query, err := o.NewQueryFromRule(
-			"allow",
-			requestingUsername,
-			friendUsername,
-		)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		// look up requesting user
+		if _, ok := helpers.LoadUser(r.Context(), users, principal.Name); !ok {
+			decision.Finish(false, "unknown user", nil)
+			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		// don't care about getting all results, just that one exists
-		result, err := query.Next()
+		// the policy is only queried when the decision for this request isn't
+		// cached
+		key := decisioncache.NewKey(engine, principal, "create_friend_request", "users/"+payload.Friend)
+		allowed, reason, err := decisioncache.Check(r.Context(), key, func() (bool, string, error) {
+			// don't care about getting all results, just that one exists
+			allowed, reason, err := queryDecision(o, "create_friend_request", "allow", "deny", principal, payload.Friend, graph)
+			if err != nil {
+				requestid.Printf(r.Context(), "failed to query create_friend_request: %s", err)
+			}
+			return allowed, reason, err
+		})
 		if err != nil {
-			fmt.Println(err)
+			decision.Finish(false, "", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
 		// if no solution, then unauthorized
-		if result == nil {
+		decision.Finish(allowed, reason, nil)
+		if !allowed {
 			w.WriteHeader(http.StatusUnauthorized)
+			return
 		}
 
 		// just return 200 ok if allowed, don't bother to update the state
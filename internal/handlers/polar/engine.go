@@ -0,0 +1,158 @@
+package polar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/metrics"
+	"github.com/charlieegan3/go-authz-dsls/internal/profile"
+	"github.com/charlieegan3/go-authz-dsls/internal/tracing"
+	"github.com/osohq/go-oso"
+	osotypes "github.com/osohq/go-oso/types"
+)
+
+// engine is the name decisions made by this package's policies are recorded
+// under
+const engine = "polar"
+
+// instance is an Oso instance which is shared by the requests to a handler.
+// Oso keeps the values given to a query in a map without a lock, so only one
+// query is made at a time, from when it's created until it's done.
+type instance struct {
+	oso.Oso
+	mu *sync.Mutex
+}
+
+// newOso creates an Oso instance with the application types registered for
+// the policy called name, failing to is recorded in the health checks like the
+// policy failing to load
+func newOso(name string, classes ...reflect.Type) (instance, error) {
+	osoInstance, err := oso.NewOso()
+	o := instance{Oso: osoInstance, mu: &sync.Mutex{}}
+	for _, class := range classes {
+		if err != nil {
+			break
+		}
+		err = o.RegisterClass(class, nil)
+	}
+	if err != nil {
+		health.ObservePolicy(engine, name, err)
+		return o, fmt.Errorf("failed to configure oso: %s", err)
+	}
+	return o, nil
+}
+
+// loadPolicy loads the policies into the Oso instance in order, how long they
+// took to load is recorded in the policy compile metrics under name and
+// whether they loaded in the health checks. Decisions cached with earlier
+// policies are invalidated. Loading during a request has a span.
+func loadPolicy(ctx context.Context, o instance, name string, policies ...string) error {
+	_, span := tracing.StartSpan(ctx, "policy.load")
+	span.SetAttribute("authz.engine", engine)
+	span.SetAttribute("authz.policy", name)
+	defer span.End()
+
+	start := time.Now()
+
+	var err error
+	for _, policy := range policies {
+		if err = o.LoadString(policy); err != nil {
+			break
+		}
+	}
+
+	metrics.ObservePolicyCompile(engine, name, time.Since(start), err)
+	health.ObservePolicy(engine, name, err)
+	decisioncache.Invalidate()
+	return err
+}
+
+// query is an Oso query which is timed when the engine is being profiled,
+// from when it's created until its first result or all of its results. The
+// instance it was made with is locked until then.
+type query struct {
+	*oso.Query
+	stop   func()
+	unlock func()
+}
+
+// newQuery queries a rule of the named policy, it's profiled as policy:rule
+// since rules of the same name are in several policies. The query must be
+// done with Next or GetAllResults before the instance can be queried again.
+func newQuery(o instance, policy, rule string, args ...interface{}) (*query, error) {
+	o.mu.Lock()
+	stop := profile.Active(engine).Time(policy + ":" + rule)
+	q, err := o.NewQueryFromRule(rule, args...)
+	if err != nil {
+		stop()
+		o.mu.Unlock()
+		return nil, err
+	}
+	return &query{Query: q, stop: stop, unlock: o.mu.Unlock}, nil
+}
+
+// Next returns the next result of the query, or nil when there are no more
+func (q *query) Next() (*map[string]interface{}, error) {
+	defer q.done()
+	return q.Query.Next()
+}
+
+// GetAllResults returns every result of the query
+func (q *query) GetAllResults() ([]map[string]interface{}, error) {
+	defer q.done()
+	return q.Query.GetAllResults()
+}
+
+// done records the query's time and unlocks its instance the first time it's
+// called
+func (q *query) done() {
+	if q.stop != nil {
+		q.stop()
+		q.unlock()
+		q.stop = nil
+	}
+}
+
+// errUnexpectedResult is recorded for decisions when a rule binds its reason
+// to something other than a string
+var errUnexpectedResult = errors.New("unexpected result from policy")
+
+// queryDecision queries the allow rule of the named policy with the args and a
+// reason variable, which the rule binds to why it permitted them. When it has
+// no results the deny rule is queried the same way for why they weren't
+// permitted. Only the first result of each is used, so the alternatives of a
+// rule are in the order their reasons are preferred.
+func queryDecision(o instance, policy, allowRule, denyRule string, args ...interface{}) (allowed bool, reason string, err error) {
+	reason, allowed, err = queryReason(o, policy, allowRule, args...)
+	if err != nil || allowed {
+		return allowed, reason, err
+	}
+
+	reason, _, err = queryReason(o, policy, denyRule, args...)
+	return false, reason, err
+}
+
+// queryReason returns the reason bound by the first result of the rule, ok is
+// false when there are no results
+func queryReason(o instance, policy, rule string, args ...interface{}) (reason string, ok bool, err error) {
+	query, err := newQuery(o, policy, rule, append(args, osotypes.ValueVariable("reason"))...)
+	if err != nil {
+		return "", false, err
+	}
+	result, err := query.Next()
+	if err != nil || result == nil {
+		return "", false, err
+	}
+
+	reason, ok = (*result)["reason"].(string)
+	if !ok {
+		return "", false, errUnexpectedResult
+	}
+	return reason, true, nil
+}
@@ -0,0 +1,115 @@
+package polar
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// entryHistoryPolicy is the policy for who may see the past revisions of an
+// entry. Unlike the GetEntryHandler policy, readers and service accounts are
+// not included.
+const entryHistoryPolicy = `
+allow_history(principal: Principal { Type: "user" }, entry, notebook, reason) if
+    "entries:read" in principal.Scopes and
+    can_see_history(principal.Name, entry, notebook, reason);
+
+deny_history(principal: Principal, _, _, reason) if
+    (not "entries:read" in principal.Scopes and reason = "missing scope entries:read") or
+    (principal.Type != "user" and reason = "not a user") or
+    reason = "not an editor";
+
+can_see_history(userName, _: Entry { User: userName }, _, "owner");
+can_see_history(userName, entry: Entry, _, "editor") if userName in entry.Editors;
+can_see_history(userName, entry: Entry, notebook: Notebook, "notebook sharing") if
+    inherits_sharing(entry) and edits_notebook(userName, notebook);`
+
+// ListEntryRevisionsHandler lists the past revisions of an entry for users
+// permitted to see its history
+func ListEntryRevisionsHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook) func(w http.ResponseWriter, r *http.Request) {
+	o, err := newEntryOso("entry_history", entryHistoryPolicy)
+	if err != nil {
+		return health.Unavailable(engine, "entry_history", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry, ok := authzEntryHistory(w, r, o, entries, notebooks)
+		if !ok {
+			return
+		}
+
+		helpers.WriteRevisions(w, entry.Revisions)
+	}
+}
+
+// GetEntryRevisionHandler returns the content of a single past revision of an
+// entry for users permitted to see its history
+func GetEntryRevisionHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook) func(w http.ResponseWriter, r *http.Request) {
+	o, err := newEntryOso("entry_history", entryHistoryPolicy)
+	if err != nil {
+		return health.Unavailable(engine, "entry_history", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry, ok := authzEntryHistory(w, r, o, entries, notebooks)
+		if !ok {
+			return
+		}
+
+		revision, ok := helpers.LookupRevision(entry, mux.Vars(r)["revisionID"])
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, revision.Content)
+	}
+}
+
+// authzEntryHistory looks up the requested entry and checks the user may see
+// its history. When not ok, the response has already been written.
+func authzEntryHistory(w http.ResponseWriter, r *http.Request, o instance, entries *entrystore.Store, notebooks *map[string]types.Notebook) (entry types.Entry, ok bool) {
+	// the principal has been set in the request context by the authn
+	// middleware
+	principal, ok := authn.PrincipalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return types.Entry{}, false
+	}
+
+	entryID, ok := mux.Vars(r)["entryID"]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return types.Entry{}, false
+	}
+
+	entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, entryID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return types.Entry{}, false
+	}
+
+	decision := decisions.Start(r.Context(), engine, principal, "read_entry_history", "entries/"+entryID, []interface{}{principal, entry, notebook})
+	allowed, reason, err := queryDecision(o, "entry_history", "allow_history", "deny_history", principal, entry, notebook)
+	decision.Finish(allowed, reason, err)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return types.Entry{}, false
+	}
+
+	// if no solution, then the user may not see the history
+	if !allowed {
+		w.WriteHeader(http.StatusUnauthorized)
+		return types.Entry{}, false
+	}
+
+	return entry, true
+}
@@ -3,32 +3,81 @@ package polar
 import (
 	"fmt"
 	"net/http"
-	"reflect"
 
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
 	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
 	"github.com/gorilla/mux"
-	"github.com/osohq/go-oso"
 )
 
-func GetEntryHandler(users *map[string]types.User, entries *map[string]types.Entry) func(w http.ResponseWriter, r *http.Request) {
-	var o oso.Oso
+// getEntryPolicy is a simple rule where the user and the entry name must
+// match, or where the entry has been shared with the user, either directly,
+// through its notebook or through a group in the user's JWT claims or client
+// certificate. Reported entries can also be read by users whose roles are
+// granted permission to in ROLE_PERMISSIONS. Service accounts can only read
+// with a grant. The principal must also hold the entries:read scope. The
+// reason is bound to the rule which permitted reading, or why none did.
+const getEntryPolicy = `
+allow(principal: Principal, entry, notebook, reason) if
+    "entries:read" in principal.Scopes and
+    principal_can_read(principal, entry, notebook, reason);
 
-	// configure a new Oso instance
-	o, _ = oso.NewOso()
+deny(principal: Principal, _, _, reason) if
+    (not "entries:read" in principal.Scopes and reason = "missing scope entries:read") or
+    (principal.Type = "service_account" and reason = "missing grant read_all_entries") or
+    reason = "not shared with the user";
 
-	// make polar aware of our application types
-	o.RegisterClass(reflect.TypeOf(types.Entry{}), nil)
+principal_can_read(principal: Principal { Type: "user" }, entry, notebook, reason) if
+    can_read(principal.Name, entry, principal.Claims, reason) or
+    (certificate_can_read(principal.Certificate, entry) and reason = "certificate group") or
+    role_can_read(principal.Roles, entry, reason) or
+    (inherits_sharing(entry) and reads_notebook(principal.Name, notebook) and reason = "notebook sharing");
+principal_can_read(principal: Principal { Type: "service_account" }, _, _, "grant read_all_entries") if
+    "read_all_entries" in principal.Grants;
 
-	// create a simple rule where the user and the entry name must match
-	o.LoadString(`allow(userName, _: Entry { User: userName });`)
+can_read(userName, _: Entry { User: userName }, _, "owner");
+can_read(userName, entry: Entry, _, "reader") if userName in entry.Readers;
+can_read(userName, entry: Entry, _, "editor") if userName in entry.Editors;
+can_read(_, entry: Entry, claims, "group") if
+    claims.email_verified = true and
+    group in claims.groups and
+    group in entry.Groups;
+
+# the organizational units of a client certificate are groups too
+certificate_can_read(certificate: Certificate, entry: Entry) if
+    unit in certificate.OrganizationalUnit and
+    unit in entry.Groups;
+
+# moderators can read reported entries unless they're private
+role_can_read(roles, entry: Entry, "permission read_private_reported_entries") if
+    entry.Reported = true and
+    has_permission(roles, "read_private_reported_entries");
+role_can_read(roles, entry: Entry, "permission read_reported_entries") if
+    entry.Reported = true and
+    entry.Private = false and
+    has_permission(roles, "read_reported_entries");
+
+has_permission(roles, permission) if
+    role in roles and
+    [role, permissions] in ROLE_PERMISSIONS and
+    permission in permissions;`
+
+func GetEntryHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook) func(w http.ResponseWriter, r *http.Request) {
+	o, err := newEntryOso("get_entry", getEntryPolicy)
+	if err != nil {
+		return health.Unavailable(engine, "get_entry", err)
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		// we're using a bearer token, we have a helper to look up the user
-		// from using the data in the headers
-		userName, responseCode := helpers.AuthnUser(&r.Header, users)
-		if responseCode > 0 {
-			w.WriteHeader(responseCode)
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
@@ -40,31 +89,28 @@ func GetEntryHandler(users *map[string]types.User, entries *map[string]types.Ent
 		}
 
 		// check that the entry exists
-		entry, ok := (*entries)[entryID]
+		entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, entryID)
 		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		// submit the name and the entry requested to the policy
-		query, err := o.NewQueryFromRule(
-			"allow",
-			userName,
-			entry,
-		)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		results, err := query.GetAllResults()
+		// submit the principal, with any JWT claims or client certificate,
+		// the entry requested and its notebook to the policy
+		decision := decisions.Start(r.Context(), engine, principal, "read_entry", "entries/"+entryID, []interface{}{principal, entry, notebook})
+		key := decisioncache.NewKey(engine, principal, "read_entry", "entries/"+entryID)
+		allowed, reason, err := decisioncache.Check(r.Context(), key, func() (bool, string, error) {
+			return queryDecision(o, "get_entry", "allow", "deny", principal, entry, notebook)
+		})
 		if err != nil {
+			decision.Finish(false, "", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
 		// if there are no results, then the request was not allowed
-		if len(results) == 0 {
+		decision.Finish(allowed, reason, nil)
+		if !allowed {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
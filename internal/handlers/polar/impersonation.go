@@ -0,0 +1,50 @@
+package polar
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+)
+
+// impersonationPolicy permits admins to act as any other user who isn't also
+// an admin
+const impersonationPolicy = `
+allow_impersonation(actor: User, target: User, "admin") if
+    "admin" in actor.Roles and
+    not "admin" in target.Roles;
+
+deny_impersonation(actor: User, target: User, reason) if
+    (not "admin" in actor.Roles and reason = "not an admin") or
+    ("admin" in target.Roles and reason = "target is an admin");`
+
+// ImpersonationPolicy queries the impersonation policy for the actor and
+// target, both must be known users
+func ImpersonationPolicy(users *userstore.Store) authn.ImpersonationPolicy {
+	o, err := newOso("impersonation", reflect.TypeOf(types.User{}))
+	if err == nil {
+		err = loadPolicy(context.Background(), o, "impersonation", impersonationPolicy)
+	}
+	if err != nil {
+		return decisions.RecordImpersonation(engine, func(r *http.Request, actor types.Principal, target string) (bool, string, error) {
+			return false, "", err
+		})
+	}
+
+	return decisions.RecordImpersonation(engine, func(r *http.Request, actor types.Principal, target string) (bool, string, error) {
+		actorUser, ok := users.Get(actor.Name)
+		if !ok {
+			return false, "unknown user", nil
+		}
+		targetUser, ok := users.Get(target)
+		if !ok {
+			return false, "unknown user", nil
+		}
+
+		return queryDecision(o, "impersonation", "allow_impersonation", "deny_impersonation", actorUser, targetUser)
+	})
+}
@@ -0,0 +1,45 @@
+package polar
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// notebookSharingPolicy has the rules for sharing inherited from a notebook,
+// these are used in the policies for entries
+const notebookSharingPolicy = `
+inherits_sharing(entry: Entry) if
+    entry.Notebook != "" and entry.OverrideSharing = false;
+
+reads_notebook(userName, _: Notebook { User: userName });
+reads_notebook(userName, notebook: Notebook) if userName in notebook.Readers;
+reads_notebook(userName, notebook: Notebook) if userName in notebook.Editors;
+
+edits_notebook(userName, _: Notebook { User: userName });
+edits_notebook(userName, notebook: Notebook) if userName in notebook.Editors;`
+
+// newEntryOso configures a new Oso instance for a policy about entries and
+// the notebooks they're in
+func newEntryOso(name, policy string) (instance, error) {
+	// make polar aware of our application types
+	o, err := newOso(name,
+		reflect.TypeOf(types.Entry{}),
+		reflect.TypeOf(types.Notebook{}),
+		reflect.TypeOf(types.Certificate{}),
+		reflect.TypeOf(types.Principal{}),
+	)
+	if err != nil {
+		return o, err
+	}
+
+	// the permissions of each role are data for the policies
+	if err := o.RegisterConstant(types.RolePermissions, "ROLE_PERMISSIONS"); err != nil {
+		health.ObservePolicy(engine, name, err)
+		return o, err
+	}
+
+	return o, loadPolicy(context.Background(), o, name, notebookSharingPolicy, policy)
+}
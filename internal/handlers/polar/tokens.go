@@ -0,0 +1,214 @@
+package polar
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// manageTokenPolicy permits users to issue, see and revoke only their own
+// tokens
+const manageTokenPolicy = `
+allow_token(userName, _: Token { User: userName }, "owner");
+
+deny_token(userName, token: Token, "token of another user") if
+    token.User != userName;
+
+# admins acting as a user can't revoke their tokens
+allow_revoke(principal: Principal, token: Token, reason) if
+    principal.Impersonator = "" and
+    allow_token(principal.Name, token, reason);
+
+deny_revoke(principal: Principal, token: Token, reason) if
+    (principal.Impersonator != "" and reason = "impersonated") or
+    deny_token(principal.Name, token, reason);
+
+# a scoped token can't be used to issue a token with scopes it doesn't hold,
+# and tokens are only issued to users whose risk isn't elevated by recent
+# failed attempts to authenticate. Admins acting as the user can't issue
+# tokens, which would outlive the impersonation and not record who issued them.
+allow_issue(principal: Principal { Type: "user" }, token: Token, "owner") if
+    principal.Impersonator = "" and
+    token.User = principal.Name and
+    principal.Risk != "elevated" and
+    forall(scope in token.Scopes, scope in principal.Scopes);
+
+deny_issue(principal: Principal, token: Token, reason) if
+    (principal.Type != "user" and reason = "not a user") or
+    deny_token(principal.Name, token, reason) or
+    (principal.Impersonator != "" and reason = "impersonated") or
+    (principal.Risk = "elevated" and reason = "elevated risk") or
+    (scope in token.Scopes and not scope in principal.Scopes and
+        reason = REASONS.MissingScope(scope));`
+
+// newTokenOso configures an Oso instance with the manage token policy
+func newTokenOso() (instance, error) {
+	o, err := newOso("tokens", reflect.TypeOf(types.Token{}), reflect.TypeOf(types.Principal{}))
+	if err != nil {
+		return o, err
+	}
+	if err := o.RegisterConstant(tokenReasons{}, "REASONS"); err != nil {
+		health.ObservePolicy(engine, "tokens", err)
+		return o, err
+	}
+	return o, loadPolicy(context.Background(), o, "tokens", manageTokenPolicy)
+}
+
+// tokenReasons formats the reasons polar can't build from strings itself
+type tokenReasons struct{}
+
+// MissingScope is the reason a token with a scope the principal doesn't hold
+// isn't issued
+func (tokenReasons) MissingScope(scope string) string {
+	return "missing scope " + scope
+}
+
+// canManageToken queries the manage token policy for a user and token
+func canManageToken(o instance, userName string, token types.Token) (bool, string, error) {
+	return queryDecision(o, "tokens", "allow_token", "deny_token", userName, token)
+}
+
+// canIssueToken queries the issue token policy for a principal and token
+func canIssueToken(o instance, principal types.Principal, token types.Token) (bool, string, error) {
+	return queryDecision(o, "tokens", "allow_issue", "deny_issue", principal, token)
+}
+
+// canRevokeToken queries the revoke token policy for a principal and token
+func canRevokeToken(o instance, principal types.Principal, token types.Token) (bool, string, error) {
+	return queryDecision(o, "tokens", "allow_revoke", "deny_revoke", principal, token)
+}
+
+// CreateTokenHandler issues a new token to the user, the secret is returned
+// in the response
+func CreateTokenHandler(tokens *authn.Tokens) func(w http.ResponseWriter, r *http.Request) {
+	o, err := newTokenOso()
+	if err != nil {
+		return health.Unavailable(engine, "tokens", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userName := principal.Name
+
+		payload, err := helpers.ReadCreateTokenPayload(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		requested := types.Token{User: userName, Name: payload.Name, Scopes: payload.RequestedScopes()}
+		decision := decisions.Start(r.Context(), engine, principal, "issue_token", "tokens", []interface{}{principal, requested})
+		allowed, reason, err := canIssueToken(o, principal, requested)
+		decision.Finish(allowed, reason, err)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		token, secret, err := tokens.Issue(userName, requested.Name, requested.Scopes, payload.Lifetime())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		helpers.WriteIssuedToken(w, token, secret)
+	}
+}
+
+// ListTokensHandler lists the tokens the user is permitted to manage
+func ListTokensHandler(tokens *authn.Tokens) func(w http.ResponseWriter, r *http.Request) {
+	o, err := newTokenOso()
+	if err != nil {
+		return health.Unavailable(engine, "tokens", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userName := principal.Name
+
+		var permitted []types.Token
+		for _, token := range tokens.All() {
+			decision := decisions.Start(r.Context(), engine, principal, "read_token", "tokens/"+token.ID, []interface{}{userName, token})
+			allowed, reason, err := canManageToken(o, userName, token)
+			decision.Finish(allowed, reason, err)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if allowed {
+				permitted = append(permitted, token)
+			}
+		}
+
+		helpers.WriteTokens(w, permitted)
+	}
+}
+
+// RevokeTokenHandler revokes a token, it can't be used from then on
+func RevokeTokenHandler(tokens *authn.Tokens) func(w http.ResponseWriter, r *http.Request) {
+	o, err := newTokenOso()
+	if err != nil {
+		return health.Unavailable(engine, "tokens", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		tokenID, ok := mux.Vars(r)["tokenID"]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		token, ok := tokens.Get(tokenID)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		decision := decisions.Start(r.Context(), engine, principal, "revoke_token", "tokens/"+tokenID, []interface{}{principal, token})
+		allowed, reason, err := canRevokeToken(o, principal, token)
+		decision.Finish(allowed, reason, err)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		tokens.Revoke(tokenID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
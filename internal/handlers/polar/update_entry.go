@@ -0,0 +1,104 @@
+package polar
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// UpdateEntryHandler will overwrite the content of an entry, if permitted. The
+// replaced content is kept as a revision and the search index is updated
+func UpdateEntryHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook, index *search.Index) func(w http.ResponseWriter, r *http.Request) {
+	// only the owner and editors of an entry, or of its notebook, may update
+	// it and only with the entries:write scope. Service accounts may not.
+	o, err := newEntryOso("update_entry", `
+allow(principal: Principal { Type: "user" }, entry, notebook, reason) if
+    "entries:write" in principal.Scopes and
+    can_update(principal.Name, entry, notebook, reason);
+
+deny(principal: Principal, _, _, reason) if
+    (not "entries:write" in principal.Scopes and reason = "missing scope entries:write") or
+    (principal.Type != "user" and reason = "not a user") or
+    reason = "not an editor";
+
+can_update(userName, _: Entry { User: userName }, _, "owner");
+can_update(userName, entry: Entry, _, "editor") if userName in entry.Editors;
+can_update(userName, entry: Entry, notebook: Notebook, "notebook sharing") if
+    inherits_sharing(entry) and edits_notebook(userName, notebook);`)
+	if err != nil {
+		return health.Unavailable(engine, "update_entry", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userName := principal.Name
+
+		// get the entryID from the request vars set for us by go mux
+		entryID, ok := mux.Vars(r)["entryID"]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// check that the entry exists
+		entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, entryID)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		decision := decisions.Start(r.Context(), engine, principal, "update_entry", "entries/"+entryID, []interface{}{principal, entry, notebook})
+		allowed, reason, err := queryDecision(o, "update_entry", "allow", "deny", principal, entry, notebook)
+		decision.Finish(allowed, reason, err)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		payloadBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var payload helpers.UpdateEntryPayload
+		err = json.Unmarshal(payloadBytes, &payload)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// the entry is revised as it's stored now, another update may have
+		// been made since it was authorized. It's indexed before the store is
+		// unlocked so that the index matches the latest content.
+		_, ok = entries.Update(entryID, func(current types.Entry) types.Entry {
+			revised := helpers.ReviseEntry(current, userName, payload.Content)
+			index.Put(entryID, revised.Content)
+			return revised
+		})
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -1,71 +1,80 @@
 package polar
 
 import (
-	"fmt"
+	"context"
 	"net/http"
 	"reflect"
-	"strings"
 
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
-	"github.com/osohq/go-oso"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
 	osotypes "github.com/osohq/go-oso/types"
 )
 
 // WhoAmIHandler is the polar implementation of the first task
-func WhoAmIHandler(users *map[string]types.User) func(w http.ResponseWriter, r *http.Request) {
-	var o oso.Oso
+func WhoAmIHandler(users *userstore.Store) func(w http.ResponseWriter, r *http.Request) {
 	// configure a new Oso instance and load in our whoami 'policy' (read:
-	// lookup in polar in this case...)
-	o, _ = oso.NewOso()
-	// make polar aware of our application types
-	o.RegisterClass(reflect.TypeOf(types.User{}), nil)
-	// set a whoami policy for looking up users by token
-	o.LoadString(`
-whoami(userName, users, user: User) if
-  [userName, match] in users and
-  match.Token = user.Token;`)
+	// lookup in polar in this case...), making polar aware of our application
+	// types
+	o, err := newOso("whoami", reflect.TypeOf(types.Principal{}))
+	if err != nil {
+		return health.Unavailable(engine, "whoami", err)
+	}
+	// set a whoami policy for checking the authenticated principal is a user
+	// we know about, service accounts were checked by their authenticator
+	err = loadPolicy(context.Background(), o, "whoami", `
+whoami(userName, users, _: Principal { Name: userName, Type: "user" }, "known user") if
+  [userName, _] in users;
+whoami(name, _, _: Principal { Name: name, Type: "service_account" }, "service account");`)
+	if err != nil {
+		return health.Unavailable(engine, "whoami", err)
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		// extract the token and proceed if supplied
-		auth := r.Header.Get("Authorization")
-		if auth == "" {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		if !strings.HasPrefix(auth, "Bearer ") {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		token := strings.TrimSpace(strings.Replace(auth, "Bearer ", "", 1))
 
-		// use the token and users as input to the query
-		query, err := o.NewQueryFromRule(
+		// use the principal and users as input to the query
+		decision := decisions.Start(r.Context(), engine, principal, "whoami", "users/"+principal.Name, principal)
+		query, err := newQuery(o, "whoami",
 			"whoami",
 			osotypes.ValueVariable("userName"),
-			users,
-			// pass token as a 'User' to demo typed Polar param
-			types.User{Token: token},
+			users.All(),
+			principal,
+			osotypes.ValueVariable("reason"),
 		)
 		if err != nil {
+			decision.Finish(false, "", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		results, err := query.GetAllResults()
 		if err != nil {
+			decision.Finish(false, "", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		// if there were no solutions to the policy, then a user with that token
-		// did not exist and so they must be unauthorized
+		// if there were no solutions to the policy, then the principal isn't a
+		// user and so they must be unauthorized
 		if len(results) == 0 {
+			decision.Finish(false, "unknown user", nil)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		reason, _ := results[0]["reason"].(string)
+		decision.Finish(true, reason, nil)
 
 		// naively extract the username from the results
 		username := results[0]["userName"].(string)
 
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, username)
+		helpers.WriteWhoAmI(w, r, username, principal.Type)
 	}
 }
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/profile"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestProfile(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123", Roles: []string{"admin"}},
+		"Bob":   {Token: "456"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	router := mux.NewRouter()
+	router.Use(
+		authn.Middleware(authn.BearerToken{Users: users}),
+		authn.UserRoles(users),
+	)
+	router.HandleFunc("/debug/authz/profile", profile.Handler(profile.Default, "rego", "polar", "cue"))
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks))
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	testCases := []struct {
+		Language     string
+		ExpectedStat string
+	}{
+		{
+			Language:     "rego",
+			ExpectedStat: "get_entry.rego:",
+		},
+		{
+			Language:     "polar",
+			ExpectedStat: "get_entry:allow",
+		},
+		{
+			Language:     "cue",
+			ExpectedStat: "get_entry:allowed",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Language, func(t *testing.T) {
+			profiled := make(chan *httptest.ResponseRecorder)
+			go func() {
+				profiled <- get(fmt.Sprintf("/debug/authz/profile?engine=%s&seconds=1", tc.Language), "123")
+			}()
+
+			// wait for the profile to start before reading the entry
+			deadline := time.Now().Add(time.Second)
+			for profile.Active(tc.Language) == nil {
+				if time.Now().After(deadline) {
+					t.Fatalf("profile didn't start")
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			if rr := get(fmt.Sprintf("/debug/authz/profile?engine=%s&seconds=1", tc.Language), "123"); rr.Code != http.StatusConflict {
+				t.Fatalf("unexpected response code: got %d want %d", rr.Code, http.StatusConflict)
+			}
+
+			for i := 0; i < 3; i++ {
+				for _, token := range []string{"123", "456"} {
+					get(fmt.Sprintf("/%s/entries/1", tc.Language), token)
+				}
+			}
+
+			rr := <-profiled
+			if rr.Code != http.StatusOK {
+				t.Fatalf("unexpected response code: got %d want %d", rr.Code, http.StatusOK)
+			}
+			if profile.Active(tc.Language) != nil {
+				t.Fatalf("profile is still active")
+			}
+
+			var report profile.Report
+			if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+				t.Fatalf("failed to parse report: %s", err)
+			}
+			if report.Engine != tc.Language {
+				t.Fatalf("unexpected engine: got %s want %s", report.Engine, tc.Language)
+			}
+
+			var found bool
+			for i, stat := range report.Stats {
+				if i > 0 && stat.TotalTimeNS > report.Stats[i-1].TotalTimeNS {
+					t.Fatalf("stats aren't sorted by total time: %+v", report.Stats)
+				}
+				if strings.HasPrefix(stat.Name, tc.ExpectedStat) {
+					found = true
+					if stat.Hits < 1 || stat.TotalTimeNS <= 0 || stat.MeanTimeNS != stat.TotalTimeNS/stat.Hits {
+						t.Fatalf("unexpected stat: %+v", stat)
+					}
+				}
+			}
+			if !found {
+				t.Fatalf("missing stat %s in %+v", tc.ExpectedStat, report.Stats)
+			}
+		})
+	}
+
+	t.Run("requests which aren't profiled aren't recorded", func(t *testing.T) {
+		if rr := get("/rego/entries/1", "123"); rr.Code != http.StatusOK {
+			t.Fatalf("unexpected response code: got %d want %d", rr.Code, http.StatusOK)
+		}
+		if profile.Active("rego") != nil {
+			t.Fatalf("unexpected active profile")
+		}
+	})
+
+	badRequests := []struct {
+		Description    string
+		Token          string
+		Query          string
+		ExpectedStatus int
+	}{
+		{
+			Description:    "non admin",
+			Token:          "456",
+			Query:          "engine=rego&seconds=1",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "unknown engine",
+			Token:          "123",
+			Query:          "engine=golang&seconds=1",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Description:    "too few seconds",
+			Token:          "123",
+			Query:          "engine=rego&seconds=0",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Description:    "too many seconds",
+			Token:          "123",
+			Query:          "engine=rego&seconds=3600",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range badRequests {
+		t.Run(tc.Description, func(t *testing.T) {
+			rr := get("/debug/authz/profile?"+tc.Query, tc.Token)
+			if rr.Code != tc.ExpectedStatus {
+				t.Fatalf("unexpected response code: got %d want %d", rr.Code, tc.ExpectedStatus)
+			}
+		})
+	}
+}
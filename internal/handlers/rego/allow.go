@@ -0,0 +1,153 @@
+package rego
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/metrics"
+	"github.com/charlieegan3/go-authz-dsls/internal/profile"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/profiler"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+)
+
+// partialDecisionRule compiles a single module and partially evaluates its
+// data.auth.decision rule so that it's ready to use in a handler. Modules
+// define the decision as the value of their allow rule and the reason for it.
+// The policy data from policyStore is available to the module.
+func partialDecisionRule(name, module string) (rego.PartialResult, error) {
+	return partialRule(name, module, "data.auth.decision")
+}
+
+// partialRule compiles a single module and partially evaluates the query,
+// how long this took is recorded in the policy compile metrics and whether it
+// succeeded in the health checks. Decisions cached with earlier policies are
+// invalidated.
+func partialRule(name, module, query string) (rego.PartialResult, error) {
+	start := time.Now()
+	compiler, err := ast.CompileModules(map[string]string{name: module})
+	if err != nil {
+		metrics.ObservePolicyCompile(engine, name, time.Since(start), err)
+		health.ObservePolicy(engine, name, err)
+		return rego.PartialResult{}, fmt.Errorf("rule failed to compile: %s", err)
+	}
+
+	store, err := policyStore()
+	if err != nil {
+		metrics.ObservePolicyCompile(engine, name, time.Since(start), err)
+		health.ObservePolicy(engine, name, err)
+		return rego.PartialResult{}, err
+	}
+
+	rule, err := rego.
+		New(rego.Compiler(compiler), rego.Store(store), rego.Query(query)).
+		PartialResult(context.Background())
+	metrics.ObservePolicyCompile(engine, name, time.Since(start), err)
+	health.ObservePolicy(engine, name, err)
+	decisioncache.Invalidate()
+	if err != nil {
+		return rego.PartialResult{}, fmt.Errorf("failed to compute partial result: %s", err)
+	}
+
+	return rule, nil
+}
+
+// policyStore returns a store with the data policies can refer to, i.e. the
+// permissions granted by each role as data.role_permissions
+func policyStore() (storage.Store, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"role_permissions": types.RolePermissions,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode policy data: %s", err)
+	}
+
+	return inmem.NewFromReader(bytes.NewReader(data)), nil
+}
+
+// errUnexpectedResult is recorded for decisions when a rule's value isn't of
+// the expected type
+var errUnexpectedResult = errors.New("unexpected result from policy")
+
+// evalDecision evaluates a data.auth.decision rule and reports if it allowed
+// the input, and the reason it gave
+func evalDecision(ctx context.Context, rule rego.PartialResult, input interface{}) (bool, string, error) {
+	resultSet, err := eval(ctx, rule, input)
+	if err != nil {
+		return false, "", err
+	}
+
+	return decisionValue(resultSet)
+}
+
+// decisionValue reads the allow and reason fields of a data.auth.decision
+// result. Undefined results are treated as a denial without a reason.
+func decisionValue(resultSet rego.ResultSet) (bool, string, error) {
+	if len(resultSet) == 0 || len(resultSet[0].Expressions) == 0 {
+		return false, "", nil
+	}
+
+	decision, ok := resultSet[0].Expressions[0].Value.(map[string]interface{})
+	if !ok {
+		return false, "", errUnexpectedResult
+	}
+	allowed, ok := decision["allow"].(bool)
+	if !ok {
+		return false, "", errUnexpectedResult
+	}
+	reason, ok := decision["reason"].(string)
+	if !ok {
+		return false, "", errUnexpectedResult
+	}
+
+	return allowed, reason, nil
+}
+
+// eval evaluates the partially evaluated rule with the input. When the engine
+// is being profiled the time spent on each expression is recorded, using a
+// profiler for each evaluation since they aren't safe to share.
+func eval(ctx context.Context, rule rego.PartialResult, input interface{}) (rego.ResultSet, error) {
+	session := profile.Active(engine)
+	if session == nil {
+		return rule.Rego(rego.Input(input)).Eval(ctx)
+	}
+
+	p := profiler.New()
+	resultSet, err := rule.Rego(rego.Input(input), rego.QueryTracer(p)).Eval(ctx)
+	recordProfile(session, p)
+	return resultSet, err
+}
+
+// evalPrepared evaluates the prepared rule with the input against the data in
+// its store, it's profiled like eval
+func evalPrepared(ctx context.Context, rule rego.PreparedEvalQuery, input interface{}) (rego.ResultSet, error) {
+	session := profile.Active(engine)
+	if session == nil {
+		return rule.Eval(ctx, rego.EvalInput(input))
+	}
+
+	p := profiler.New()
+	resultSet, err := rule.Eval(ctx, rego.EvalInput(input), rego.EvalQueryTracer(p))
+	recordProfile(session, p)
+	return resultSet, err
+}
+
+// recordProfile adds the time spent on each expression to the session
+func recordProfile(session *profile.Session, p *profiler.Profiler) {
+	for _, stat := range p.ReportTopNResults(0, nil) {
+		if stat.Location == nil {
+			continue
+		}
+		name := fmt.Sprintf("%s:%d:%d", stat.Location.File, stat.Location.Row, stat.Location.Col)
+		session.Add(name, string(stat.Location.Text), int64(stat.NumEval), time.Duration(stat.ExprTimeNs))
+	}
+}
@@ -1,72 +1,73 @@
 package rego
 
 import (
-	"context"
 	"encoding/json"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"strings"
 
 	"github.com/Jeffail/gabs/v2"
-	"github.com/charlieegan3/go-authz-dsls/internal/types"
-	"github.com/open-policy-agent/opa/ast"
-	"github.com/open-policy-agent/opa/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
 )
 
 // CreateFriendRequestHandler will create a new friend request between two
 // users, if permitted
-func CreateFriendRequestHandler(users *map[string]types.User) func(w http.ResponseWriter, r *http.Request) {
-	var createFriendRequestRule rego.PartialResult
-	compiler, err := ast.CompileModules(map[string]string{
-		"get_entry.rego": `
+func CreateFriendRequestHandler(store *Store) func(w http.ResponseWriter, r *http.Request) {
+	// the friendships are read from the users in the store
+	createFriendRequestRule, err := preparedRule("create_friend_request.rego", `
 		package auth
 
         user_graph[user] = friends {
-            friends := input.Users[user].Friends
+            friends := data.users[user].Friends
         }
 
         default allow = false
 		allow {
+			# tokens must have the scope, whatever the friendships are, and
+			# service accounts aren't in the friend graph
+			scoped
+			input.Type == "user"
+			connected
+		}
+
+		decision = {"allow": allow, "reason": reason}
+
+		reason = "missing scope friends:write" {
+			not scoped
+		} else = "not a user" {
+			input.Type != "user"
+		} else = "connected through friends" {
+			connected
+		} else = "not connected through friends" {
+			true
+		}
+
+		scoped {
+			input.Scopes[_] == "friends:write"
+		}
+
+		connected {
 			friends_of_friends := graph.reachable(user_graph, {input.User})
 			friends_of_friends[input.RequestedFriend]
-		}`,
-	})
-	if err != nil {
-		log.Fatalf("rule failed to compile: %s", err)
-	}
-
-	createFriendRequestRule, err = rego.
-		New(rego.Compiler(compiler), rego.Query("data.auth.allow")).
-		PartialResult(context.Background())
+		}`, "data.auth.decision", store)
 	if err != nil {
-		log.Fatalf("failed to compute partial result: %s", err)
+		return health.Unavailable(engine, "create_friend_request.rego", err)
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		// extract the token if supplied
-		auth := r.Header.Get("Authorization")
-		if auth == "" {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		if !strings.HasPrefix(auth, "Bearer ") {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		token := strings.TrimSpace(strings.Replace(auth, "Bearer ", "", 1))
 
 		// look up requesting user
-		var requestingUsername string
-		for name, user := range *users {
-			if user.Token == token {
-				requestingUsername = name
-				break
-			}
-		}
-
-		// token matched no user
-		if requestingUsername == "" {
+		requestingUsername := principal.Name
+		if _, ok := store.User(r.Context(), requestingUsername); !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
@@ -86,16 +87,9 @@ func CreateFriendRequestHandler(users *map[string]types.User) func(w http.Respon
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		var friendUsername string
-		for name := range *users {
-			if name == payload.Friend {
-				friendUsername = name
-				break
-			}
-		}
 
 		// no user exists, return 404
-		if friendUsername == "" {
+		if _, ok := store.User(r.Context(), payload.Friend); !ok {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
@@ -103,41 +97,58 @@ func CreateFriendRequestHandler(users *map[string]types.User) func(w http.Respon
 		// authzInputData is a structure passed to the Rego policy evaluation
 		authzInputData := struct {
 			User            string
-			Users           *map[string]types.User
+			Type            string
+			Scopes          []string
 			RequestedFriend string
 		}{
 			User:            requestingUsername,
-			Users:           users,
-			RequestedFriend: friendUsername,
+			Type:            principal.Type,
+			Scopes:          principal.Scopes,
+			RequestedFriend: payload.Friend,
 		}
 
-		resultSet, err := createFriendRequestRule.Rego(rego.Input(authzInputData)).Eval(r.Context())
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		decision := decisions.Start(r.Context(), engine, principal, "create_friend_request", "friend_requests", authzInputData)
 
-		// convert to data to make extracting the result easier
-		bytes, err := json.MarshalIndent(resultSet, "", "    ")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		// the policy is only evaluated when the decision for this request
+		// isn't cached
+		key := decisioncache.NewKey(engine, principal, "create_friend_request", "users/"+payload.Friend)
+		allowed, reason, err := decisioncache.Check(r.Context(), key, func() (bool, string, error) {
+			resultSet, err := evalPrepared(r.Context(), createFriendRequestRule, authzInputData)
+			if err != nil {
+				return false, "", err
+			}
 
-		// wrap the data in gabs to make it easier to extract values
-		result, err := gabs.ParseJSON(bytes)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+			// convert to data to make extracting the result easier
+			bytes, err := json.MarshalIndent(resultSet, "", "    ")
+			if err != nil {
+				return false, "", err
+			}
 
-		// extract the allowed value from the response using gabs
-		allowed, ok := result.Path("0.expressions.0.value").Data().(bool)
-		if !ok {
+			// wrap the data in gabs to make it easier to extract values
+			result, err := gabs.ParseJSON(bytes)
+			if err != nil {
+				return false, "", err
+			}
+
+			// extract the allowed value and its reason from the response
+			// using gabs
+			allowed, ok := result.Path("0.expressions.0.value.allow").Data().(bool)
+			if !ok {
+				return false, "", errUnexpectedResult
+			}
+			reason, ok := result.Path("0.expressions.0.value.reason").Data().(string)
+			if !ok {
+				return false, "", errUnexpectedResult
+			}
+			return allowed, reason, nil
+		})
+		if err != nil {
+			decision.Finish(false, "", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
+		decision.Finish(allowed, reason, nil)
 		if !allowed {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
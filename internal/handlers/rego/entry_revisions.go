@@ -0,0 +1,164 @@
+package rego
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// entryHistoryModule is the policy for who may see the past revisions of an
+// entry. Unlike get_entry.rego, readers and service accounts are not included.
+const entryHistoryModule = `
+	package auth
+	default allow = false
+	# the token must be allowed to read entries as well as the user
+	allow {
+		scoped
+		input.Type == "user"
+		history_seen_by
+	}
+
+	decision = {"allow": allow, "reason": reason}
+
+	reason = "missing scope entries:read" {
+		not scoped
+	} else = "not a user" {
+		input.Type != "user"
+	} else = rule {
+		rule := history_seen_by
+	} else = "not an editor" {
+		true
+	}
+
+	scoped {
+		input.Scopes[_] == "entries:read"
+	}
+
+	history_seen_by = "owner" {
+		input.Entry.User == input.User
+	} else = "editor" {
+		input.Entry.Editors[_] == input.User
+	} else = "notebook sharing" {
+		inherits_sharing
+		notebook_editors[input.User]
+	}
+
+	notebook_editors[user] {
+		user := input.Notebook.User
+	}
+	notebook_editors[user] {
+		user := input.Notebook.Editors[_]
+	}
+
+	inherits_sharing {
+		input.Entry.Notebook != ""
+		not input.Entry.OverrideSharing
+	}`
+
+// ListEntryRevisionsHandler lists the past revisions of an entry for users
+// permitted to see its history
+func ListEntryRevisionsHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook) func(w http.ResponseWriter, r *http.Request) {
+	entryHistoryRule, err := partialDecisionRule("entry_history.rego", entryHistoryModule)
+	if err != nil {
+		return health.Unavailable(engine, "entry_history.rego", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry, ok := authzEntryHistory(w, r, entryHistoryRule, entries, notebooks)
+		if !ok {
+			return
+		}
+
+		helpers.WriteRevisions(w, entry.Revisions)
+	}
+}
+
+// GetEntryRevisionHandler returns the content of a single past revision of an
+// entry for users permitted to see its history
+func GetEntryRevisionHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook) func(w http.ResponseWriter, r *http.Request) {
+	entryHistoryRule, err := partialDecisionRule("entry_history.rego", entryHistoryModule)
+	if err != nil {
+		return health.Unavailable(engine, "entry_history.rego", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry, ok := authzEntryHistory(w, r, entryHistoryRule, entries, notebooks)
+		if !ok {
+			return
+		}
+
+		revision, ok := helpers.LookupRevision(entry, mux.Vars(r)["revisionID"])
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, revision.Content)
+	}
+}
+
+// authzEntryHistory looks up the requested entry and checks the user may see
+// its history. When not ok, the response has already been written.
+func authzEntryHistory(w http.ResponseWriter, r *http.Request, rule rego.PartialResult, entries *entrystore.Store, notebooks *map[string]types.Notebook) (entry types.Entry, ok bool) {
+	// the principal has been set in the request context by the authn
+	// middleware
+	principal, ok := authn.PrincipalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return types.Entry{}, false
+	}
+	userName := principal.Name
+
+	entryID, ok := mux.Vars(r)["entryID"]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return types.Entry{}, false
+	}
+
+	entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, entryID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return types.Entry{}, false
+	}
+
+	authzInputData := struct {
+		User        string
+		Type        string
+		Claims      map[string]interface{}
+		Certificate *types.Certificate
+		Scopes      []string
+		Entry       types.Entry
+		Notebook    types.Notebook
+	}{
+		User:        userName,
+		Type:        principal.Type,
+		Claims:      principal.Claims,
+		Certificate: principal.Certificate,
+		Scopes:      principal.Scopes,
+		Entry:       entry,
+		Notebook:    notebook,
+	}
+
+	decision := decisions.Start(r.Context(), engine, principal, "read_entry_history", "entries/"+entryID, authzInputData)
+	allowed, reason, err := evalDecision(r.Context(), rule, authzInputData)
+	decision.Finish(allowed, reason, err)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return types.Entry{}, false
+	}
+	if !allowed {
+		w.WriteHeader(http.StatusUnauthorized)
+		return types.Entry{}, false
+	}
+
+	return entry, true
+}
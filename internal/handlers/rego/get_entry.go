@@ -1,52 +1,125 @@
 package rego
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 
 	"github.com/Jeffail/gabs/v2"
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
 	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
 	"github.com/gorilla/mux"
-	"github.com/open-policy-agent/opa/ast"
-	"github.com/open-policy-agent/opa/rego"
 )
 
-func GetEntryHandler(users *map[string]types.User, entries *map[string]types.Entry) func(w http.ResponseWriter, r *http.Request) {
-	// create a rule which can be partially evaluated at boot time and reused
-	// in each call to the handler
-	var getEntryRule rego.PartialResult
-	compiler, err := ast.CompileModules(map[string]string{
-		// simple rego rule to check the data in the input conforms. i.e. that
-		// the user and entry/user match
-		"get_entry.rego": `
+// getEntryModule is a simple rego rule to check the data in the input
+// conforms. i.e. that the user and entry/user match, or that the entry has
+// been shared with the user, either directly, through its notebook or through
+// a group in the user's JWT claims or client certificate. Reported entries can
+// also be read by users whose roles are granted permission to in
+// data.role_permissions. Service accounts can only read with a grant. The
+// reason is the first rule which permitted reading, or why none did.
+const getEntryModule = `
 	package auth
+	default allow = false
+	# the token must be allowed to read entries as well as the user
 	allow {
+		scoped
+		input.Type == "user"
+		read_by
+	}
+	allow {
+		scoped
+		input.Type == "service_account"
+		input.Grants[_] == "read_all_entries"
+	}
+
+	decision = {"allow": allow, "reason": reason}
+
+	reason = "missing scope entries:read" {
+		not scoped
+	} else = "grant read_all_entries" {
+		input.Type == "service_account"
+		input.Grants[_] == "read_all_entries"
+	} else = "missing grant read_all_entries" {
+		input.Type == "service_account"
+	} else = rule {
+		input.Type == "user"
+		rule := read_by
+	} else = "not shared with the user" {
+		true
+	}
+
+	scoped {
+		input.Scopes[_] == "entries:read"
+	}
+
+	read_by = "owner" {
 		input.Entry.User == input.User
-	}`,
-	})
-	if err != nil {
-		log.Fatalf("rule failed to compile: %s", err)
+	} else = "reader" {
+		input.Entry.Readers[_] == input.User
+	} else = "editor" {
+		input.Entry.Editors[_] == input.User
+	} else = "group" {
+		# groups are only trusted for users with a verified email
+		input.Claims.email_verified == true
+		input.Claims.groups[_] == input.Entry.Groups[_]
+	} else = "certificate group" {
+		# the organizational units of a client certificate are groups too
+		input.Certificate.OrganizationalUnit[_] == input.Entry.Groups[_]
+	} else = "permission read_private_reported_entries" {
+		input.Entry.Reported
+		permissions["read_private_reported_entries"]
+	} else = "permission read_reported_entries" {
+		# moderators can read reported entries unless they're private
+		input.Entry.Reported
+		not input.Entry.Private
+		permissions["read_reported_entries"]
+	} else = "notebook sharing" {
+		inherits_sharing
+		notebook_readers[input.User]
+	}
+
+	permissions[permission] {
+		permission := data.role_permissions[input.Roles[_]][_]
+	}
+
+	notebook_readers[user] {
+		user := input.Notebook.User
+	}
+	notebook_readers[user] {
+		user := input.Notebook.Readers[_]
+	}
+	notebook_readers[user] {
+		user := input.Notebook.Editors[_]
 	}
 
-	getEntryRule, err = rego.
-		New(rego.Compiler(compiler), rego.Query("data.auth.allow")).
-		PartialResult(context.Background())
+	inherits_sharing {
+		input.Entry.Notebook != ""
+		not input.Entry.OverrideSharing
+	}`
+
+func GetEntryHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook) func(w http.ResponseWriter, r *http.Request) {
+	// create a rule which can be partially evaluated at boot time and reused
+	// in each call to the handler
+	getEntryRule, err := partialDecisionRule("get_entry.rego", getEntryModule)
 	if err != nil {
-		log.Fatalf("failed to compute partial result: %s", err)
+		return health.Unavailable(engine, "get_entry.rego", err)
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		// we're using a bearer token, we have a helper to look up the user
-		// from using the data in the headers
-		userName, responseCode := helpers.AuthnUser(&r.Header, users)
-		if responseCode > 0 {
-			w.WriteHeader(responseCode)
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		userName := principal.Name
 
 		// get the entryID from the request vars set for us by go mux
 		entryID, ok := mux.Vars(r)["entryID"]
@@ -56,56 +129,80 @@ func GetEntryHandler(users *map[string]types.User, entries *map[string]types.Ent
 		}
 
 		// check that the entry exists
-		entry, ok := (*entries)[entryID]
+		entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, entryID)
 		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		// build the input data for the Rego evaluation containing the entry
-		// and the requesting user
+		// build the input data for the Rego evaluation containing the entry,
+		// its notebook and the requesting user
 		authzInputData := struct {
-			User  string
-			Entry types.Entry
+			User        string
+			Type        string
+			Claims      map[string]interface{}
+			Certificate *types.Certificate
+			Scopes      []string
+			Roles       []string
+			Grants      []string
+			Entry       types.Entry
+			Notebook    types.Notebook
 		}{
-			User:  userName,
-			Entry: entry,
+			User:        userName,
+			Type:        principal.Type,
+			Claims:      principal.Claims,
+			Certificate: principal.Certificate,
+			Scopes:      principal.Scopes,
+			Roles:       principal.Roles,
+			Grants:      principal.Grants,
+			Entry:       entry,
+			Notebook:    notebook,
 		}
 
 		// get the results from the rego evaluation
-		resultSet, err := getEntryRule.Rego(rego.Input(authzInputData)).Eval(r.Context())
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		// if there are no 'solutions' then we can return unauthorized
-		if len(resultSet) == 0 {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+		decision := decisions.Start(r.Context(), engine, principal, "read_entry", "entries/"+entryID, authzInputData)
+		key := decisioncache.NewKey(engine, principal, "read_entry", "entries/"+entryID)
+		allowed, reason, err := decisioncache.Check(r.Context(), key, func() (bool, string, error) {
+			resultSet, err := eval(r.Context(), getEntryRule, authzInputData)
+			if err != nil {
+				return false, "", err
+			}
+			// if there are no 'solutions' then we can return unauthorized
+			if len(resultSet) == 0 {
+				return false, "", nil
+			}
 
-		// next we convert the output into JSON. This is a bit of a hack but it
-		// allows us to use gabs to extracts data from the response more in a
-		// terse manner
-		bytes, err := json.MarshalIndent(resultSet, "", "    ")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+			// next we convert the output into JSON. This is a bit of a hack but
+			// it allows us to use gabs to extracts data from the response more
+			// in a terse manner
+			bytes, err := json.MarshalIndent(resultSet, "", "    ")
+			if err != nil {
+				return false, "", err
+			}
 
-		result, err := gabs.ParseJSON(bytes)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+			result, err := gabs.ParseJSON(bytes)
+			if err != nil {
+				return false, "", err
+			}
 
-		// use a gabs query to get the data we want and assert it's a boolean
-		allowed, ok := result.Path("0.expressions.0.value").Data().(bool)
-		if !ok {
+			// use gabs queries to get the data we want and assert its types
+			allowed, ok := result.Path("0.expressions.0.value.allow").Data().(bool)
+			if !ok {
+				return false, "", errUnexpectedResult
+			}
+			reason, ok := result.Path("0.expressions.0.value.reason").Data().(string)
+			if !ok {
+				return false, "", errUnexpectedResult
+			}
+			return allowed, reason, nil
+		})
+		if err != nil {
+			decision.Finish(false, "", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
+		decision.Finish(allowed, reason, nil)
 		if !allowed {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
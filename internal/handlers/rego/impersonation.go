@@ -0,0 +1,70 @@
+package rego
+
+import (
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+)
+
+// impersonationModule permits admins to act as any other user who isn't also
+// an admin
+const impersonationModule = `
+package auth
+default allow = false
+allow {
+	actor_is_admin
+	not target_is_admin
+}
+
+decision = {"allow": allow, "reason": reason}
+
+reason = "admin" {
+	allow
+} else = "not an admin" {
+	not actor_is_admin
+} else = "target is an admin" {
+	true
+}
+
+actor_is_admin {
+	input.Actor.Roles[_] == "admin"
+}
+
+target_is_admin {
+	input.Target.Roles[_] == "admin"
+}`
+
+// ImpersonationPolicy evaluates the impersonation module for the actor and
+// target, both must be known users
+func ImpersonationPolicy(users *userstore.Store) authn.ImpersonationPolicy {
+	rule, err := partialDecisionRule("impersonation.rego", impersonationModule)
+	if err != nil {
+		return decisions.RecordImpersonation(engine, func(r *http.Request, actor types.Principal, target string) (bool, string, error) {
+			return false, "", err
+		})
+	}
+
+	return decisions.RecordImpersonation(engine, func(r *http.Request, actor types.Principal, target string) (bool, string, error) {
+		actorUser, ok := users.Get(actor.Name)
+		if !ok {
+			return false, "unknown user", nil
+		}
+		targetUser, ok := users.Get(target)
+		if !ok {
+			return false, "unknown user", nil
+		}
+
+		authzInputData := struct {
+			Actor  types.User
+			Target types.User
+		}{
+			Actor:  actorUser,
+			Target: targetUser,
+		}
+
+		return evalDecision(r.Context(), rule, authzInputData)
+	})
+}
@@ -0,0 +1,86 @@
+package rego
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// SearchHandler returns the entries matching the query in the q parameter,
+// only entries the user is permitted to read are included
+func SearchHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook, index *search.Index) func(w http.ResponseWriter, r *http.Request) {
+	// results are checked with the same policy as the GetEntryHandler
+	getEntryRule, err := partialDecisionRule("get_entry.rego", getEntryModule)
+	if err != nil {
+		return health.Unavailable(engine, "get_entry.rego", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userName := principal.Name
+
+		query := r.URL.Query().Get("q")
+		if strings.TrimSpace(query) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var results []search.Result
+		for _, id := range index.Search(query) {
+			entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, id)
+			if !ok {
+				continue
+			}
+
+			authzInputData := struct {
+				User        string
+				Type        string
+				Claims      map[string]interface{}
+				Certificate *types.Certificate
+				Scopes      []string
+				Roles       []string
+				Grants      []string
+				Entry       types.Entry
+				Notebook    types.Notebook
+			}{
+				User:        userName,
+				Type:        principal.Type,
+				Claims:      principal.Claims,
+				Certificate: principal.Certificate,
+				Scopes:      principal.Scopes,
+				Roles:       principal.Roles,
+				Grants:      principal.Grants,
+				Entry:       entry,
+				Notebook:    notebook,
+			}
+
+			decision := decisions.Start(r.Context(), engine, principal, "read_entry", "entries/"+id, authzInputData)
+			allowed, reason, err := evalDecision(r.Context(), getEntryRule, authzInputData)
+			decision.Finish(allowed, reason, err)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				continue
+			}
+
+			results = append(results, search.NewResult(id, entry, query))
+		}
+
+		search.WriteResults(w, results)
+	}
+}
@@ -0,0 +1,141 @@
+package rego
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/metrics"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// Store keeps the data policies refer to in OPA's in-memory storage, the
+// permissions granted by each role as data.role_permissions and the users as
+// data.users. Only the parts of users policies need are stored, not their
+// credentials. The users are those of a users store, which every engine and
+// authentication read. The storage watches it, so each change to a user is
+// written to the storage in a transaction before it's made, and policies
+// don't need the users sent as input.
+type Store struct {
+	users *userstore.Store
+	store storage.Store
+}
+
+// storedUser is a user as policies see them in data.users
+type storedUser struct {
+	Roles   []string `json:"Roles"`
+	Friends []string `json:"Friends"`
+}
+
+func newStoredUser(user types.User) storedUser {
+	stored := storedUser{Roles: user.Roles, Friends: user.Friends}
+	if stored.Roles == nil {
+		stored.Roles = []string{}
+	}
+	if stored.Friends == nil {
+		stored.Friends = []string{}
+	}
+	return stored
+}
+
+// NewStore loads the users into a new store which is kept in step with them
+func NewStore(users *userstore.Store) (*Store, error) {
+	s := &Store{users: users}
+	err := users.Watch(func(current map[string]types.User) error {
+		stored := make(map[string]interface{}, len(current))
+		for name, user := range current {
+			stored[name] = newStoredUser(user)
+		}
+
+		// values are written as their JSON would be, so that they're read
+		// back as the types OPA expects
+		data, err := toStorageValue(map[string]interface{}{
+			"role_permissions": types.RolePermissions,
+			"users":            stored,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode policy data: %s", err)
+		}
+
+		s.store = inmem.NewFromObject(data.(map[string]interface{}))
+		return nil
+	}, s.write)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// User looks up the named user, in a data.load span like helpers.LoadUser
+func (s *Store) User(ctx context.Context, name string) (types.User, bool) {
+	return helpers.LoadUser(ctx, s.users, name)
+}
+
+// write changes a user in the storage, it's called by the users store before
+// the change is made there
+func (s *Store) write(ctx context.Context, name string, user types.User, deleted bool) error {
+	if deleted {
+		err := storage.Txn(ctx, s.store, storage.WriteParams, func(txn storage.Transaction) error {
+			return s.store.Write(ctx, txn, storage.RemoveOp, storage.Path{"users", name}, nil)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete user: %s", err)
+		}
+		return nil
+	}
+
+	value, err := toStorageValue(newStoredUser(user))
+	if err != nil {
+		return fmt.Errorf("failed to encode user: %s", err)
+	}
+	err = storage.Txn(ctx, s.store, storage.WriteParams, func(txn storage.Transaction) error {
+		return s.store.Write(ctx, txn, storage.AddOp, storage.Path{"users", name}, value)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write user: %s", err)
+	}
+	return nil
+}
+
+// toStorageValue converts the value to the JSON types the store holds
+func toStorageValue(value interface{}) (interface{}, error) {
+	if err := util.RoundTrip(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// preparedRule compiles a single module and prepares the query to be
+// evaluated against the store. Unlike partialRule, the data isn't evaluated
+// when the rule is prepared, so each evaluation reads the store as it is
+// then. It's recorded and invalidates cached decisions like partialRule.
+func preparedRule(name, module, query string, store *Store) (rego.PreparedEvalQuery, error) {
+	start := time.Now()
+	compiler, err := ast.CompileModules(map[string]string{name: module})
+	if err != nil {
+		metrics.ObservePolicyCompile(engine, name, time.Since(start), err)
+		health.ObservePolicy(engine, name, err)
+		return rego.PreparedEvalQuery{}, fmt.Errorf("rule failed to compile: %s", err)
+	}
+
+	rule, err := rego.
+		New(rego.Compiler(compiler), rego.Store(store.store), rego.Query(query)).
+		PrepareForEval(context.Background())
+	metrics.ObservePolicyCompile(engine, name, time.Since(start), err)
+	health.ObservePolicy(engine, name, err)
+	decisioncache.Invalidate()
+	if err != nil {
+		return rego.PreparedEvalQuery{}, fmt.Errorf("failed to prepare query: %s", err)
+	}
+
+	return rule, nil
+}
@@ -0,0 +1,241 @@
+package rego
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// manageTokenModule permits users to issue, see and revoke only their own
+// tokens
+const manageTokenModule = `
+package auth
+default allow = false
+allow {
+	input.Token.User == input.User
+}
+
+decision = {"allow": allow, "reason": reason}
+
+reason = "owner" {
+	allow
+} else = "token of another user" {
+	true
+}`
+
+// revokeTokenModule permits users to revoke their own tokens, but not admins
+// acting as them
+const revokeTokenModule = `
+package auth
+default allow = false
+allow {
+	input.Impersonator == ""
+	input.Token.User == input.User
+}
+
+decision = {"allow": allow, "reason": reason}
+
+reason = "impersonated" {
+	input.Impersonator != ""
+} else = "token of another user" {
+	input.Token.User != input.User
+} else = "owner" {
+	true
+}`
+
+// issueTokenModule also stops a scoped token being used to issue a token with
+// scopes it doesn't hold, tokens are only issued to users and not when the
+// principal's risk is elevated by recent failed attempts to authenticate.
+// Admins acting as the user can't issue tokens, which would outlive the
+// impersonation and not record who issued them.
+const issueTokenModule = `
+package auth
+default allow = false
+allow {
+	input.Type == "user"
+	input.Impersonator == ""
+	input.Risk != "elevated"
+	input.Token.User == input.User
+	not exceeds_scopes
+}
+
+decision = {"allow": allow, "reason": reason}
+
+reason = "not a user" {
+	input.Type != "user"
+} else = "token of another user" {
+	input.Token.User != input.User
+} else = "impersonated" {
+	input.Impersonator != ""
+} else = "elevated risk" {
+	input.Risk == "elevated"
+} else = message {
+	message := concat(" ", ["missing scope", missing_scopes[0]])
+} else = "owner" {
+	true
+}
+
+exceeds_scopes {
+	count(missing_scopes) > 0
+}
+
+missing_scopes = [scope | scope := input.Token.Scopes[_]; not held_scopes[scope]]
+
+held_scopes[scope] {
+	scope := input.Scopes[_]
+}`
+
+// canManageToken evaluates a token policy for a principal and token
+func canManageToken(ctx context.Context, rule rego.PartialResult, principal types.Principal, token types.Token) (bool, string, error) {
+	authzInputData := struct {
+		User         string
+		Type         string
+		Impersonator string
+		Risk         string
+		Scopes       []string
+		Token        types.Token
+	}{
+		User:         principal.Name,
+		Type:         principal.Type,
+		Impersonator: principal.Impersonator,
+		Risk:         principal.Risk,
+		Scopes:       principal.Scopes,
+		Token:        token,
+	}
+
+	return evalDecision(ctx, rule, authzInputData)
+}
+
+// CreateTokenHandler issues a new token to the user, the secret is returned
+// in the response
+func CreateTokenHandler(tokens *authn.Tokens) func(w http.ResponseWriter, r *http.Request) {
+	issueTokenRule, err := partialDecisionRule("issue_token.rego", issueTokenModule)
+	if err != nil {
+		return health.Unavailable(engine, "issue_token.rego", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userName := principal.Name
+
+		payload, err := helpers.ReadCreateTokenPayload(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		requested := types.Token{User: userName, Name: payload.Name, Scopes: payload.RequestedScopes()}
+		decision := decisions.Start(r.Context(), engine, principal, "issue_token", "tokens", []interface{}{principal, requested})
+		allowed, reason, err := canManageToken(r.Context(), issueTokenRule, principal, requested)
+		decision.Finish(allowed, reason, err)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		token, secret, err := tokens.Issue(userName, requested.Name, requested.Scopes, payload.Lifetime())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		helpers.WriteIssuedToken(w, token, secret)
+	}
+}
+
+// ListTokensHandler lists the tokens the user is permitted to manage
+func ListTokensHandler(tokens *authn.Tokens) func(w http.ResponseWriter, r *http.Request) {
+	manageTokenRule, err := partialDecisionRule("manage_token.rego", manageTokenModule)
+	if err != nil {
+		return health.Unavailable(engine, "manage_token.rego", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var permitted []types.Token
+		for _, token := range tokens.All() {
+			decision := decisions.Start(r.Context(), engine, principal, "read_token", "tokens/"+token.ID, []interface{}{principal, token})
+			allowed, reason, err := canManageToken(r.Context(), manageTokenRule, principal, token)
+			decision.Finish(allowed, reason, err)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if allowed {
+				permitted = append(permitted, token)
+			}
+		}
+
+		helpers.WriteTokens(w, permitted)
+	}
+}
+
+// RevokeTokenHandler revokes a token, it can't be used from then on
+func RevokeTokenHandler(tokens *authn.Tokens) func(w http.ResponseWriter, r *http.Request) {
+	revokeTokenRule, err := partialDecisionRule("revoke_token.rego", revokeTokenModule)
+	if err != nil {
+		return health.Unavailable(engine, "revoke_token.rego", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		tokenID, ok := mux.Vars(r)["tokenID"]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		token, ok := tokens.Get(tokenID)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		decision := decisions.Start(r.Context(), engine, principal, "revoke_token", "tokens/"+tokenID, []interface{}{principal, token})
+		allowed, reason, err := canManageToken(r.Context(), revokeTokenRule, principal, token)
+		decision.Finish(allowed, reason, err)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		tokens.Revoke(tokenID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
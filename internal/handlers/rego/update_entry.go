@@ -0,0 +1,154 @@
+package rego
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// UpdateEntryHandler will overwrite the content of an entry, if permitted. The
+// replaced content is kept as a revision and the search index is updated
+func UpdateEntryHandler(entries *entrystore.Store, notebooks *map[string]types.Notebook, index *search.Index) func(w http.ResponseWriter, r *http.Request) {
+	// only the owner and editors of an entry, or of its notebook, may update
+	// it. Service accounts may not.
+	updateEntryRule, err := partialDecisionRule("update_entry.rego", `
+	package auth
+	default allow = false
+	# the token must be allowed to write entries as well as the user
+	allow {
+		scoped
+		input.Type == "user"
+		updated_by
+	}
+
+	decision = {"allow": allow, "reason": reason}
+
+	reason = "missing scope entries:write" {
+		not scoped
+	} else = "not a user" {
+		input.Type != "user"
+	} else = rule {
+		rule := updated_by
+	} else = "not an editor" {
+		true
+	}
+
+	scoped {
+		input.Scopes[_] == "entries:write"
+	}
+
+	updated_by = "owner" {
+		input.Entry.User == input.User
+	} else = "editor" {
+		input.Entry.Editors[_] == input.User
+	} else = "notebook sharing" {
+		inherits_sharing
+		notebook_editors[input.User]
+	}
+
+	notebook_editors[user] {
+		user := input.Notebook.User
+	}
+	notebook_editors[user] {
+		user := input.Notebook.Editors[_]
+	}
+
+	inherits_sharing {
+		input.Entry.Notebook != ""
+		not input.Entry.OverrideSharing
+	}`)
+	if err != nil {
+		return health.Unavailable(engine, "update_entry.rego", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userName := principal.Name
+
+		// get the entryID from the request vars set for us by go mux
+		entryID, ok := mux.Vars(r)["entryID"]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// check that the entry exists
+		entry, notebook, ok := helpers.LoadEntry(r.Context(), entries, notebooks, entryID)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		authzInputData := struct {
+			User        string
+			Type        string
+			Claims      map[string]interface{}
+			Certificate *types.Certificate
+			Scopes      []string
+			Entry       types.Entry
+			Notebook    types.Notebook
+		}{
+			User:        userName,
+			Type:        principal.Type,
+			Claims:      principal.Claims,
+			Certificate: principal.Certificate,
+			Scopes:      principal.Scopes,
+			Entry:       entry,
+			Notebook:    notebook,
+		}
+
+		decision := decisions.Start(r.Context(), engine, principal, "update_entry", "entries/"+entryID, authzInputData)
+		allowed, reason, err := evalDecision(r.Context(), updateEntryRule, authzInputData)
+		decision.Finish(allowed, reason, err)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		payloadBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var payload helpers.UpdateEntryPayload
+		err = json.Unmarshal(payloadBytes, &payload)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// the entry is revised as it's stored now, another update may have
+		// been made since it was authorized. It's indexed before the store is
+		// unlocked so that the index matches the latest content.
+		_, ok = entries.Update(entryID, func(current types.Entry) types.Entry {
+			revised := helpers.ReviseEntry(current, userName, payload.Content)
+			index.Put(entryID, revised.Content)
+			return revised
+		})
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
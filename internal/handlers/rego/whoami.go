@@ -1,141 +1,100 @@
 package rego
 
 import (
-	"context"
-	"fmt"
-	"log"
 	"net/http"
 
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/helpers"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
-	"github.com/open-policy-agent/opa/ast"
-	"github.com/open-policy-agent/opa/rego"
 )
 
 // WhoAmIHandler is the rego implementation of the first task
-func WhoAmIHandler(users *map[string]types.User) func(w http.ResponseWriter, r *http.Request) {
-	// whoAmiRule is partially evaluated at boot time and then available to make
-	// decisions during the execution of the handler
-	var whoAmiRule rego.PartialResult
-	// initialize the various gubbins for Rego evaluation.
-	// we can load and partially evaluate the rule before using it in our
-	// handler.
-	compiler, err := ast.CompileModules(map[string]string{
-		"whoami.rego": `
+func WhoAmIHandler(store *Store) func(w http.ResponseWriter, r *http.Request) {
+	// whoAmiRule is prepared at boot time and then available to make
+	// decisions during the execution of the handler. The principal has already
+	// been authenticated by the time the rule is evaluated, users only need to
+	// be a user we still know about in the store and service accounts were
+	// checked by their authenticator.
+	whoAmiRule, err := preparedRule("whoami.rego", `
 		package auth
-		whoami[result] {
-			headers := object.get(input.Headers, "Authorization", [])
-			token := concat("", {h| h := split(headers[_], " ")[1]})
-			users := [u| input.Users[u].Token == token]
+		default whoami = ""
+		whoami = name {
+			input.Principal.Type == "user"
+			name := input.Principal.Name
+			data.users[name]
+		}
+		whoami = name {
+			input.Principal.Type == "service_account"
+			name := input.Principal.Name
+		}
 
-			result := {
-				"auth_header_set": object.get(input.Headers, "Authorization", false) != false,
-				"token": token,
-				"users": users,
-			}
-		}`,
-	})
-	if err != nil {
-		log.Fatalf("rule failed to compile: %s", err)
-	}
+		decision = {"whoami": whoami, "reason": reason}
 
-	// create a partially evaluated result ready for use in our handlers when
-	// evaluating requests
-	whoAmiRule, err = rego.
-		New(rego.Compiler(compiler), rego.Query("data.auth.whoami")).
-		PartialResult(context.Background())
+		reason = "known user" {
+			input.Principal.Type == "user"
+			data.users[input.Principal.Name]
+		} else = "service account" {
+			input.Principal.Type == "service_account"
+		} else = "unknown user" {
+			true
+		}`, "data.auth.decision", store)
 	if err != nil {
-		log.Fatalf("failed to compute partial result: %s", err)
+		return health.Unavailable(engine, "whoami.rego", err)
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		// this data will be used by Rego to determine the user making the request
-		authzInputData := struct {
-			Headers http.Header
-			Users   *map[string]types.User
-		}{
-			Headers: r.Header,
-			Users:   users,
-		}
-
-		// this evaluates our rule for the endpoint with the request and the user
-		// data (clearly it'd be unwise to load all the users into an authz
-		// check in a real application...)
-		resultSet, err := whoAmiRule.Rego(rego.Input(authzInputData)).Eval(r.Context())
-		if err != nil || resultSet == nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		if len(resultSet) != 1 {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		result := resultSet[0]
-
-		// we expect there to be a single solution in the valid case of identifying
-		// a user
-		if len(result.Expressions) != 1 {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		expressions, ok := result.Expressions[0].Value.([]interface{})
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
 		if !ok {
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		if len(expressions) != 1 {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		// only the principal is input, the users are read from the store
+		authzInputData := struct {
+			Principal types.Principal
+		}{
+			Principal: principal,
 		}
 
-		expression, ok := expressions[0].(map[string]interface{})
-		if !ok {
+		decision := decisions.Start(r.Context(), engine, principal, "whoami", "users/"+principal.Name, authzInputData)
+		resultSet, err := evalPrepared(r.Context(), whoAmiRule, authzInputData)
+		if err != nil {
+			decision.Finish(false, "", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		authHeaderSet, ok := expression["auth_header_set"].(bool)
-		if !ok {
+		if len(resultSet) != 1 || len(resultSet[0].Expressions) != 1 {
+			decision.Finish(false, "", errUnexpectedResult)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if authHeaderSet == false {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
-		token, ok := expression["token"].(string)
+		result, ok := resultSet[0].Expressions[0].Value.(map[string]interface{})
 		if !ok {
+			decision.Finish(false, "", errUnexpectedResult)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if token == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		users := expression["users"].([]interface{})
-		if !ok {
+		user, userOK := result["whoami"].(string)
+		reason, reasonOK := result["reason"].(string)
+		if !userOK || !reasonOK {
+			decision.Finish(false, "", errUnexpectedResult)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		// we expect there to be a single solution in the valid case of identifying
-		// a user
-		if len(users) != 1 {
+		// an empty name means the principal isn't a known user
+		decision.Finish(user != "", reason, nil)
+		if user == "" {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		user, ok := users[0].(string)
-		if !ok {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
 		// report back the to the user who they are
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, user)
+		helpers.WriteWhoAmI(w, r, user, principal.Type)
 	}
 }
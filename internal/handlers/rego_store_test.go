@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+)
+
+// mustRegoStore loads the users into a store for the rego handlers
+func mustRegoStore(users *userstore.Store) *rego.Store {
+	store, err := rego.NewStore(users)
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
+
+func TestRegoStore(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123", Friends: []string{"Bob"}},
+		"Bob":     {Token: "456", Friends: []string{"Alice"}},
+		"Charlie": {Token: "789"},
+	})
+	store := mustRegoStore(users)
+
+	whoami := rego.WhoAmIHandler(store)
+	createFriendRequest := rego.CreateFriendRequestHandler(store)
+
+	// the handlers are called directly, so that the users are only known to
+	// the policies through the store
+	call := func(handler func(http.ResponseWriter, *http.Request), name string, req *http.Request) int {
+		principal := types.Principal{Name: name, Type: types.PrincipalTypeUser, Scopes: types.AllScopes}
+		rr := httptest.NewRecorder()
+		handler(rr, req.WithContext(authn.WithPrincipal(req.Context(), principal)))
+		return rr.Code
+	}
+	whoamiAs := func(name string) int {
+		return call(whoami, name, httptest.NewRequest("GET", "/rego/whoami", nil))
+	}
+	requestFriend := func(name, friend string) int {
+		return call(createFriendRequest, name, httptest.NewRequest("POST", "/rego/friendrequests", bytes.NewBufferString(`{"friend": "`+friend+`"}`)))
+	}
+
+	testCases := []struct {
+		Description    string
+		Change         func() error
+		Check          func() int
+		ExpectedStatus int
+	}{
+		{
+			Description:    "charlie has no mutual friends with alice",
+			Check:          func() int { return requestFriend("Alice", "Charlie") },
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description: "a friendship put in the store is used",
+			Change: func() error {
+				if err := users.Put(context.Background(), "Charlie", types.User{Token: "789", Friends: []string{"Bob"}}); err != nil {
+					return err
+				}
+				return users.Put(context.Background(), "Bob", types.User{Token: "456", Friends: []string{"Alice", "Charlie"}})
+			},
+			Check:          func() int { return requestFriend("Alice", "Charlie") },
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description: "a friendship removed from the store is no longer used",
+			Change: func() error {
+				return users.Put(context.Background(), "Bob", types.User{Token: "456", Friends: []string{"Alice"}})
+			},
+			Check:          func() int { return requestFriend("Alice", "Charlie") },
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "a user in the store is known",
+			Check:          func() int { return whoamiAs("Charlie") },
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "a user deleted from the store is unknown",
+			Change:         func() error { return users.Delete(context.Background(), "Charlie") },
+			Check:          func() int { return whoamiAs("Charlie") },
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "a user added to the store is known",
+			Change:         func() error { return users.Put(context.Background(), "Dennis", types.User{Token: "101"}) },
+			Check:          func() int { return whoamiAs("Dennis") },
+			ExpectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			if tc.Change != nil {
+				if err := tc.Change(); err != nil {
+					t.Fatalf("failed to change store: %s", err)
+				}
+			}
+			if got := tc.Check(); got != tc.ExpectedStatus {
+				t.Fatalf("unexpected response code: got %d want %d", got, tc.ExpectedStatus)
+			}
+		})
+	}
+
+	// changes are made to the users every engine reads, the rego store is
+	// kept in step with them rather than having its own
+	if _, ok := store.User(context.Background(), "Charlie"); ok {
+		t.Fatalf("deleted user is still in the store")
+	}
+	if _, ok := store.User(context.Background(), "Dennis"); !ok {
+		t.Fatalf("added user isn't in the store")
+	}
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/requestid"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestRequestID(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123", Roles: []string{"admin"}},
+		"Bob":   {Token: "456"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	var logs bytes.Buffer
+	ring := decisions.NewRing(100)
+
+	router := mux.NewRouter()
+	router.Use(
+		requestid.Middleware(),
+		decisions.Middleware(decisions.NewLog(ring)),
+		authn.Middleware(authn.BearerToken{Users: users}),
+		authn.Impersonation(map[string]authn.ImpersonationPolicy{
+			"golang": golang.ImpersonationPolicy(users),
+			"rego":   rego.ImpersonationPolicy(users),
+			"cue":    cue.ImpersonationPolicy(users),
+			"polar":  polar.ImpersonationPolicy(users),
+		}, log.New(&logs, "", 0)),
+		authn.UserRoles(users),
+	)
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks))
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	testCases := []struct {
+		Description       string
+		Token             string
+		ActAs             string
+		RequestID         string
+		Path              string
+		ExpectedStatus    int
+		ExpectedRequestID string
+		ExpectedResponse  string
+		ExpectedDecision  bool
+		ExpectedLog       string
+	}{
+		{
+			Description:       "client request ID is used for a denial",
+			Token:             "456",
+			RequestID:         "support-ticket-42",
+			Path:              "/entries/1",
+			ExpectedStatus:    http.StatusUnauthorized,
+			ExpectedRequestID: "support-ticket-42",
+			ExpectedResponse:  `{"error":"Unauthorized","request_id":"support-ticket-42"}`,
+			ExpectedDecision:  true,
+		},
+		{
+			Description:       "client request ID is returned with a permitted response",
+			Token:             "123",
+			RequestID:         "abc.123:def_4",
+			Path:              "/entries/1",
+			ExpectedStatus:    http.StatusOK,
+			ExpectedRequestID: "abc.123:def_4",
+			ExpectedResponse:  "dear diary",
+			ExpectedDecision:  true,
+		},
+		{
+			Description:      "missing request ID is generated",
+			Token:            "456",
+			Path:             "/entries/1",
+			ExpectedStatus:   http.StatusUnauthorized,
+			ExpectedResponse: `{"error":"Unauthorized","request_id":"%s"}`,
+			ExpectedDecision: true,
+		},
+		{
+			Description:      "unsafe request ID is replaced",
+			Token:            "456",
+			RequestID:        "forged\" injected=true",
+			Path:             "/entries/1",
+			ExpectedStatus:   http.StatusUnauthorized,
+			ExpectedResponse: `{"error":"Unauthorized","request_id":"%s"}`,
+			ExpectedDecision: true,
+		},
+		{
+			Description:      "overlong request ID is replaced",
+			Token:            "456",
+			RequestID:        strings.Repeat("a", 129),
+			Path:             "/entries/1",
+			ExpectedStatus:   http.StatusUnauthorized,
+			ExpectedResponse: `{"error":"Unauthorized","request_id":"%s"}`,
+			ExpectedDecision: true,
+		},
+		{
+			Description:       "missing entry error has the request ID",
+			Token:             "123",
+			RequestID:         "missing-entry",
+			Path:              "/entries/2",
+			ExpectedStatus:    http.StatusNotFound,
+			ExpectedRequestID: "missing-entry",
+			ExpectedResponse:  `{"error":"Not Found","request_id":"missing-entry"}`,
+		},
+		{
+			Description:       "authentication error has the request ID",
+			Token:             "000",
+			RequestID:         "bad-token",
+			Path:              "/entries/1",
+			ExpectedStatus:    http.StatusUnauthorized,
+			ExpectedRequestID: "bad-token",
+			ExpectedResponse:  `{"error":"Unauthorized","request_id":"bad-token"}`,
+		},
+		{
+			Description:       "impersonation log has the request ID",
+			Token:             "123",
+			ActAs:             "Bob",
+			RequestID:         "acting-as-bob",
+			Path:              "/entries/1",
+			ExpectedStatus:    http.StatusUnauthorized,
+			ExpectedRequestID: "acting-as-bob",
+			ExpectedResponse:  `{"error":"Unauthorized","request_id":"acting-as-bob"}`,
+			ExpectedDecision:  true,
+			ExpectedLog:       "request_id=acting-as-bob impersonation: Alice as Bob: GET /%s/entries/1 401",
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				logs.Reset()
+				before := len(ring.Decisions())
+
+				req := httptest.NewRequest("GET", fmt.Sprintf("/%s%s", language, tc.Path), nil)
+				req.Header.Set("Authorization", "Bearer "+tc.Token)
+				if tc.RequestID != "" {
+					req.Header.Set("X-Request-ID", tc.RequestID)
+				}
+				if tc.ActAs != "" {
+					req.Header.Set("X-Act-As", tc.ActAs)
+				}
+
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+
+				if rr.Code != tc.ExpectedStatus {
+					t.Fatalf("unexpected response code: got %d want %d", rr.Code, tc.ExpectedStatus)
+				}
+
+				id := rr.Header().Get("X-Request-ID")
+				if tc.ExpectedRequestID != "" && id != tc.ExpectedRequestID {
+					t.Fatalf("unexpected request ID: got %q want %q", id, tc.ExpectedRequestID)
+				}
+				if tc.ExpectedRequestID == "" && !generated.MatchString(id) {
+					t.Fatalf("expected a generated request ID, got %q", id)
+				}
+
+				expectedResponse := tc.ExpectedResponse
+				if strings.Contains(expectedResponse, "%s") {
+					expectedResponse = fmt.Sprintf(expectedResponse, id)
+				}
+				if got := strings.TrimSpace(rr.Body.String()); got != expectedResponse {
+					t.Fatalf("unexpected response: got %q want %q", got, expectedResponse)
+				}
+				if tc.ExpectedStatus >= http.StatusBadRequest {
+					var body requestid.ErrorResponse
+					if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+						t.Fatalf("failed to parse error response: %s", err)
+					}
+				}
+
+				recorded := ring.Decisions()[before:]
+				if tc.ExpectedDecision {
+					if len(recorded) == 0 {
+						t.Fatalf("expected a decision")
+					}
+					for _, decision := range recorded {
+						if decision.RequestID != id {
+							t.Fatalf("unexpected decision request ID: got %q want %q", decision.RequestID, id)
+						}
+					}
+				} else if len(recorded) != 0 {
+					t.Fatalf("unexpected decisions: %+v", recorded)
+				}
+
+				if tc.ExpectedLog != "" {
+					if got, want := strings.TrimSpace(logs.String()), fmt.Sprintf(tc.ExpectedLog, language); got != want {
+						t.Fatalf("unexpected log: got %q want %q", got, want)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestRoles(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123", Roles: []string{"admin"}},
+		"Bob":     {Token: "456", Roles: []string{"moderator"}},
+		"Charlie": {Token: "789", Roles: []string{"member"}},
+		"Dennis":  {Token: "101"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Charlie", Content: "spam", Reported: true},
+		"2": {User: "Charlie", Content: "secret spam", Reported: true, Private: true},
+		"3": {User: "Charlie", Content: "not spam"},
+		"4": {User: "Dennis", Content: "more spam", Reported: true},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description      string
+		Token            string
+		ActAs            string
+		EntryID          string
+		ExpectedStatus   int
+		ExpectedResponse string
+	}{
+		{
+			Description:      "moderator can read a reported entry",
+			Token:            "456",
+			EntryID:          "1",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "spam",
+		},
+		{
+			Description:    "moderator cannot read a private reported entry",
+			Token:          "456",
+			EntryID:        "2",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "moderator cannot read an entry which isn't reported",
+			Token:          "456",
+			EntryID:        "3",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:      "admin can read a private reported entry",
+			Token:            "123",
+			EntryID:          "2",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "secret spam",
+		},
+		{
+			Description:    "admin cannot read an entry which isn't reported",
+			Token:          "123",
+			EntryID:        "3",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "member cannot read another user's reported entry",
+			Token:          "789",
+			EntryID:        "4",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:      "owner can still read their private reported entry",
+			Token:            "789",
+			EntryID:          "2",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "secret spam",
+		},
+		{
+			Description:    "admin acting as a member has the member's roles",
+			Token:          "123",
+			ActAs:          "Dennis",
+			EntryID:        "1",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				router := newRolesRouter(users, entryStore, &notebooks)
+
+				req, err := http.NewRequest("GET", fmt.Sprintf("/%s/entries/%s", language, tc.EntryID), nil)
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				req.Header.Set("Authorization", "Bearer "+tc.Token)
+				if tc.ActAs != "" {
+					req.Header.Set(authn.ActAsHeader, tc.ActAs)
+				}
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				body, err := ioutil.ReadAll(w.Body)
+				if err != nil {
+					t.Fatalf("failed to read request: %s", err)
+				}
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+
+				if got, want := string(body), tc.ExpectedResponse; got != want {
+					t.Fatalf("unexpected body: got %s want %s", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestRolesSearch(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Bob": {Token: "456", Roles: []string{"moderator"}},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Charlie", Content: "spam", Reported: true},
+		"2": {User: "Charlie", Content: "secret spam", Reported: true, Private: true},
+		"3": {User: "Charlie", Content: "not spam"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	for _, language := range languages {
+		t.Run(language, func(t *testing.T) {
+			router := newRolesRouter(users, entryStore, &notebooks)
+
+			req, err := http.NewRequest("GET", fmt.Sprintf("/%s/search?q=spam", language), nil)
+			if err != nil {
+				t.Fatalf("failed to build request: %s", err)
+			}
+			req.Header.Set("Authorization", "Bearer 456")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+
+			body, err := ioutil.ReadAll(w.Body)
+			if err != nil {
+				t.Fatalf("failed to read request: %s", err)
+			}
+
+			// only the reported entry which isn't private is found
+			if got, want := string(body), `{"count":1,"results":[{"id":"1","snippet":"spam"}]}`; got != want {
+				t.Fatalf("unexpected body: got %s want %s", got, want)
+			}
+		})
+	}
+}
+
+// newRolesRouter serves the entry handlers of each engine with principals
+// given the roles of their user
+func newRolesRouter(users *userstore.Store, entries *entrystore.Store, notebooks *map[string]types.Notebook) *mux.Router {
+	index := search.NewIndex(entries)
+
+	router := mux.NewRouter()
+	router.Use(
+		authn.Middleware(authn.BearerToken{Users: users}),
+		authn.Impersonation(map[string]authn.ImpersonationPolicy{
+			"golang": golang.ImpersonationPolicy(users),
+			"rego":   rego.ImpersonationPolicy(users),
+			"cue":    cue.ImpersonationPolicy(users),
+			"polar":  polar.ImpersonationPolicy(users),
+		}, nil),
+		authn.UserRoles(users),
+	)
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entries, notebooks))
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entries, notebooks))
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entries, notebooks))
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entries, notebooks))
+	router.HandleFunc("/golang/search", golang.SearchHandler(entries, notebooks, index))
+	router.HandleFunc("/rego/search", rego.SearchHandler(entries, notebooks, index))
+	router.HandleFunc("/cue/search", cue.SearchHandler(entries, notebooks, index))
+	router.HandleFunc("/polar/search", polar.SearchHandler(entries, notebooks, index))
+
+	return router
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestScopedTokens(t *testing.T) {
+	testCases := []struct {
+		Description      string
+		Scopes           []string
+		Languages        []string
+		Method           string
+		Path             string
+		Body             string
+		ExpectedStatus   int
+		ExpectedResponse string
+	}{
+		{
+			Description:      "read only token can read an entry",
+			Scopes:           []string{types.ScopeEntriesRead},
+			Method:           "GET",
+			Path:             "/entries/1",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "Dear diary...",
+		},
+		{
+			Description:    "read only token cannot update the user's own entry",
+			Scopes:         []string{types.ScopeEntriesRead},
+			Method:         "PUT",
+			Path:           "/entries/1",
+			Body:           `{"content": "updated"}`,
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "write only token cannot read the user's own entry",
+			Scopes:         []string{types.ScopeEntriesWrite},
+			Method:         "GET",
+			Path:           "/entries/1",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "write only token can update the user's own entry",
+			Scopes:         []string{types.ScopeEntriesWrite},
+			Method:         "PUT",
+			Path:           "/entries/1",
+			Body:           `{"content": "updated"}`,
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "write only token cannot see the history of the user's own entry",
+			Scopes:         []string{types.ScopeEntriesWrite},
+			Method:         "GET",
+			Path:           "/entries/1/revisions",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:      "search results need the read scope",
+			Scopes:           []string{types.ScopeFriendsWrite},
+			Method:           "GET",
+			Path:             "/search?q=diary",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: `{"count":0,"results":[]}`,
+		},
+		{
+			Description:    "read only token cannot create a friend request the user could make",
+			Scopes:         []string{types.ScopeEntriesRead},
+			Languages:      []string{"golang", "rego", "polar"},
+			Method:         "POST",
+			Path:           "/friendrequests",
+			Body:           `{"friend": "Charlie"}`,
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "friends token can create a friend request",
+			Scopes:         []string{types.ScopeFriendsWrite},
+			Languages:      []string{"golang", "rego", "polar"},
+			Method:         "POST",
+			Path:           "/friendrequests",
+			Body:           `{"friend": "Charlie"}`,
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "read only token cannot issue a token with more scopes",
+			Scopes:         []string{types.ScopeEntriesRead},
+			Method:         "POST",
+			Path:           "/tokens",
+			Body:           `{"name": "escalated", "scopes": ["entries:read", "friends:write"]}`,
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "read only token cannot issue a token without scopes",
+			Scopes:         []string{types.ScopeEntriesRead},
+			Method:         "POST",
+			Path:           "/tokens",
+			Body:           `{"name": "escalated"}`,
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "read only token can issue another read only token",
+			Scopes:         []string{types.ScopeEntriesRead},
+			Method:         "POST",
+			Path:           "/tokens",
+			Body:           `{"name": "copy", "scopes": ["entries:read"]}`,
+			ExpectedStatus: http.StatusCreated,
+		},
+		{
+			Description:    "tokens with unknown scopes cannot be issued",
+			Scopes:         types.AllScopes,
+			Method:         "POST",
+			Path:           "/tokens",
+			Body:           `{"name": "admin", "scopes": ["admin"]}`,
+			ExpectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		languages := tc.Languages
+		if languages == nil {
+			languages = []string{"golang", "rego", "cue", "polar"}
+		}
+
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				users := userstore.New(map[string]types.User{
+					"Alice":   {Token: "123", Friends: []string{"Bob"}},
+					"Bob":     {Token: "456", Friends: []string{"Alice", "Charlie"}},
+					"Charlie": {Token: "789", Friends: []string{"Bob"}},
+				})
+				var entries = map[string]types.Entry{
+					"1": {User: "Alice", Content: "Dear diary..."},
+				}
+				entryStore := entrystore.New(entries)
+				var notebooks = map[string]types.Notebook{}
+				index := search.NewIndex(entryStore)
+
+				tokens := authn.NewTokens()
+				_, secret, err := tokens.Issue("Alice", "scoped", tc.Scopes, time.Hour)
+				if err != nil {
+					t.Fatalf("failed to issue token: %s", err)
+				}
+
+				router := mux.NewRouter()
+				router.Use(authn.Middleware(authn.IssuedToken{Tokens: tokens}))
+				router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+				router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+				router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+				router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+				router.HandleFunc("/golang/entries/{entryID}", golang.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+				router.HandleFunc("/rego/entries/{entryID}", rego.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+				router.HandleFunc("/cue/entries/{entryID}", cue.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+				router.HandleFunc("/polar/entries/{entryID}", polar.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+				router.HandleFunc("/golang/entries/{entryID}/revisions", golang.ListEntryRevisionsHandler(entryStore, &notebooks))
+				router.HandleFunc("/rego/entries/{entryID}/revisions", rego.ListEntryRevisionsHandler(entryStore, &notebooks))
+				router.HandleFunc("/cue/entries/{entryID}/revisions", cue.ListEntryRevisionsHandler(entryStore, &notebooks))
+				router.HandleFunc("/polar/entries/{entryID}/revisions", polar.ListEntryRevisionsHandler(entryStore, &notebooks))
+				router.HandleFunc("/golang/search", golang.SearchHandler(entryStore, &notebooks, index))
+				router.HandleFunc("/rego/search", rego.SearchHandler(entryStore, &notebooks, index))
+				router.HandleFunc("/cue/search", cue.SearchHandler(entryStore, &notebooks, index))
+				router.HandleFunc("/polar/search", polar.SearchHandler(entryStore, &notebooks, index))
+				router.HandleFunc("/golang/friendrequests", golang.CreateFriendRequestHandler(users))
+				router.HandleFunc("/rego/friendrequests", rego.CreateFriendRequestHandler(mustRegoStore(users)))
+				router.HandleFunc("/polar/friendrequests", polar.CreateFriendRequestHandler(users))
+				router.HandleFunc("/golang/tokens", golang.CreateTokenHandler(tokens))
+				router.HandleFunc("/rego/tokens", rego.CreateTokenHandler(tokens))
+				router.HandleFunc("/cue/tokens", cue.CreateTokenHandler(tokens))
+				router.HandleFunc("/polar/tokens", polar.CreateTokenHandler(tokens))
+
+				req, err := http.NewRequest(tc.Method, fmt.Sprintf("/%s%s", language, tc.Path), bytes.NewReader([]byte(tc.Body)))
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				req.Header.Set("Authorization", "Bearer "+secret)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+
+				if tc.ExpectedResponse == "" {
+					return
+				}
+				if got, want := w.Body.String(), tc.ExpectedResponse; got != want {
+					t.Fatalf("unexpected body: got %s want %s", got, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestSearchEndpoints(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123"},
+		"Bob":     {Token: "456"},
+		"Charlie": {Token: "789"},
+		"Dennis":  {Token: "101"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "Our secret plans for the party", Readers: []string{"Charlie"}},
+		"2": {User: "Bob", Content: "A secret about band camp"},
+		"3": {User: "Bob", Content: "Band camp was fun", Readers: []string{"Alice"}},
+		"4": {User: "Alice", Content: "It was a long day and I wanted to tell someone a secret but there was no one around to listen"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+	index := search.NewIndex(entryStore)
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+	router.HandleFunc("/golang/search", golang.SearchHandler(entryStore, &notebooks, index))
+	router.HandleFunc("/rego/search", rego.SearchHandler(entryStore, &notebooks, index))
+	router.HandleFunc("/cue/search", cue.SearchHandler(entryStore, &notebooks, index))
+	router.HandleFunc("/polar/search", polar.SearchHandler(entryStore, &notebooks, index))
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description      string
+		Headers          map[string]string
+		Query            string
+		ExpectedStatus   int
+		ExpectedResponse string
+	}{
+		{
+			Description: "owner only finds their own and shared entries",
+			Headers: map[string]string{
+				"Authorization": "Bearer 123",
+			},
+			Query:            "secret",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: `{"count":2,"results":[{"id":"1","snippet":"Our secret plans for the party"},{"id":"4","snippet":"...wanted to tell someone a secret but there was no one..."}]}`,
+		},
+		{
+			Description: "reader finds the entries shared with them",
+			Headers: map[string]string{
+				"Authorization": "Bearer 789",
+			},
+			Query:            "secret",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: `{"count":1,"results":[{"id":"1","snippet":"Our secret plans for the party"}]}`,
+		},
+		{
+			Description: "all terms must match",
+			Headers: map[string]string{
+				"Authorization": "Bearer 456",
+			},
+			Query:            "Band camp secret",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: `{"count":1,"results":[{"id":"2","snippet":"A secret about band camp"}]}`,
+		},
+		{
+			Description: "shared entries are found but private ones are not",
+			Headers: map[string]string{
+				"Authorization": "Bearer 123",
+			},
+			Query:            "band camp",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: `{"count":1,"results":[{"id":"3","snippet":"Band camp was fun"}]}`,
+		},
+		{
+			// the response must be the same as when nothing matches at all
+			Description: "matches in unreadable entries are not leaked",
+			Headers: map[string]string{
+				"Authorization": "Bearer 101",
+			},
+			Query:            "secret",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: `{"count":0,"results":[]}`,
+		},
+		{
+			Description: "no matches",
+			Headers: map[string]string{
+				"Authorization": "Bearer 101",
+			},
+			Query:            "unicorns",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: `{"count":0,"results":[]}`,
+		},
+		{
+			Description: "missing query",
+			Headers: map[string]string{
+				"Authorization": "Bearer 123",
+			},
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Description:    "missing auth header",
+			Headers:        map[string]string{},
+			Query:          "secret",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				req, err := http.NewRequest("GET", fmt.Sprintf("/%s/search?q=%s", language, url.QueryEscape(tc.Query)), nil)
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+
+				for k, v := range tc.Headers {
+					req.Header.Set(k, v)
+				}
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				body, err := ioutil.ReadAll(w.Body)
+				if err != nil {
+					t.Fatalf("failed to read request: %s", err)
+				}
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+
+				if got, want := string(body), tc.ExpectedResponse; got != want {
+					t.Fatalf("unexpected body: got %s want %s", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestSearchAfterUpdate(t *testing.T) {
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	for _, language := range languages {
+		t.Run(language, func(t *testing.T) {
+			users := userstore.New(map[string]types.User{
+				"Alice": {Token: "123"},
+			})
+			var entries = map[string]types.Entry{
+				"1": {User: "Alice", Content: "Dear diary"},
+			}
+			entryStore := entrystore.New(entries)
+			var notebooks = map[string]types.Notebook{}
+			index := search.NewIndex(entryStore)
+
+			router := mux.NewRouter()
+			router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+			router.HandleFunc("/golang/entries/{entryID}", golang.UpdateEntryHandler(entryStore, &notebooks, index))
+			router.HandleFunc("/rego/entries/{entryID}", rego.UpdateEntryHandler(entryStore, &notebooks, index))
+			router.HandleFunc("/cue/entries/{entryID}", cue.UpdateEntryHandler(entryStore, &notebooks, index))
+			router.HandleFunc("/polar/entries/{entryID}", polar.UpdateEntryHandler(entryStore, &notebooks, index))
+			router.HandleFunc("/golang/search", golang.SearchHandler(entryStore, &notebooks, index))
+			router.HandleFunc("/rego/search", rego.SearchHandler(entryStore, &notebooks, index))
+			router.HandleFunc("/cue/search", cue.SearchHandler(entryStore, &notebooks, index))
+			router.HandleFunc("/polar/search", polar.SearchHandler(entryStore, &notebooks, index))
+
+			req, err := http.NewRequest("PUT", fmt.Sprintf("/%s/entries/1", language), bytes.NewReader([]byte(`{"content": "Dear notebook"}`)))
+			if err != nil {
+				t.Fatalf("failed to build request: %s", err)
+			}
+			req.Header.Set("Authorization", "Bearer 123")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+
+			expectedResponses := map[string]string{
+				"diary":    `{"count":0,"results":[]}`,
+				"notebook": `{"count":1,"results":[{"id":"1","snippet":"Dear notebook"}]}`,
+			}
+			for query, expectedResponse := range expectedResponses {
+				req, err := http.NewRequest("GET", fmt.Sprintf("/%s/search?q=%s", language, query), nil)
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				req.Header.Set("Authorization", "Bearer 123")
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				body, err := ioutil.ReadAll(w.Body)
+				if err != nil {
+					t.Fatalf("failed to read request: %s", err)
+				}
+				if got, want := string(body), expectedResponse; got != want {
+					t.Fatalf("unexpected body for %s: got %s want %s", query, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func TestServiceAccounts(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123", Roles: []string{"admin"}, Friends: []string{"Bob"}},
+		"Bob":   {Token: "456", Friends: []string{"Alice"}},
+	})
+	var serviceAccounts = map[string]types.ServiceAccount{
+		"backup": {Token: "sa_backup", Grants: []string{types.GrantReadAllEntries}},
+		"mailer": {Token: "sa_mailer"},
+		// shares a name with a user but none of their relationships
+		"Alice": {Token: "sa_alice"},
+	}
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary", Editors: []string{"Bob"}},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+	index := search.NewIndex(entryStore)
+	tokens := authn.NewTokens()
+
+	router := mux.NewRouter()
+	router.Use(
+		authn.Middleware(
+			authn.ServiceAccountToken{Accounts: &serviceAccounts},
+			authn.BearerToken{Users: users},
+		),
+		authn.Impersonation(map[string]authn.ImpersonationPolicy{
+			"golang": golang.ImpersonationPolicy(users),
+			"rego":   rego.ImpersonationPolicy(users),
+			"cue":    cue.ImpersonationPolicy(users),
+			"polar":  polar.ImpersonationPolicy(users),
+		}, nil),
+		authn.UserRoles(users),
+	)
+	router.HandleFunc("/golang/whoami", golang.WhoAmIHandler(users))
+	router.HandleFunc("/rego/whoami", rego.WhoAmIHandler(mustRegoStore(users)))
+	router.HandleFunc("/cue/whoami", cue.WhoAmIHandler(users))
+	router.HandleFunc("/polar/whoami", polar.WhoAmIHandler(users))
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+	router.HandleFunc("/golang/entries/{entryID}", golang.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+	router.HandleFunc("/rego/entries/{entryID}", rego.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+	router.HandleFunc("/cue/entries/{entryID}", cue.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+	router.HandleFunc("/polar/entries/{entryID}", polar.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+	router.HandleFunc("/golang/entries/{entryID}/revisions", golang.ListEntryRevisionsHandler(entryStore, &notebooks))
+	router.HandleFunc("/rego/entries/{entryID}/revisions", rego.ListEntryRevisionsHandler(entryStore, &notebooks))
+	router.HandleFunc("/cue/entries/{entryID}/revisions", cue.ListEntryRevisionsHandler(entryStore, &notebooks))
+	router.HandleFunc("/polar/entries/{entryID}/revisions", polar.ListEntryRevisionsHandler(entryStore, &notebooks))
+	router.HandleFunc("/golang/search", golang.SearchHandler(entryStore, &notebooks, index))
+	router.HandleFunc("/rego/search", rego.SearchHandler(entryStore, &notebooks, index))
+	router.HandleFunc("/cue/search", cue.SearchHandler(entryStore, &notebooks, index))
+	router.HandleFunc("/polar/search", polar.SearchHandler(entryStore, &notebooks, index))
+	router.HandleFunc("/golang/tokens", golang.CreateTokenHandler(tokens)).Methods("POST")
+	router.HandleFunc("/rego/tokens", rego.CreateTokenHandler(tokens)).Methods("POST")
+	router.HandleFunc("/cue/tokens", cue.CreateTokenHandler(tokens)).Methods("POST")
+	router.HandleFunc("/polar/tokens", polar.CreateTokenHandler(tokens)).Methods("POST")
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description      string
+		Method           string
+		Path             string
+		Body             string
+		Headers          map[string]string
+		ExpectedStatus   int
+		ExpectedResponse string
+	}{
+		{
+			Description:      "service account is identified by name",
+			Method:           "GET",
+			Path:             "/whoami",
+			Headers:          map[string]string{"Authorization": "Bearer sa_backup"},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "backup",
+		},
+		{
+			Description: "whoami reports the service account type",
+			Method:      "GET",
+			Path:        "/whoami",
+			Headers: map[string]string{
+				"Authorization": "Bearer sa_backup",
+				"Accept":        "application/json",
+			},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: `{"name":"backup","type":"service_account"}`,
+		},
+		{
+			Description: "whoami reports the user type",
+			Method:      "GET",
+			Path:        "/whoami",
+			Headers: map[string]string{
+				"Authorization": "Bearer 456",
+				"Accept":        "application/json",
+			},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: `{"name":"Bob","type":"user"}`,
+		},
+		{
+			Description:    "unknown service account token",
+			Method:         "GET",
+			Path:           "/whoami",
+			Headers:        map[string]string{"Authorization": "Bearer sa_unknown"},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:      "service account with the grant can read any entry",
+			Method:           "GET",
+			Path:             "/entries/1",
+			Headers:          map[string]string{"Authorization": "Bearer sa_backup"},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: "dear diary",
+		},
+		{
+			Description:      "service account with the grant finds any entry",
+			Method:           "GET",
+			Path:             "/search?q=diary",
+			Headers:          map[string]string{"Authorization": "Bearer sa_backup"},
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResponse: `{"count":1,"results":[{"id":"1","snippet":"dear diary"}]}`,
+		},
+		{
+			Description:    "service account without the grant cannot read entries",
+			Method:         "GET",
+			Path:           "/entries/1",
+			Headers:        map[string]string{"Authorization": "Bearer sa_mailer"},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "service account does not get the access of a user with the same name",
+			Method:         "GET",
+			Path:           "/entries/1",
+			Headers:        map[string]string{"Authorization": "Bearer sa_alice"},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "service account cannot update entries",
+			Method:         "PUT",
+			Path:           "/entries/1",
+			Body:           `{"content": "overwritten"}`,
+			Headers:        map[string]string{"Authorization": "Bearer sa_alice"},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "service account cannot see entry history",
+			Method:         "GET",
+			Path:           "/entries/1/revisions",
+			Headers:        map[string]string{"Authorization": "Bearer sa_backup"},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "service account cannot issue tokens",
+			Method:         "POST",
+			Path:           "/tokens",
+			Body:           `{"name": "backup"}`,
+			Headers:        map[string]string{"Authorization": "Bearer sa_alice"},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description: "service account cannot act as a user",
+			Method:      "GET",
+			Path:        "/whoami",
+			Headers: map[string]string{
+				"Authorization":   "Bearer sa_alice",
+				authn.ActAsHeader: "Bob",
+			},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				req, err := http.NewRequest(tc.Method, fmt.Sprintf("/%s%s", language, tc.Path), strings.NewReader(tc.Body))
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+
+				for k, v := range tc.Headers {
+					req.Header.Set(k, v)
+				}
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				body, err := ioutil.ReadAll(w.Body)
+				if err != nil {
+					t.Fatalf("failed to read request: %s", err)
+				}
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+
+				if got, want := string(body), tc.ExpectedResponse; got != want {
+					t.Fatalf("unexpected body: got %s want %s", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestServiceAccountFriendRequests(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123", Friends: []string{"Bob"}},
+		"Bob":     {Token: "456", Friends: []string{"Alice", "Charlie"}},
+		"Charlie": {Token: "789", Friends: []string{"Bob"}},
+	})
+	var serviceAccounts = map[string]types.ServiceAccount{
+		// even with every grant and a user's name, it's not in the graph
+		"Alice": {Token: "sa_alice", Grants: []string{types.GrantReadAllEntries}},
+	}
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(
+		authn.ServiceAccountToken{Accounts: &serviceAccounts},
+		authn.BearerToken{Users: users},
+	))
+	router.HandleFunc("/golang/friendrequests", golang.CreateFriendRequestHandler(users))
+	router.HandleFunc("/polar/friendrequests", polar.CreateFriendRequestHandler(users))
+	router.HandleFunc("/rego/friendrequests", rego.CreateFriendRequestHandler(mustRegoStore(users)))
+
+	languages := []string{"golang", "rego", "polar"}
+
+	for _, language := range languages {
+		t.Run(language, func(t *testing.T) {
+			req, err := http.NewRequest("POST", fmt.Sprintf("/%s/friendrequests", language), strings.NewReader(`{"friend": "Charlie"}`))
+			if err != nil {
+				t.Fatalf("failed to build request: %s", err)
+			}
+			req.Header.Set("Authorization", "Bearer sa_alice")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if got, want := w.Code, http.StatusUnauthorized; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/synthetic"
+)
+
+func TestSyntheticGraph(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Config      synthetic.Config
+
+		// ExpectedFriendships is the number of friendships in the graph, each
+		// is counted once though it's in the friends of both users
+		ExpectedFriendships int
+		// MinFriends is the fewest friends any user may have
+		MinFriends int
+		// SeedMatters is true when graphs with different seeds differ, too
+		// few users only have one way of being connected
+		SeedMatters bool
+	}{
+		{
+			Description:         "random with a single user",
+			Config:              synthetic.Config{Topology: synthetic.Random, Users: 1, Entries: 5},
+			ExpectedFriendships: 0,
+		},
+		{
+			Description:         "random with two users",
+			Config:              synthetic.Config{Topology: synthetic.Random, Users: 2, Entries: 5},
+			ExpectedFriendships: 1,
+			MinFriends:          1,
+		},
+		{
+			Description:         "random with fewer users than friends",
+			Config:              synthetic.Config{Topology: synthetic.Random, Users: 3, Entries: 5},
+			ExpectedFriendships: 3,
+			MinFriends:          2,
+		},
+		{
+			Description:         "random",
+			Config:              synthetic.Config{Topology: synthetic.Random, Users: 500, Entries: 200},
+			ExpectedFriendships: 2500,
+			SeedMatters:         true,
+		},
+		{
+			Description:         "random with few friends",
+			Config:              synthetic.Config{Topology: synthetic.Random, Users: 500, Entries: 200, Friends: 2},
+			ExpectedFriendships: 500,
+			SeedMatters:         true,
+		},
+		{
+			Description:         "small world with a single user",
+			Config:              synthetic.Config{Topology: synthetic.SmallWorld, Users: 1, Entries: 5},
+			ExpectedFriendships: 0,
+		},
+		{
+			Description:         "small world with two users",
+			Config:              synthetic.Config{Topology: synthetic.SmallWorld, Users: 2, Entries: 5},
+			ExpectedFriendships: 1,
+			MinFriends:          1,
+		},
+		{
+			Description:         "small world with fewer users than friends",
+			Config:              synthetic.Config{Topology: synthetic.SmallWorld, Users: 3, Entries: 5},
+			ExpectedFriendships: 3,
+			MinFriends:          2,
+		},
+		{
+			// rewiring moves the other end of a friendship, so users keep
+			// the half of their friends which come after them on the ring
+			Description:         "small world",
+			Config:              synthetic.Config{Topology: synthetic.SmallWorld, Users: 500, Entries: 200},
+			ExpectedFriendships: 2500,
+			MinFriends:          5,
+			SeedMatters:         true,
+		},
+		{
+			Description:         "small world with few friends",
+			Config:              synthetic.Config{Topology: synthetic.SmallWorld, Users: 500, Entries: 200, Friends: 2},
+			ExpectedFriendships: 500,
+			MinFriends:          1,
+			SeedMatters:         true,
+		},
+		{
+			Description:         "power law with a single user",
+			Config:              synthetic.Config{Topology: synthetic.PowerLaw, Users: 1, Entries: 5},
+			ExpectedFriendships: 0,
+		},
+		{
+			Description:         "power law with two users",
+			Config:              synthetic.Config{Topology: synthetic.PowerLaw, Users: 2, Entries: 5},
+			ExpectedFriendships: 1,
+			MinFriends:          1,
+		},
+		{
+			Description:         "power law with fewer users than friends",
+			Config:              synthetic.Config{Topology: synthetic.PowerLaw, Users: 3, Entries: 5},
+			ExpectedFriendships: 2,
+			MinFriends:          1,
+		},
+		{
+			// the first 6 users are all friends, each later user befriends 5
+			Description:         "power law",
+			Config:              synthetic.Config{Topology: synthetic.PowerLaw, Users: 500, Entries: 200},
+			ExpectedFriendships: 15 + 494*5,
+			MinFriends:          5,
+			SeedMatters:         true,
+		},
+		{
+			Description:         "without entries",
+			Config:              synthetic.Config{Topology: synthetic.PowerLaw, Users: 50},
+			ExpectedFriendships: 15 + 44*5,
+			MinFriends:          5,
+			SeedMatters:         true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			config := tc.Config
+			config.Seed = 42
+
+			graph, err := synthetic.Generate(config)
+			if err != nil {
+				t.Fatalf("failed to generate graph: %s", err)
+			}
+
+			// graphs with the same config are the same
+			again, err := synthetic.Generate(config)
+			if err != nil {
+				t.Fatalf("failed to generate graph: %s", err)
+			}
+			if !reflect.DeepEqual(graph, again) {
+				t.Fatalf("graphs with the same seed differ")
+			}
+
+			config.Seed++
+			other, err := synthetic.Generate(config)
+			if err != nil {
+				t.Fatalf("failed to generate graph: %s", err)
+			}
+			if got, want := !reflect.DeepEqual(graph.Users, other.Users), tc.SeedMatters; got != want {
+				t.Fatalf("unexpected difference between seeds: got %t want %t", got, want)
+			}
+
+			if len(graph.Users) != config.Users || len(graph.Names) != config.Users {
+				t.Fatalf("unexpected number of users: got %d users and %d names want %d", len(graph.Users), len(graph.Names), config.Users)
+			}
+			if len(graph.Entries) != config.Entries || len(graph.EntryIDs) != config.Entries {
+				t.Fatalf("unexpected number of entries: got %d entries and %d ids want %d", len(graph.Entries), len(graph.EntryIDs), config.Entries)
+			}
+
+			// names and ids are in the order they were created
+			for i, name := range graph.Names {
+				if name != synthetic.UserName(i) {
+					t.Fatalf("unexpected name %d: got %s want %s", i, name, synthetic.UserName(i))
+				}
+				if got, want := graph.Users[name].Token, synthetic.Token(name); got != want {
+					t.Fatalf("unexpected token of %s: got %s want %s", name, got, want)
+				}
+			}
+			for i, id := range graph.EntryIDs {
+				if _, ok := graph.Entries[id]; !ok || id != fmt.Sprint(i+1) {
+					t.Fatalf("unexpected entry id %d: %s", i, id)
+				}
+			}
+
+			// friendships go both ways, users aren't their own friends and
+			// are friends at most once
+			var friends int
+			for name, user := range graph.Users {
+				seen := map[string]bool{}
+				for _, friend := range user.Friends {
+					if friend == name {
+						t.Fatalf("%s is their own friend", name)
+					}
+					if seen[friend] {
+						t.Fatalf("%s is a friend of %s more than once", friend, name)
+					}
+					seen[friend] = true
+					if !contains(graph.Users[friend].Friends, name) {
+						t.Fatalf("%s is a friend of %s but not the other way", friend, name)
+					}
+				}
+				if len(user.Friends) < tc.MinFriends {
+					t.Fatalf("%s has too few friends: got %d want at least %d", name, len(user.Friends), tc.MinFriends)
+				}
+				friends += len(user.Friends)
+			}
+			if got, want := friends/2, tc.ExpectedFriendships; got != want {
+				t.Fatalf("unexpected number of friendships: got %d want %d", got, want)
+			}
+
+			// entries and notebooks are only shared with their owner's friends
+			for _, entry := range graph.Entries {
+				owner, ok := graph.Users[entry.User]
+				if !ok {
+					t.Fatalf("entry of unknown user %s", entry.User)
+				}
+				for _, reader := range entry.Readers {
+					if !contains(owner.Friends, reader) {
+						t.Fatalf("entry of %s is shared with %s who isn't their friend", entry.User, reader)
+					}
+				}
+				if entry.Notebook == "" {
+					continue
+				}
+				notebook, ok := graph.Notebooks[entry.Notebook]
+				if !ok || notebook.User != entry.User {
+					t.Fatalf("entry of %s is in notebook %s which isn't theirs", entry.User, entry.Notebook)
+				}
+				for _, reader := range notebook.Readers {
+					if !contains(owner.Friends, reader) {
+						t.Fatalf("notebook of %s is shared with %s who isn't their friend", entry.User, reader)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSyntheticGraphInvalidConfig(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Config      synthetic.Config
+	}{
+		{
+			Description: "no users",
+			Config:      synthetic.Config{Topology: synthetic.Random},
+		},
+		{
+			Description: "negative users",
+			Config:      synthetic.Config{Topology: synthetic.SmallWorld, Users: -1},
+		},
+		{
+			Description: "negative entries",
+			Config:      synthetic.Config{Topology: synthetic.PowerLaw, Users: 10, Entries: -1},
+		},
+		{
+			Description: "negative friends",
+			Config:      synthetic.Config{Topology: synthetic.Random, Users: 10, Friends: -1},
+		},
+		{
+			Description: "unknown topology",
+			Config:      synthetic.Config{Topology: "tree", Users: 10},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			if _, err := synthetic.Generate(tc.Config); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
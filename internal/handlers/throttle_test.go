@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+// failureLog is a FailureStore for tests which records every update, failures
+// are never forgotten
+type failureLog struct {
+	failures   map[string]authn.Failures
+	increments []string
+}
+
+func (s *failureLog) Get(key string, now time.Time) (authn.Failures, bool) {
+	failures, ok := s.failures[key]
+	return failures, ok
+}
+
+func (s *failureLog) Increment(key string, now time.Time, ttl func(count int) time.Duration) (before, after authn.Failures) {
+	before = s.failures[key]
+	after = authn.Failures{Count: before.Count + 1, LastFailure: now}
+	s.failures[key] = after
+	s.increments = append(s.increments, fmt.Sprintf("%s=%d", key, after.Count))
+	return before, after
+}
+
+func (s *failureLog) Delete(key string) {
+	delete(s.failures, key)
+}
+
+func newThrottledRouter(users *userstore.Store, throttle *authn.Throttle) *mux.Router {
+	tokens := authn.NewTokens()
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(authn.Throttled{
+		Throttle: throttle,
+		Authenticators: []authn.Authenticator{
+			authn.BearerToken{Users: users},
+			authn.Basic{Users: users},
+		},
+	}))
+	router.HandleFunc("/golang/whoami", golang.WhoAmIHandler(users))
+	router.HandleFunc("/rego/whoami", rego.WhoAmIHandler(mustRegoStore(users)))
+	router.HandleFunc("/cue/whoami", cue.WhoAmIHandler(users))
+	router.HandleFunc("/polar/whoami", polar.WhoAmIHandler(users))
+	router.HandleFunc("/golang/tokens", golang.CreateTokenHandler(tokens)).Methods("POST")
+	router.HandleFunc("/rego/tokens", rego.CreateTokenHandler(tokens)).Methods("POST")
+	router.HandleFunc("/cue/tokens", cue.CreateTokenHandler(tokens)).Methods("POST")
+	router.HandleFunc("/polar/tokens", polar.CreateTokenHandler(tokens)).Methods("POST")
+
+	return router
+}
+
+// throttledRequest makes a request from the remote address with the
+// credentials in the Authorization header
+func throttledRequest(t *testing.T, router http.Handler, method, path, remoteAddr, authorization, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to build request: %s", err)
+	}
+	req.RemoteAddr = remoteAddr
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// basicAuth encodes the credentials for a Basic Authorization header
+func basicAuth(userName, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(userName + ":" + password))
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+		"Bob":   {Token: "456"},
+	})
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	for _, language := range languages {
+		t.Run(language, func(t *testing.T) {
+			now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+			throttle := authn.NewThrottle()
+			throttle.Now = func() time.Time { return now }
+			router := newThrottledRouter(users, throttle)
+			path := fmt.Sprintf("/%s/whoami", language)
+
+			steps := []struct {
+				Description        string
+				Advance            time.Duration
+				RemoteAddr         string
+				Authorization      string
+				ExpectedStatus     int
+				ExpectedRetryAfter string
+			}{
+				{
+					Description:    "a wrong token is rejected",
+					RemoteAddr:     "192.0.2.1:1234",
+					Authorization:  "Bearer guess",
+					ExpectedStatus: http.StatusUnauthorized,
+				},
+				{
+					Description:        "the client must wait before trying again",
+					RemoteAddr:         "192.0.2.1:1234",
+					Authorization:      "Bearer guess",
+					ExpectedStatus:     http.StatusTooManyRequests,
+					ExpectedRetryAfter: "2",
+				},
+				{
+					Description:    "the right token is accepted while the client waits",
+					RemoteAddr:     "192.0.2.1:1234",
+					Authorization:  "Bearer 123",
+					ExpectedStatus: http.StatusOK,
+				},
+				{
+					Description:    "requests without credentials are unaffected",
+					RemoteAddr:     "192.0.2.1:1234",
+					ExpectedStatus: http.StatusUnauthorized,
+				},
+				{
+					Description:    "other clients are unaffected",
+					RemoteAddr:     "192.0.2.2:1234",
+					Authorization:  "Bearer guess",
+					ExpectedStatus: http.StatusUnauthorized,
+				},
+				{
+					Description:        "the wait doubles after each failure",
+					Advance:            time.Second,
+					RemoteAddr:         "192.0.2.1:4321",
+					Authorization:      "Bearer guess",
+					ExpectedStatus:     http.StatusTooManyRequests,
+					ExpectedRetryAfter: "4",
+				},
+				{
+					Description:    "the client can try again after the wait",
+					Advance:        4 * time.Second,
+					RemoteAddr:     "192.0.2.1:1234",
+					Authorization:  "Bearer guess",
+					ExpectedStatus: http.StatusUnauthorized,
+				},
+				{
+					Description:    "a wrong password for a user is rejected",
+					RemoteAddr:     "192.0.2.3:1234",
+					Authorization:  "Basic " + basicAuth("Bob", "guess"),
+					ExpectedStatus: http.StatusUnauthorized,
+				},
+				{
+					Description:        "the claimed user must wait, whichever client is used",
+					RemoteAddr:         "192.0.2.4:1234",
+					Authorization:      "Basic " + basicAuth("Bob", "guess"),
+					ExpectedStatus:     http.StatusTooManyRequests,
+					ExpectedRetryAfter: "2",
+				},
+				{
+					Description:    "the user's password is accepted while they wait",
+					RemoteAddr:     "192.0.2.4:1234",
+					Authorization:  "Basic " + basicAuth("Bob", "456"),
+					ExpectedStatus: http.StatusOK,
+				},
+				{
+					Description:    "other users are unaffected",
+					RemoteAddr:     "192.0.2.5:1234",
+					Authorization:  "Basic " + basicAuth("Alice", "guess"),
+					ExpectedStatus: http.StatusUnauthorized,
+				},
+			}
+
+			for _, step := range steps {
+				now = now.Add(step.Advance)
+
+				w := throttledRequest(t, router, "GET", path, step.RemoteAddr, step.Authorization, "")
+
+				if got, want := w.Code, step.ExpectedStatus; got != want {
+					t.Fatalf("%s: unexpected response code: got %d want %d", step.Description, got, want)
+				}
+				if got, want := w.Header().Get("Retry-After"), step.ExpectedRetryAfter; got != want {
+					t.Fatalf("%s: unexpected Retry-After: got %q want %q", step.Description, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestThrottleLockout(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+	})
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	for _, language := range languages {
+		t.Run(language, func(t *testing.T) {
+			now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+			store := &failureLog{failures: map[string]authn.Failures{}}
+			throttle := &authn.Throttle{
+				Store:           store,
+				LockoutFailures: 3,
+				LockoutDuration: 10 * time.Minute,
+				Now:             func() time.Time { return now },
+			}
+			router := newThrottledRouter(users, throttle)
+			path := fmt.Sprintf("/%s/whoami", language)
+
+			// fail until locked out, waiting out the backoff each time
+			for i := 0; i < 3; i++ {
+				w := throttledRequest(t, router, "GET", path, "192.0.2.1:1234", "Basic "+basicAuth("Alice", "guess"), "")
+				if got, want := w.Code, http.StatusUnauthorized; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+				now = now.Add(time.Minute)
+			}
+
+			if got, want := strings.Join(store.increments, ","), "ip:192.0.2.1=1,user:Alice=1,ip:192.0.2.1=2,user:Alice=2,ip:192.0.2.1=3,user:Alice=3"; got != want {
+				t.Fatalf("unexpected failures: got %s want %s", got, want)
+			}
+
+			// further failures are refused until the lockout is over, whichever
+			// client is used, and extend it
+			w := throttledRequest(t, router, "GET", path, "192.0.2.2:1234", "Basic "+basicAuth("Alice", "guess"), "")
+			if got, want := w.Code, http.StatusTooManyRequests; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+			if got, want := w.Header().Get("Retry-After"), "600"; got != want {
+				t.Fatalf("unexpected Retry-After: got %q want %q", got, want)
+			}
+
+			// the right password is still accepted
+			w = throttledRequest(t, router, "GET", path, "192.0.2.2:1234", "Basic "+basicAuth("Alice", "123"), "")
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+
+			// the user proved who they are so their counter is reset, the
+			// client that failed is still locked out
+			if _, ok := store.failures["user:Alice"]; ok {
+				t.Fatalf("expected the user's failures to be reset")
+			}
+			if got, want := store.failures["ip:192.0.2.1"].Count, 3; got != want {
+				t.Fatalf("unexpected client failures: got %d want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestThrottleRisk(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+	})
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description    string
+		Failures       int
+		ExpectedStatus int
+	}{
+		{
+			Description:    "tokens are issued without recent failures",
+			ExpectedStatus: http.StatusCreated,
+		},
+		{
+			Description:    "tokens are issued after a few failures",
+			Failures:       2,
+			ExpectedStatus: http.StatusCreated,
+		},
+		{
+			Description:    "tokens are not issued when the risk is elevated",
+			Failures:       3,
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+				store := authn.NewMemoryFailureStore()
+				for i := 0; i < tc.Failures; i++ {
+					store.Increment("user:Alice", now.Add(-5*time.Minute), func(int) time.Duration { return time.Hour })
+				}
+				throttle := &authn.Throttle{Store: store, Now: func() time.Time { return now }}
+				router := newThrottledRouter(users, throttle)
+
+				w := throttledRequest(t, router, "POST", fmt.Sprintf("/%s/tokens", language), "192.0.2.1:1234", "Basic "+basicAuth("Alice", "123"), `{"name": "laptop"}`)
+
+				body, err := ioutil.ReadAll(w.Body)
+				if err != nil {
+					t.Fatalf("failed to read request: %s", err)
+				}
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d: %s", got, want, body)
+				}
+			})
+		}
+	}
+}
+
+func TestThrottleForgetsFailures(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := authn.NewMemoryFailureStore()
+	throttle := &authn.Throttle{
+		Store:         store,
+		FailureWindow: 10 * time.Minute,
+		Now:           func() time.Time { return now },
+	}
+
+	// each guessed user name is only tried once, so none of them are locked
+	// out but they're all counted
+	for i := 0; i < 100; i++ {
+		throttle.Fail(fmt.Sprintf("user:guess-%d", i))
+	}
+	if got, want := store.Len(), 100; got != want {
+		t.Fatalf("unexpected number of keys: got %d want %d", got, want)
+	}
+
+	// expired failures aren't used, and are pruned by later failures
+	now = now.Add(10 * time.Minute)
+	if got, want := throttle.Risk("user:guess-0"), types.RiskLow; got != want {
+		t.Fatalf("unexpected risk: got %s want %s", got, want)
+	}
+	throttle.Fail("user:guess-100")
+	if got, want := store.Len(), 1; got != want {
+		t.Fatalf("unexpected number of keys: got %d want %d", got, want)
+	}
+}
+
+func TestThrottleConcurrentFailures(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := authn.NewMemoryFailureStore()
+	throttle := &authn.Throttle{Store: store, Now: func() time.Time { return now }}
+
+	const attempts = 50
+
+	// every failure is counted however many are made at once, and only the
+	// first isn't made while waiting
+	waits := make(chan time.Duration, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			waits <- throttle.Fail("ip:192.0.2.1")
+		}()
+	}
+	wg.Wait()
+	close(waits)
+
+	failures, _ := store.Get("ip:192.0.2.1", now)
+	if got, want := failures.Count, attempts; got != want {
+		t.Fatalf("unexpected failures: got %d want %d", got, want)
+	}
+
+	notWaiting := 0
+	for wait := range waits {
+		if wait == 0 {
+			notWaiting++
+		}
+	}
+	if got, want := notWaiting, 1; got != want {
+		t.Fatalf("unexpected attempts made without waiting: got %d want %d", got, want)
+	}
+}
@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+func newTokensRouter(users *userstore.Store, entries *entrystore.Store, tokens *authn.Tokens) *mux.Router {
+	var notebooks = map[string]types.Notebook{}
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(
+		authn.IssuedToken{Tokens: tokens},
+		authn.BearerToken{Users: users},
+	))
+	router.HandleFunc("/golang/whoami", golang.WhoAmIHandler(users))
+	router.HandleFunc("/rego/whoami", rego.WhoAmIHandler(mustRegoStore(users)))
+	router.HandleFunc("/cue/whoami", cue.WhoAmIHandler(users))
+	router.HandleFunc("/polar/whoami", polar.WhoAmIHandler(users))
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entries, &notebooks))
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entries, &notebooks))
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entries, &notebooks))
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entries, &notebooks))
+	router.HandleFunc("/golang/tokens", golang.CreateTokenHandler(tokens)).Methods("POST")
+	router.HandleFunc("/rego/tokens", rego.CreateTokenHandler(tokens)).Methods("POST")
+	router.HandleFunc("/cue/tokens", cue.CreateTokenHandler(tokens)).Methods("POST")
+	router.HandleFunc("/polar/tokens", polar.CreateTokenHandler(tokens)).Methods("POST")
+	router.HandleFunc("/golang/tokens", golang.ListTokensHandler(tokens)).Methods("GET")
+	router.HandleFunc("/rego/tokens", rego.ListTokensHandler(tokens)).Methods("GET")
+	router.HandleFunc("/cue/tokens", cue.ListTokensHandler(tokens)).Methods("GET")
+	router.HandleFunc("/polar/tokens", polar.ListTokensHandler(tokens)).Methods("GET")
+	router.HandleFunc("/golang/tokens/{tokenID}", golang.RevokeTokenHandler(tokens)).Methods("DELETE")
+	router.HandleFunc("/rego/tokens/{tokenID}", rego.RevokeTokenHandler(tokens)).Methods("DELETE")
+	router.HandleFunc("/cue/tokens/{tokenID}", cue.RevokeTokenHandler(tokens)).Methods("DELETE")
+	router.HandleFunc("/polar/tokens/{tokenID}", polar.RevokeTokenHandler(tokens)).Methods("DELETE")
+
+	return router
+}
+
+type tokenResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	User       string     `json:"user"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Token      string     `json:"token"`
+}
+
+func TestTokenLifecycle(t *testing.T) {
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	for _, language := range languages {
+		t.Run(language, func(t *testing.T) {
+			users := userstore.New(map[string]types.User{
+				"Alice": {Token: "123"},
+			})
+			var entries = map[string]types.Entry{
+				"1": {User: "Alice", Content: "Dear diary..."},
+			}
+			entryStore := entrystore.New(entries)
+			tokens := authn.NewTokens()
+			router := newTokensRouter(users, entryStore, tokens)
+
+			do := func(method, path, authorization string, body []byte) *httptest.ResponseRecorder {
+				req, err := http.NewRequest(method, path, bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				req.Header.Set("Authorization", authorization)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			// issue a token using the static token
+			w := do("POST", fmt.Sprintf("/%s/tokens", language), "Bearer 123", []byte(`{"name": "laptop", "expires_in": 3600}`))
+			if got, want := w.Code, http.StatusCreated; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+			var issued tokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &issued); err != nil {
+				t.Fatalf("failed to parse issued token: %s", err)
+			}
+			if issued.Name != "laptop" || issued.User != "Alice" || issued.Token == "" {
+				t.Fatalf("unexpected issued token: %+v", issued)
+			}
+			if issued.LastUsedAt != nil {
+				t.Fatalf("new token should not have been used: %+v", issued)
+			}
+			if got, want := issued.ExpiresAt.Sub(time.Now()).Round(time.Minute), time.Hour; got != want {
+				t.Fatalf("unexpected lifetime: got %s want %s", got, want)
+			}
+
+			// the issued token works for every engine
+			for _, l := range languages {
+				w = do("GET", fmt.Sprintf("/%s/whoami", l), "Bearer "+issued.Token, nil)
+				if got, want := w.Code, http.StatusOK; got != want {
+					t.Fatalf("unexpected whoami response code for %s: got %d want %d", l, got, want)
+				}
+				if got, want := w.Body.String(), "Alice"; got != want {
+					t.Fatalf("unexpected whoami body for %s: got %s want %s", l, got, want)
+				}
+			}
+
+			// the list includes when the token was last used, but not the
+			// secret
+			w = do("GET", fmt.Sprintf("/%s/tokens", language), "Bearer "+issued.Token, nil)
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+			var listed []tokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+				t.Fatalf("failed to parse tokens: %s", err)
+			}
+			if len(listed) != 1 || listed[0].ID != issued.ID || listed[0].Token != "" || listed[0].LastUsedAt == nil {
+				t.Fatalf("unexpected tokens: %s", w.Body.String())
+			}
+
+			// a token can revoke itself
+			w = do("DELETE", fmt.Sprintf("/%s/tokens/%s", language, issued.ID), "Bearer "+issued.Token, nil)
+			if got, want := w.Code, http.StatusNoContent; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+
+			// revocation applies straight away to every engine
+			for _, l := range languages {
+				for _, path := range []string{"/whoami", "/entries/1"} {
+					w = do("GET", fmt.Sprintf("/%s%s", l, path), "Bearer "+issued.Token, nil)
+					if got, want := w.Code, http.StatusUnauthorized; got != want {
+						t.Fatalf("unexpected response code for %s%s after revocation: got %d want %d", l, path, got, want)
+					}
+				}
+			}
+
+			// the static token is unaffected
+			w = do("GET", fmt.Sprintf("/%s/entries/1", language), "Bearer 123", nil)
+			if got, want := w.Code, http.StatusOK; got != want {
+				t.Fatalf("unexpected response code: got %d want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestTokenManagement(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+		"Bob":   {Token: "456"},
+	})
+	var entries = map[string]types.Entry{}
+	entryStore := entrystore.New(entries)
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description string
+		// Token is a static token, IssuedToken is the name of an issued one
+		Token          string
+		IssuedToken    string
+		Method         string
+		Path           string
+		Body           string
+		ExpectedStatus int
+		ExpectedNames  []string
+	}{
+		{
+			Description:    "users only list their own tokens",
+			Token:          "456",
+			Method:         "GET",
+			Path:           "/tokens",
+			ExpectedStatus: http.StatusOK,
+			ExpectedNames:  []string{"phone"},
+		},
+		{
+			Description:    "expired tokens are still listed",
+			Token:          "123",
+			Method:         "GET",
+			Path:           "/tokens",
+			ExpectedStatus: http.StatusOK,
+			ExpectedNames:  []string{"laptop", "old"},
+		},
+		{
+			Description:    "users cannot revoke another user's token",
+			Token:          "456",
+			Method:         "DELETE",
+			Path:           "/tokens/{laptop}",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "users can revoke their own token",
+			IssuedToken:    "laptop",
+			Method:         "DELETE",
+			Path:           "/tokens/{laptop}",
+			ExpectedStatus: http.StatusNoContent,
+		},
+		{
+			Description:    "revoking an unknown token",
+			Token:          "123",
+			Method:         "DELETE",
+			Path:           "/tokens/unknown",
+			ExpectedStatus: http.StatusNotFound,
+		},
+		{
+			Description:    "issuing a token without a name",
+			Token:          "123",
+			Method:         "POST",
+			Path:           "/tokens",
+			Body:           `{"expires_in": 60}`,
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Description:    "issuing a token with a negative lifetime",
+			Token:          "123",
+			Method:         "POST",
+			Path:           "/tokens",
+			Body:           `{"name": "laptop", "expires_in": -60}`,
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Description:    "issuing a token with a lifetime longer than the maximum",
+			Token:          "123",
+			Method:         "POST",
+			Path:           "/tokens",
+			Body:           `{"name": "laptop", "expires_in": 31536001}`,
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Description:    "issuing a token with a lifetime which would overflow",
+			Token:          "123",
+			Method:         "POST",
+			Path:           "/tokens",
+			Body:           `{"name": "laptop", "expires_in": 9223372036854775807}`,
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Description:    "issuing a token without credentials",
+			Method:         "POST",
+			Path:           "/tokens",
+			Body:           `{"name": "laptop"}`,
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "using an expired token",
+			IssuedToken:    "old",
+			Method:         "GET",
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "using an unknown issued token",
+			Token:          authn.TokenPrefix + "unknown",
+			Method:         "GET",
+			Path:           "/whoami",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				tokens := authn.NewTokens()
+				issued := map[string]types.Token{}
+				secrets := map[string]string{}
+				for _, issue := range []struct {
+					User     string
+					Name     string
+					Lifetime time.Duration
+				}{
+					{"Alice", "laptop", time.Hour},
+					{"Bob", "phone", time.Hour},
+					{"Alice", "old", -time.Minute},
+				} {
+					token, secret, err := tokens.Issue(issue.User, issue.Name, types.AllScopes, issue.Lifetime)
+					if err != nil {
+						t.Fatalf("failed to issue token: %s", err)
+					}
+					issued[issue.Name] = token
+					secrets[issue.Name] = secret
+				}
+
+				router := newTokensRouter(users, entryStore, tokens)
+
+				path := tc.Path
+				for name, token := range issued {
+					path = strings.Replace(path, "{"+name+"}", token.ID, 1)
+				}
+
+				req, err := http.NewRequest(tc.Method, fmt.Sprintf("/%s%s", language, path), bytes.NewReader([]byte(tc.Body)))
+				if err != nil {
+					t.Fatalf("failed to build request: %s", err)
+				}
+				if tc.Token != "" {
+					req.Header.Set("Authorization", "Bearer "+tc.Token)
+				}
+				if tc.IssuedToken != "" {
+					req.Header.Set("Authorization", "Bearer "+secrets[tc.IssuedToken])
+				}
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				if got, want := w.Code, tc.ExpectedStatus; got != want {
+					t.Fatalf("unexpected response code: got %d want %d", got, want)
+				}
+
+				if tc.ExpectedNames == nil {
+					return
+				}
+				var listed []tokenResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+					t.Fatalf("failed to parse tokens: %s", err)
+				}
+				var names []string
+				for _, token := range listed {
+					if token.Token != "" {
+						t.Fatalf("secret included in list: %s", w.Body.String())
+					}
+					names = append(names, token.Name)
+				}
+				// tokens issued in the same instant can be listed in any order
+				sort.Strings(names)
+				if got, want := strings.Join(names, ","), strings.Join(tc.ExpectedNames, ","); got != want {
+					t.Fatalf("unexpected tokens: got %s want %s", got, want)
+				}
+			})
+		}
+	}
+}
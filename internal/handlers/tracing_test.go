@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
+	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/tracing"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+	"github.com/gorilla/mux"
+)
+
+// spanRecorder is an exporter keeping the spans in memory
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (r *spanRecorder) Export(span tracing.SpanData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+	return nil
+}
+
+func (r *spanRecorder) Reset() []tracing.SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := r.spans
+	r.spans = nil
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice":   {Token: "123", Friends: []string{"Bob"}},
+		"Bob":     {Token: "456", Friends: []string{"Alice", "Charlie"}},
+		"Charlie": {Token: "789", Friends: []string{"Bob"}},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	recorder := &spanRecorder{}
+
+	router := mux.NewRouter()
+	router.Use(
+		tracing.Middleware(tracing.NewTracer(recorder)),
+		decisions.Middleware(decisions.NewLog()),
+		tracing.Stage("authn", authn.Middleware(authn.BearerToken{Users: users})),
+		tracing.Stage("roles", authn.UserRoles(users)),
+	)
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks))
+	router.HandleFunc("/polar/friend_requests", polar.CreateFriendRequestHandler(users)).Methods("POST")
+
+	languages := []string{"golang", "rego", "cue", "polar"}
+
+	testCases := []struct {
+		Description   string
+		Token         string
+		ExpectedSpans map[string]string
+	}{
+		{
+			Description: "permitted read",
+			Token:       "123",
+			ExpectedSpans: map[string]string{
+				"golang": "GET /golang/entries/{entryID},authn,data.load,policy.evaluate,response,roles",
+				"rego":   "GET /rego/entries/{entryID},authn,data.load,policy.evaluate,response,roles",
+				"cue":    "GET /cue/entries/{entryID},authn,data.load,policy.evaluate,response,roles",
+				"polar":  "GET /polar/entries/{entryID},authn,data.load,policy.evaluate,response,roles",
+			},
+		},
+		{
+			Description: "unauthenticated",
+			Token:       "000",
+			ExpectedSpans: map[string]string{
+				"golang": "GET /golang/entries/{entryID},authn,response",
+				"rego":   "GET /rego/entries/{entryID},authn,response",
+				"cue":    "GET /cue/entries/{entryID},authn,response",
+				"polar":  "GET /polar/entries/{entryID},authn,response",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, language := range languages {
+			t.Run(fmt.Sprintf("%s %s", tc.Description, language), func(t *testing.T) {
+				recorder.Reset()
+
+				req := httptest.NewRequest("GET", fmt.Sprintf("/%s/entries/1", language), nil)
+				req.Header.Set("Authorization", "Bearer "+tc.Token)
+				router.ServeHTTP(httptest.NewRecorder(), req)
+
+				spans := recorder.Reset()
+				if got := spanNames(spans); got != tc.ExpectedSpans[language] {
+					t.Fatalf("unexpected spans: got %s want %s", got, tc.ExpectedSpans[language])
+				}
+
+				// everything is in the trace of the request's span
+				root := spans[len(spans)-1]
+				for _, span := range spans[:len(spans)-1] {
+					if span.TraceID != root.TraceID {
+						t.Fatalf("span %s isn't in the request's trace", span.Name)
+					}
+					if span.ParentSpanID != root.SpanID {
+						t.Fatalf("span %s isn't a child of the request's span", span.Name)
+					}
+				}
+			})
+		}
+	}
+
+	t.Run("polar doesn't rebuild its knowledge base per request", func(t *testing.T) {
+		recorder.Reset()
+
+		req := httptest.NewRequest("POST", "/polar/friend_requests", bytes.NewBufferString(`{"friend": "Charlie"}`))
+		req.Header.Set("Authorization", "Bearer 123")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unexpected response code: got %d want %d", rr.Code, http.StatusOK)
+		}
+
+		for _, span := range recorder.Reset() {
+			if span.Name == "policy.load" {
+				t.Fatalf("unexpected policy.load span: %v", span.Attributes)
+			}
+		}
+	})
+}
+
+func TestTraceparent(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	var exported bytes.Buffer
+	router := mux.NewRouter()
+	router.Use(
+		tracing.Middleware(tracing.NewTracer(tracing.NewJSONExporter(&exported))),
+		tracing.Stage("authn", authn.Middleware(authn.BearerToken{Users: users})),
+	)
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks))
+
+	testCases := []struct {
+		Description    string
+		Traceparent    string
+		ContinuesTrace bool
+	}{
+		{
+			Description:    "valid traceparent is continued",
+			Traceparent:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			ContinuesTrace: true,
+		},
+		{
+			Description:    "future version is continued",
+			Traceparent:    "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			ContinuesTrace: true,
+		},
+		{
+			Description: "missing traceparent starts a new trace",
+		},
+		{
+			Description: "all zero trace id starts a new trace",
+			Traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		},
+		{
+			Description: "uppercase hex starts a new trace",
+			Traceparent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01",
+		},
+		{
+			Description: "invalid version starts a new trace",
+			Traceparent: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			exported.Reset()
+
+			req := httptest.NewRequest("GET", "/golang/entries/1", nil)
+			req.Header.Set("Authorization", "Bearer 123")
+			if tc.Traceparent != "" {
+				req.Header.Set("traceparent", tc.Traceparent)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			var spans []tracing.SpanData
+			for _, line := range strings.Split(strings.TrimSpace(exported.String()), "\n") {
+				var span tracing.SpanData
+				if err := json.Unmarshal([]byte(line), &span); err != nil {
+					t.Fatalf("failed to parse span line %q: %s", line, err)
+				}
+				spans = append(spans, span)
+			}
+			root := spans[len(spans)-1]
+
+			if tc.ContinuesTrace {
+				if root.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || root.ParentSpanID != "00f067aa0ba902b7" {
+					t.Fatalf("trace wasn't continued: %+v", root)
+				}
+			} else {
+				if root.TraceID == "4bf92f3577b34da6a3ce929d0e0e4736" || root.ParentSpanID != "" {
+					t.Fatalf("expected a new trace: %+v", root)
+				}
+				if len(root.TraceID) != 32 {
+					t.Fatalf("invalid trace id: %s", root.TraceID)
+				}
+			}
+
+			expected := fmt.Sprintf("00-%s-%s-01", root.TraceID, root.SpanID)
+			if got := rr.Header().Get("traceparent"); got != expected {
+				t.Fatalf("unexpected traceparent response header: got %s want %s", got, expected)
+			}
+			if root.Attributes["http.status_code"] != "200" || root.Attributes["http.route"] != "/golang/entries/{entryID}" {
+				t.Fatalf("unexpected attributes: %v", root.Attributes)
+			}
+		})
+	}
+}
+
+func TestTraceparentNotSampled(t *testing.T) {
+	users := userstore.New(map[string]types.User{
+		"Alice": {Token: "123"},
+	})
+	var entries = map[string]types.Entry{
+		"1": {User: "Alice", Content: "dear diary"},
+	}
+	entryStore := entrystore.New(entries)
+	var notebooks = map[string]types.Notebook{}
+
+	recorder := &spanRecorder{}
+	router := mux.NewRouter()
+	router.Use(
+		tracing.Middleware(tracing.NewTracer(recorder)),
+		tracing.Stage("authn", authn.Middleware(authn.BearerToken{Users: users})),
+	)
+	router.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks))
+
+	req := httptest.NewRequest("GET", "/golang/entries/1", nil)
+	req.Header.Set("Authorization", "Bearer 123")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected response code: got %d want %d", got, want)
+	}
+
+	// the caller decided not to sample the trace, so nothing is exported
+	if spans := recorder.Reset(); len(spans) != 0 {
+		t.Fatalf("unexpected spans: %s", spanNames(spans))
+	}
+
+	// but the trace is still propagated, without the sampled flag
+	traceID, _, flags, ok := tracing.ParseTraceparent(rr.Header().Get("traceparent"))
+	if !ok || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || flags != "00" {
+		t.Fatalf("unexpected traceparent response header: %s", rr.Header().Get("traceparent"))
+	}
+}
+
+// spanNames returns the sorted names of the spans, joined by commas
+func spanNames(spans []tracing.SpanData) string {
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
@@ -7,24 +7,27 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
 	"github.com/gorilla/mux"
 )
 
 func TestWhoAmIEndpoints(t *testing.T) {
-	var users = map[string]types.User{
+	users := userstore.New(map[string]types.User{
 		"Alice": {Token: "123"},
 		"Bob":   {Token: "456"},
-	}
+	})
 	router := mux.NewRouter()
-	router.HandleFunc("/golang/whoami", golang.WhoAmIHandler(&users))
-	router.HandleFunc("/rego/whoami", rego.WhoAmIHandler(&users))
-	router.HandleFunc("/cue/whoami", cue.WhoAmIHandler(&users))
-	router.HandleFunc("/polar/whoami", polar.WhoAmIHandler(&users))
+	router.Use(authn.Middleware(authn.BearerToken{Users: users}))
+	router.HandleFunc("/golang/whoami", golang.WhoAmIHandler(users))
+	router.HandleFunc("/rego/whoami", rego.WhoAmIHandler(mustRegoStore(users)))
+	router.HandleFunc("/cue/whoami", cue.WhoAmIHandler(users))
+	router.HandleFunc("/polar/whoami", polar.WhoAmIHandler(users))
 
 	languages := []string{"golang", "rego", "cue", "polar"}
 
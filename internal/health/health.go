@@ -0,0 +1,192 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/requestid"
+)
+
+// States of a policy
+const (
+	StateCompiled = "compiled"
+	StateFailed   = "failed"
+)
+
+// Policy is the compile status of one of an engine's policies
+type Policy struct {
+	State string `json:"state"`
+
+	// LastCompiledAt is when the policy was last compiled, or failed to be
+	LastCompiledAt time.Time `json:"last_compiled_at"`
+
+	// LastError is from the latest compile which failed, it's kept once the
+	// policy compiles again so that flapping policies can be seen
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Engine is the status of an engine and its policies
+type Engine struct {
+	// Enabled engines must be loaded for the server to be ready
+	Enabled bool `json:"enabled"`
+
+	// Loaded is set once all of the engine's policies have been compiled,
+	// successfully or not
+	Loaded bool `json:"loaded"`
+
+	// Ready is true when the engine is loaded and none of its policies are
+	// failing
+	Ready bool `json:"ready"`
+
+	Policies map[string]Policy `json:"policies"`
+}
+
+// Report is the status of every engine, it's the body of /healthz and /readyz
+type Report struct {
+	Ready   bool              `json:"ready"`
+	Engines map[string]Engine `json:"engines"`
+}
+
+// Checker keeps the compile status of each engine's policies
+type Checker struct {
+	mu      sync.Mutex
+	engines map[string]*Engine
+
+	// Now is used for compile times, time.Now is used if not set
+	Now func() time.Time
+}
+
+// NewChecker creates a Checker with no engines
+func NewChecker() *Checker {
+	return &Checker{engines: make(map[string]*Engine)}
+}
+
+// Default is the checker the engines report their policies to
+var Default = NewChecker()
+
+// ObservePolicy records the result of compiling one of an engine's policies
+// in the Default checker
+func ObservePolicy(engine, policy string, err error) {
+	Default.ObservePolicy(engine, policy, err)
+}
+
+func (c *Checker) engine(name string) *Engine {
+	e, ok := c.engines[name]
+	if !ok {
+		e = &Engine{Policies: make(map[string]Policy)}
+		c.engines[name] = e
+	}
+	return e
+}
+
+// Enable marks the engines as ones which must be loaded before the server is
+// ready
+func (c *Checker) Enable(engines ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, name := range engines {
+		c.engine(name).Enabled = true
+	}
+}
+
+// Loaded marks the engine as having compiled all of its policies
+func (c *Checker) Loaded(engine string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.engine(engine).Loaded = true
+}
+
+// ObservePolicy records the result of compiling one of the engine's policies,
+// err is nil if it compiled
+func (c *Checker) ObservePolicy(engine, policy string, err error) {
+	now := time.Now
+	if c.Now != nil {
+		now = c.Now
+	}
+	at := now().UTC()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.engine(engine)
+	status := e.Policies[policy]
+	status.LastCompiledAt = at
+	if err != nil {
+		status.State = StateFailed
+		status.LastError = err.Error()
+		status.LastErrorAt = &at
+	} else {
+		status.State = StateCompiled
+	}
+	e.Policies[policy] = status
+}
+
+// Report returns the status of every engine. The server is ready once every
+// enabled engine is loaded without failing policies.
+func (c *Checker) Report() Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report := Report{Ready: true, Engines: make(map[string]Engine)}
+	for name, e := range c.engines {
+		engine := Engine{
+			Enabled:  e.Enabled,
+			Loaded:   e.Loaded,
+			Ready:    e.Loaded,
+			Policies: make(map[string]Policy),
+		}
+		for policy, status := range e.Policies {
+			engine.Policies[policy] = status
+			if status.State == StateFailed {
+				engine.Ready = false
+			}
+		}
+		if engine.Enabled && !engine.Ready {
+			report.Ready = false
+		}
+		report.Engines[name] = engine
+	}
+	return report
+}
+
+// LivenessHandler serves /healthz, it responds OK while the server is able to
+// respond at all, with the status of each engine for information
+func LivenessHandler(c *Checker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, http.StatusOK, c.Report())
+	}
+}
+
+// ReadinessHandler serves /readyz, it responds OK only once every enabled
+// engine is loaded and none of their policies are failing
+func ReadinessHandler(c *Checker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := c.Report()
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeReport(w, status, report)
+	}
+}
+
+func writeReport(w http.ResponseWriter, status int, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// Unavailable is used in place of a handler whose policy failed to compile,
+// it responds that the service is unavailable rather than guessing at a
+// decision
+func Unavailable(engine, policy string, err error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestid.Printf(r.Context(), "%s policy %s is unavailable: %s", engine, policy, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
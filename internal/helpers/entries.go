@@ -0,0 +1,91 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/tracing"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// UpdateEntryPayload is the expected body of a request to update an entry
+type UpdateEntryPayload struct {
+	Content string `json:"content"`
+}
+
+// LoadEntry looks up an entry and the notebook it's in, found is false if
+// there's no such entry. The lookups have a data.load span so that loading the
+// data can be told apart from evaluating the policy.
+func LoadEntry(ctx context.Context, entries *entrystore.Store, notebooks *map[string]types.Notebook, entryID string) (entry types.Entry, notebook types.Notebook, found bool) {
+	_, span := tracing.StartSpan(ctx, "data.load")
+	span.SetAttribute("data.resource", "entries/"+entryID)
+	defer span.End()
+
+	entry, found = entries.Get(entryID)
+	if !found {
+		return types.Entry{}, types.Notebook{}, false
+	}
+
+	return entry, (*notebooks)[entry.Notebook], true
+}
+
+// ReviseEntry returns a copy of the entry with the new content, the replaced
+// content is kept as the latest revision in the entry's history
+func ReviseEntry(entry types.Entry, userName, content string) types.Entry {
+	// copy the revisions so that the caller's entry is left unchanged
+	revisions := make([]types.Revision, len(entry.Revisions), len(entry.Revisions)+1)
+	copy(revisions, entry.Revisions)
+
+	entry.Revisions = append(revisions, types.Revision{
+		Content:    entry.Content,
+		ReplacedBy: userName,
+		ReplacedAt: time.Now().UTC(),
+	})
+	entry.Content = content
+
+	return entry
+}
+
+// LookupRevision finds a revision of the entry by its revisionID, revisions
+// are numbered from 1 in the order they were created
+func LookupRevision(entry types.Entry, revisionID string) (revision types.Revision, found bool) {
+	index, err := strconv.Atoi(revisionID)
+	if err != nil || index < 1 || index > len(entry.Revisions) {
+		return types.Revision{}, false
+	}
+
+	return entry.Revisions[index-1], true
+}
+
+// WriteRevisions responds with a JSON list summarising the revisions of an
+// entry, the content of each revision can then be requested by its id
+func WriteRevisions(w http.ResponseWriter, revisions []types.Revision) {
+	type revisionSummary struct {
+		ID         int       `json:"id"`
+		ReplacedBy string    `json:"replaced_by"`
+		ReplacedAt time.Time `json:"replaced_at"`
+	}
+
+	summaries := []revisionSummary{}
+	for i, revision := range revisions {
+		summaries = append(summaries, revisionSummary{
+			ID:         i + 1,
+			ReplacedBy: revision.ReplacedBy,
+			ReplacedAt: revision.ReplacedAt,
+		})
+	}
+
+	bytes, err := json.Marshal(summaries)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
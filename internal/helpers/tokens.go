@@ -0,0 +1,139 @@
+package helpers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// DefaultTokenLifetime is used when a token is requested without expires_in
+const DefaultTokenLifetime = 30 * 24 * time.Hour
+
+// MaxTokenLifetime is the longest lifetime a token can be requested with, it
+// also keeps the expiry from overflowing
+const MaxTokenLifetime = 365 * 24 * time.Hour
+
+// CreateTokenPayload is the expected body of a request to issue a token
+type CreateTokenPayload struct {
+	Name string `json:"name"`
+
+	// ExpiresIn is the lifetime of the token in seconds
+	ExpiresIn int `json:"expires_in"`
+
+	// Scopes restrict what the token can be used for
+	Scopes []string `json:"scopes"`
+}
+
+// Lifetime is how long the requested token should be valid for
+func (p CreateTokenPayload) Lifetime() time.Duration {
+	if p.ExpiresIn == 0 {
+		return DefaultTokenLifetime
+	}
+	return time.Duration(p.ExpiresIn) * time.Second
+}
+
+// RequestedScopes are the scopes the token should have, tokens requested
+// without any are given all of them
+func (p CreateTokenPayload) RequestedScopes() []string {
+	if len(p.Scopes) == 0 {
+		return types.AllScopes
+	}
+	return p.Scopes
+}
+
+// ReadCreateTokenPayload parses and validates the body of a request to issue
+// a token
+func ReadCreateTokenPayload(r *http.Request) (CreateTokenPayload, error) {
+	var payload CreateTokenPayload
+
+	payloadBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return payload, err
+	}
+	err = json.Unmarshal(payloadBytes, &payload)
+	if err != nil {
+		return payload, err
+	}
+
+	if payload.Name == "" {
+		return payload, errors.New("name is required")
+	}
+	if payload.ExpiresIn < 0 {
+		return payload, errors.New("expires_in must be positive")
+	}
+	if payload.ExpiresIn > int(MaxTokenLifetime/time.Second) {
+		return payload, fmt.Errorf("expires_in can't be more than %d", int(MaxTokenLifetime/time.Second))
+	}
+	for _, scope := range payload.Scopes {
+		if !types.IsScope(scope) {
+			return payload, fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	return payload, nil
+}
+
+type tokenSummary struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	User       string     `json:"user"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+
+	// Token is the secret, it's only included when the token is issued
+	Token string `json:"token,omitempty"`
+}
+
+func summariseToken(token types.Token) tokenSummary {
+	summary := tokenSummary{
+		ID:        token.ID,
+		Name:      token.Name,
+		User:      token.User,
+		Scopes:    token.Scopes,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+	}
+	if !token.LastUsedAt.IsZero() {
+		lastUsedAt := token.LastUsedAt
+		summary.LastUsedAt = &lastUsedAt
+	}
+	return summary
+}
+
+// WriteIssuedToken responds with a newly issued token, this is the only time
+// its secret is shown
+func WriteIssuedToken(w http.ResponseWriter, token types.Token, secret string) {
+	summary := summariseToken(token)
+	summary.Token = secret
+
+	writeJSON(w, http.StatusCreated, summary)
+}
+
+// WriteTokens responds with a JSON list of tokens, without their secrets
+func WriteTokens(w http.ResponseWriter, tokens []types.Token) {
+	summaries := []tokenSummary{}
+	for _, token := range tokens {
+		summaries = append(summaries, summariseToken(token))
+	}
+
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
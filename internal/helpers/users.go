@@ -0,0 +1,19 @@
+package helpers
+
+import (
+	"context"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/tracing"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
+)
+
+// LoadUser looks up the named user, in a data.load span like LoadEntry
+func LoadUser(ctx context.Context, users *userstore.Store, name string) (types.User, bool) {
+	_, span := tracing.StartSpan(ctx, "data.load")
+	span.SetAttribute("data.resource", "users/"+name)
+	defer span.End()
+
+	user, ok := users.Get(name)
+	return user, ok
+}
@@ -0,0 +1,26 @@
+package helpers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// WriteWhoAmI reports the name of the principal. Clients which accept JSON
+// also get the type of the principal, i.e. user or service_account, others
+// get the name as plain text.
+func WriteWhoAmI(w http.ResponseWriter, r *http.Request, name, principalType string) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusOK, struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		}{
+			Name: name,
+			Type: principalType,
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, name)
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+)
+
+// Decisions is a decision log sink which counts the decisions of each engine
+// and endpoint by result, and observes how long the policies took to evaluate
+type Decisions struct {
+	total    *Counter
+	duration *Histogram
+}
+
+// NewDecisions registers the decision metrics in the registry
+func NewDecisions(registry *Registry) *Decisions {
+	return &Decisions{
+		total: registry.NewCounter(
+			"authz_decisions_total",
+			"Number of authorization decisions made.",
+			"engine", "endpoint", "result",
+		),
+		duration: registry.NewHistogram(
+			"authz_decision_duration_seconds",
+			"Time taken to evaluate the policy for an authorization decision.",
+			DefaultBuckets,
+			"engine", "endpoint",
+		),
+	}
+}
+
+func (d *Decisions) Write(decision decisions.Decision) error {
+	d.total.Inc(decision.Engine, decision.Endpoint, decision.Result)
+
+	latency := time.Duration(decision.LatencyMS * float64(time.Millisecond))
+	d.duration.Observe(latency.Seconds(), decision.Engine, decision.Endpoint)
+
+	return nil
+}
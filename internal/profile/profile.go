@@ -0,0 +1,222 @@
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+)
+
+// Limits of the seconds parameter of the profile endpoint
+const (
+	DefaultSeconds = 30
+	MaxSeconds     = 300
+)
+
+// ErrRunning is returned when starting a profile of an engine which is
+// already being profiled
+var ErrRunning = errors.New("engine is already being profiled")
+
+// Stat is the aggregated timing of a rule or expression while profiling
+type Stat struct {
+	// Name identifies what was timed, e.g. a rego expression's location or a
+	// polar rule
+	Name string `json:"name"`
+
+	// Text is the source of a rego expression
+	Text string `json:"text,omitempty"`
+
+	Hits        int64 `json:"hits"`
+	TotalTimeNS int64 `json:"total_time_ns"`
+	MeanTimeNS  int64 `json:"mean_time_ns"`
+}
+
+// Report is the result of profiling an engine, its stats are sorted by total
+// time with the most expensive first
+type Report struct {
+	Engine    string    `json:"engine"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	Stats     []Stat    `json:"stats"`
+}
+
+// Session collects timings for an engine while it's being profiled. A nil
+// Session is valid and records nothing, which is what Active returns when the
+// engine isn't being profiled.
+type Session struct {
+	engine  string
+	started time.Time
+
+	mu    sync.Mutex
+	stats map[string]*Stat
+}
+
+// Add records hits of what's identified by name taking d in total, text is
+// the source of what was timed if known
+func (s *Session) Add(name, text string, hits int64, d time.Duration) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stat, ok := s.stats[name]
+	if !ok {
+		stat = &Stat{Name: name, Text: text}
+		s.stats[name] = stat
+	}
+	stat.Hits += hits
+	stat.TotalTimeNS += d.Nanoseconds()
+}
+
+// Time starts timing a hit of name, it's recorded when the returned function
+// is called
+func (s *Session) Time(name string) func() {
+	if s == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	return func() {
+		s.Add(name, "", 1, time.Since(start))
+	}
+}
+
+func (s *Session) report() Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := Report{Engine: s.engine, StartedAt: s.started, EndedAt: time.Now().UTC(), Stats: []Stat{}}
+	for _, stat := range s.stats {
+		copied := *stat
+		if copied.Hits > 0 {
+			copied.MeanTimeNS = copied.TotalTimeNS / copied.Hits
+		}
+		report.Stats = append(report.Stats, copied)
+	}
+	sort.Slice(report.Stats, func(i, j int) bool {
+		if report.Stats[i].TotalTimeNS != report.Stats[j].TotalTimeNS {
+			return report.Stats[i].TotalTimeNS > report.Stats[j].TotalTimeNS
+		}
+		return report.Stats[i].Name < report.Stats[j].Name
+	})
+	return report
+}
+
+// Profiler keeps the session of each engine being profiled, there's at most
+// one at a time for each engine
+type Profiler struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// New creates a Profiler with nothing being profiled
+func New() *Profiler {
+	return &Profiler{sessions: make(map[string]*Session)}
+}
+
+// Default is the profiler the engines record their timings in
+var Default = New()
+
+// Active returns the Default profiler's session for the engine, it's nil when
+// the engine isn't being profiled
+func Active(engine string) *Session {
+	return Default.Session(engine)
+}
+
+// Session returns the session for the engine, nil if it isn't being profiled
+func (p *Profiler) Session(engine string) *Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.sessions[engine]
+}
+
+// Start begins profiling the engine
+func (p *Profiler) Start(engine string) (*Session, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.sessions[engine]; ok {
+		return nil, ErrRunning
+	}
+	s := &Session{engine: engine, started: time.Now().UTC(), stats: make(map[string]*Stat)}
+	p.sessions[engine] = s
+	return s, nil
+}
+
+// Stop ends the session and reports its timings
+func (p *Profiler) Stop(s *Session) Report {
+	p.mu.Lock()
+	if p.sessions[s.engine] == s {
+		delete(p.sessions, s.engine)
+	}
+	p.mu.Unlock()
+
+	return s.report()
+}
+
+// Handler profiles the engine in the engine parameter for the number of
+// seconds in the seconds parameter, then responds with the report. Profiling
+// ends early if the request is cancelled. Only admins may profile.
+func Handler(p *Profiler, engines ...string) func(w http.ResponseWriter, r *http.Request) {
+	known := make(map[string]bool)
+	for _, engine := range engines {
+		known[engine] = true
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the principal has been set in the request context by the authn
+		// middleware
+		principal, ok := authn.PrincipalFromContext(r.Context())
+		if !ok || !principal.IsAdmin() {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		engine := r.URL.Query().Get("engine")
+		if !known[engine] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		seconds := DefaultSeconds
+		if value := r.URL.Query().Get("seconds"); value != "" {
+			var err error
+			seconds, err = strconv.Atoi(value)
+			if err != nil || seconds < 1 || seconds > MaxSeconds {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		session, err := p.Start(engine)
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		timer := time.NewTimer(time.Duration(seconds) * time.Second)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+		}
+
+		bytes, err := json.Marshal(p.Stop(session))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(bytes)
+	}
+}
@@ -0,0 +1,152 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Header carries the request ID, it's accepted from clients and always sent
+// in responses
+const Header = "X-Request-ID"
+
+// maxLength is the longest request ID accepted from a client
+const maxLength = 128
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// WithRequestID returns a copy of the context holding the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// FromContext returns the request ID in the context, or an empty string if
+// there isn't one
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Middleware gives each request an ID, the client's X-Request-ID is used when
+// it's valid. The ID is in the request context and the X-Request-ID response
+// header, and error responses without a body of their own get a JSON body with
+// it so that users can report it.
+func Middleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(Header)
+			if !valid(id) {
+				id = generate()
+			}
+
+			w.Header().Set(Header, id)
+			rw := &responseWriter{ResponseWriter: w, id: id}
+			next.ServeHTTP(rw, r.WithContext(WithRequestID(r.Context(), id)))
+			rw.finish()
+		})
+	}
+}
+
+// Logger returns a logger which prefixes each line with the request ID, the
+// logger itself is returned when there's no ID
+func Logger(logger *log.Logger, id string) *log.Logger {
+	if id == "" {
+		return logger
+	}
+	return log.New(logger.Writer(), fmt.Sprintf("%srequest_id=%s ", logger.Prefix(), id), logger.Flags())
+}
+
+// Printf logs to the standard logger with the request ID in the context
+func Printf(ctx context.Context, format string, v ...interface{}) {
+	Logger(log.New(log.Writer(), "", log.LstdFlags), FromContext(ctx)).Printf(format, v...)
+}
+
+// valid is true for IDs which are safe to log and send back, i.e. short and
+// made of letters, digits and a little punctuation
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func generate() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("failed to generate request id: %s", err))
+	}
+	return hex.EncodeToString(id)
+}
+
+// ErrorResponse is the body of error responses which don't have one
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id"`
+}
+
+// responseWriter holds back error statuses until it's known whether the
+// handler writes a body, so that one with the request ID can be written if not
+type responseWriter struct {
+	http.ResponseWriter
+	id string
+
+	status      int
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.wroteHeader || w.status != 0 {
+		return
+	}
+	if status < http.StatusBadRequest {
+		w.wroteHeader = true
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.flush()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) flush() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+// finish writes the held back error status with a body identifying the
+// request
+func (w *responseWriter) finish() {
+	if w.wroteHeader || w.status == 0 {
+		return
+	}
+	w.wroteHeader = true
+
+	body, _ := json.Marshal(ErrorResponse{Error: http.StatusText(w.status), RequestID: w.id})
+	w.Header().Set("Content-Type", "application/json")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(append(body, '\n'))
+}
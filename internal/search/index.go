@@ -0,0 +1,124 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// Index is an in-memory inverted index from the terms in entry content to the
+// ids of the entries containing them. It knows nothing about who may read the
+// entries, callers must filter the results using an authorization policy.
+type Index struct {
+	mu sync.RWMutex
+
+	// postings maps each term to the set of entry ids containing it
+	postings map[string]map[string]bool
+
+	// terms maps each entry id to the terms it was indexed with so that the
+	// entry can be removed from the postings when updated
+	terms map[string][]string
+}
+
+// NewIndex creates an index populated with the content of the entries
+func NewIndex(entries *entrystore.Store) *Index {
+	index := &Index{
+		postings: make(map[string]map[string]bool),
+		terms:    make(map[string][]string),
+	}
+
+	entries.Range(func(id string, entry types.Entry) {
+		index.Put(id, entry.Content)
+	})
+
+	return index
+}
+
+// Put indexes the content for an entry, replacing anything previously indexed
+// for the same id
+func (i *Index) Put(id, content string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.remove(id)
+
+	terms := uniqueTerms(content)
+	for _, term := range terms {
+		if i.postings[term] == nil {
+			i.postings[term] = make(map[string]bool)
+		}
+		i.postings[term][id] = true
+	}
+	i.terms[id] = terms
+}
+
+// Remove drops an entry from the index
+func (i *Index) Remove(id string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.remove(id)
+}
+
+func (i *Index) remove(id string) {
+	for _, term := range i.terms[id] {
+		delete(i.postings[term], id)
+		if len(i.postings[term]) == 0 {
+			delete(i.postings, term)
+		}
+	}
+	delete(i.terms, id)
+}
+
+// Search returns the sorted ids of entries containing every term in the query
+func (i *Index) Search(query string) []string {
+	terms := uniqueTerms(query)
+	if len(terms) == 0 {
+		return []string{}
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	ids := []string{}
+	for id := range i.postings[terms[0]] {
+		matched := true
+		for _, term := range terms[1:] {
+			if !i.postings[term][id] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Terms splits text into lower case terms, this is used for both content and
+// queries so that they match in the same way
+func Terms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func uniqueTerms(text string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, term := range Terms(text) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
@@ -0,0 +1,90 @@
+package search
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// snippetWords is the number of words either side of the first matching term
+// included in a snippet
+const snippetWords = 5
+
+// Result is a single entry matching a search
+type Result struct {
+	ID      string `json:"id"`
+	Snippet string `json:"snippet"`
+}
+
+// Results is the response to a search. Count is only ever the number of
+// readable results, so that it can't be used to learn about other entries.
+type Results struct {
+	Count   int      `json:"count"`
+	Results []Result `json:"results"`
+}
+
+// NewResult builds the result for an entry the user has been permitted to read
+func NewResult(id string, entry types.Entry, query string) Result {
+	return Result{
+		ID:      id,
+		Snippet: Snippet(entry.Content, query),
+	}
+}
+
+// Snippet returns the words of the content around the first term that matches
+// the query
+func Snippet(content, query string) string {
+	queryTerms := make(map[string]bool)
+	for _, term := range Terms(query) {
+		queryTerms[term] = true
+	}
+
+	words := strings.Fields(content)
+	for i, word := range words {
+		matched := false
+		for _, term := range Terms(word) {
+			if queryTerms[term] {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		start, end := i-snippetWords, i+snippetWords+1
+		prefix, suffix := "...", "..."
+		if start <= 0 {
+			start, prefix = 0, ""
+		}
+		if end >= len(words) {
+			end, suffix = len(words), ""
+		}
+
+		return prefix + strings.Join(words[start:end], " ") + suffix
+	}
+
+	return ""
+}
+
+// WriteResults responds with the results as JSON
+func WriteResults(w http.ResponseWriter, results []Result) {
+	if results == nil {
+		results = []Result{}
+	}
+
+	bytes, err := json.Marshal(Results{
+		Count:   len(results),
+		Results: results,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
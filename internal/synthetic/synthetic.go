@@ -0,0 +1,298 @@
+package synthetic
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// Topology is the shape of the friend graph between users
+type Topology string
+
+const (
+	// Random connects pairs of users chosen uniformly at random
+	Random Topology = "random"
+
+	// SmallWorld connects users to their neighbours on a ring, with some
+	// friendships rewired to random users so that paths are short, see
+	// https://en.wikipedia.org/wiki/Watts%E2%80%93Strogatz_model
+	SmallWorld Topology = "small-world"
+
+	// PowerLaw connects new users to those who already have many friends, so
+	// a few users have most of the friendships, see
+	// https://en.wikipedia.org/wiki/Barab%C3%A1si%E2%80%93Albert_model
+	PowerLaw Topology = "power-law"
+)
+
+// Config describes a graph to generate, graphs with the same config are the
+// same
+type Config struct {
+	Topology Topology
+
+	Users   int
+	Entries int
+
+	// Friends is the average number of friends each user has, 10 if not set
+	Friends int
+
+	// Rewire is the chance of each small world friendship being rewired, 0.1
+	// if not set
+	Rewire float64
+
+	Seed int64
+}
+
+// Graph is a generated set of users with their friendships and entries, in the
+// form the handlers use
+type Graph struct {
+	Users     map[string]types.User
+	Entries   map[string]types.Entry
+	Notebooks map[string]types.Notebook
+
+	// Names are the names of the users in the order they were created, so
+	// that they can be picked from reproducibly
+	Names []string
+
+	// EntryIDs are the IDs of the entries in the order they were created
+	EntryIDs []string
+}
+
+// UserName is the name of the i'th user, it's padded so that names sort in the
+// order they were created
+func UserName(i int) string {
+	return fmt.Sprintf("user%06d", i)
+}
+
+// Token is the bearer token of the user with the name
+func Token(name string) string {
+	return "token-" + name
+}
+
+// Generate creates the graph described by the config
+func Generate(config Config) (Graph, error) {
+	if config.Users < 1 {
+		return Graph{}, fmt.Errorf("at least one user is needed")
+	}
+	if config.Entries < 0 {
+		return Graph{}, fmt.Errorf("entries can't be negative")
+	}
+	if config.Friends < 0 {
+		return Graph{}, fmt.Errorf("friends can't be negative")
+	}
+	if config.Friends == 0 {
+		config.Friends = 10
+	}
+	if config.Rewire == 0 {
+		config.Rewire = 0.1
+	}
+	// there's no one else to be friends with beyond this
+	if config.Friends > config.Users-1 {
+		config.Friends = config.Users - 1
+	}
+
+	rnd := rand.New(rand.NewSource(config.Seed))
+	friends := newAdjacency(config.Users)
+
+	switch config.Topology {
+	case Random:
+		randomFriends(rnd, friends, config.Friends)
+	case SmallWorld:
+		smallWorldFriends(rnd, friends, config.Friends, config.Rewire)
+	case PowerLaw:
+		powerLawFriends(rnd, friends, config.Friends)
+	default:
+		return Graph{}, fmt.Errorf("unknown topology %q", config.Topology)
+	}
+
+	graph := Graph{
+		Users:     make(map[string]types.User, config.Users),
+		Entries:   make(map[string]types.Entry, config.Entries),
+		Notebooks: make(map[string]types.Notebook),
+		Names:     make([]string, config.Users),
+		EntryIDs:  make([]string, config.Entries),
+	}
+
+	for i := range graph.Names {
+		graph.Names[i] = UserName(i)
+	}
+	for i, name := range graph.Names {
+		var userFriends []string
+		for _, j := range friends.of(i) {
+			userFriends = append(userFriends, graph.Names[j])
+		}
+		graph.Users[name] = types.User{
+			Token:   Token(name),
+			Roles:   []string{types.RoleMember},
+			Friends: userFriends,
+		}
+	}
+
+	for i := range graph.EntryIDs {
+		id := fmt.Sprint(i + 1)
+		graph.EntryIDs[i] = id
+
+		owner := rnd.Intn(config.Users)
+		entry := types.Entry{
+			User:    graph.Names[owner],
+			Content: fmt.Sprintf("entry %s by %s", id, graph.Names[owner]),
+			Readers: sampleFriends(rnd, graph.Names, friends.of(owner), 3),
+		}
+
+		// some entries are in their owner's notebook, which is shared with
+		// friends of its own
+		if rnd.Float64() < 0.2 {
+			entry.Notebook = "notebook-" + entry.User
+			if _, ok := graph.Notebooks[entry.Notebook]; !ok {
+				graph.Notebooks[entry.Notebook] = types.Notebook{
+					User:    entry.User,
+					Readers: sampleFriends(rnd, graph.Names, friends.of(owner), 5),
+				}
+			}
+		}
+		if rnd.Float64() < 0.05 {
+			entry.Reported = true
+			entry.Private = rnd.Float64() < 0.5
+		}
+
+		graph.Entries[id] = entry
+	}
+
+	return graph, nil
+}
+
+// adjacency is an undirected graph of users by index
+type adjacency []map[int]bool
+
+func newAdjacency(n int) adjacency {
+	a := make(adjacency, n)
+	for i := range a {
+		a[i] = make(map[int]bool)
+	}
+	return a
+}
+
+// connect adds a friendship, false if it's a loop or already exists
+func (a adjacency) connect(i, j int) bool {
+	if i == j || a[i][j] {
+		return false
+	}
+	a[i][j] = true
+	a[j][i] = true
+	return true
+}
+
+func (a adjacency) disconnect(i, j int) {
+	delete(a[i], j)
+	delete(a[j], i)
+}
+
+// of returns the friends of i, sorted so that the graph is reproducible
+func (a adjacency) of(i int) []int {
+	friends := make([]int, 0, len(a[i]))
+	for j := range a[i] {
+		friends = append(friends, j)
+	}
+	sort.Ints(friends)
+	return friends
+}
+
+// randomFriends adds friendships between random pairs until users have k
+// friends on average
+func randomFriends(rnd *rand.Rand, a adjacency, k int) {
+	n := len(a)
+	for edges := n * k / 2; edges > 0; {
+		if a.connect(rnd.Intn(n), rnd.Intn(n)) {
+			edges--
+		}
+	}
+}
+
+// smallWorldFriends befriends each user with the k nearest users on a ring,
+// then moves each friendship to a random user with probability p
+func smallWorldFriends(rnd *rand.Rand, a adjacency, k int, p float64) {
+	n := len(a)
+	half := k / 2
+	if half < 1 && n > 1 {
+		half = 1
+	}
+
+	for i := 0; i < n; i++ {
+		for offset := 1; offset <= half; offset++ {
+			a.connect(i, (i+offset)%n)
+		}
+	}
+
+	// each user has only half their friends in the lattice after them
+	if n <= k+1 {
+		return
+	}
+	for i := 0; i < n; i++ {
+		for offset := 1; offset <= half; offset++ {
+			j := (i + offset) % n
+			if rnd.Float64() >= p || !a[i][j] {
+				continue
+			}
+			target := rnd.Intn(n)
+			if target == i || a[i][target] {
+				continue
+			}
+			a.disconnect(i, j)
+			a.connect(i, target)
+		}
+	}
+}
+
+// powerLawFriends adds users one at a time, each befriending k/2 existing
+// users chosen in proportion to how many friends they already have
+func powerLawFriends(rnd *rand.Rand, a adjacency, k int) {
+	n := len(a)
+	m := k / 2
+	if m < 1 {
+		m = 1
+	}
+
+	// each user appears once for every friendship they're in, so picking
+	// from this uniformly picks in proportion to the number of friends
+	var ends []int
+
+	// the first users are all friends so that everyone has someone to join
+	seed := m + 1
+	if seed > n {
+		seed = n
+	}
+	for i := 0; i < seed; i++ {
+		for j := i + 1; j < seed; j++ {
+			a.connect(i, j)
+			ends = append(ends, i, j)
+		}
+	}
+
+	for i := seed; i < n; i++ {
+		for added := 0; added < m; {
+			j := ends[rnd.Intn(len(ends))]
+			if a.connect(i, j) {
+				ends = append(ends, i, j)
+				added++
+			}
+		}
+	}
+}
+
+// sampleFriends picks up to n of the friends at random
+func sampleFriends(rnd *rand.Rand, names []string, friends []int, n int) []string {
+	if len(friends) == 0 {
+		return nil
+	}
+
+	count := rnd.Intn(n + 1)
+	var sample []string
+	for _, i := range rnd.Perm(len(friends)) {
+		if len(sample) == count {
+			break
+		}
+		sample = append(sample, names[friends[i]])
+	}
+	return sample
+}
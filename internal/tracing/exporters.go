@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// JSONExporter writes each span as a line of JSON
+type JSONExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONExporter creates a JSONExporter writing to w
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w}
+}
+
+func (e *JSONExporter) Export(span SpanData) error {
+	line, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err = e.w.Write(append(line, '\n'))
+	return err
+}
+
+// FileExporter writes each span as a line of JSON to a local file, which a
+// collector could tail
+type FileExporter struct {
+	*JSONExporter
+	file *os.File
+}
+
+// NewFileExporter opens the file at path for appending spans
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{JSONExporter: NewJSONExporter(file), file: file}, nil
+}
+
+// Close closes the file
+func (e *FileExporter) Close() error {
+	return e.file.Close()
+}
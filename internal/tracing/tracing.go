@@ -0,0 +1,306 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/requestid"
+	"github.com/gorilla/mux"
+)
+
+// TraceparentHeader is the W3C trace context header, see
+// https://www.w3.org/TR/trace-context/
+const TraceparentHeader = "traceparent"
+
+// SpanData is the record of a finished span which is exported
+type SpanData struct {
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Name         string            `json:"name"`
+	Start        time.Time         `json:"start_time"`
+	End          time.Time         `json:"end_time"`
+	DurationMS   float64           `json:"duration_ms"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+}
+
+// Exporter receives each span as it ends
+type Exporter interface {
+	Export(span SpanData) error
+}
+
+// Tracer creates spans and exports them when they end
+type Tracer struct {
+	Exporter Exporter
+
+	// Now is used for span times, time.Now is used if not set
+	Now func() time.Time
+}
+
+// NewTracer creates a Tracer exporting to the exporter
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{Exporter: exporter}
+}
+
+func (t *Tracer) now() time.Time {
+	if t.Now != nil {
+		return t.Now()
+	}
+	return time.Now()
+}
+
+// Span is an operation within a trace. A nil Span is valid and does nothing,
+// which is what StartSpan returns when the request isn't being traced.
+type Span struct {
+	tracer *Tracer
+	flags  string
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SetAttribute sets an attribute which is exported with the span
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]string)
+	}
+	s.data.Attributes[key] = value
+}
+
+// End finishes the span and exports it if the trace is sampled, only the first
+// call has any effect
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = s.tracer.now()
+	s.data.DurationMS = float64(s.data.End.Sub(s.data.Start)) / float64(time.Millisecond)
+	data := s.data
+	s.mu.Unlock()
+
+	if s.tracer.Exporter != nil && s.sampled() {
+		s.tracer.Exporter.Export(data)
+	}
+}
+
+// sampled is true when the sampled bit of the trace flags is set
+func (s *Span) sampled() bool {
+	flags, err := hex.DecodeString(s.flags)
+	return err == nil && len(flags) == 1 && flags[0]&0x01 == 0x01
+}
+
+// Traceparent is the traceparent header value identifying the span, for
+// propagating the trace to other services
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-%s", s.data.TraceID, s.data.SpanID, s.flags)
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	stageKey
+)
+
+// StartSpan starts a span as a child of the span in the context, the returned
+// context holds the new span. When the context has no span, i.e. the request
+// isn't being traced, the span is nil.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent, ok := ctx.Value(spanKey).(*Span)
+	if !ok || parent == nil {
+		return ctx, nil
+	}
+
+	span := parent.tracer.newSpan(name, parent.data.TraceID, parent.data.SpanID, parent.flags)
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+func (t *Tracer) newSpan(name, traceID, parentSpanID, flags string) *Span {
+	return &Span{
+		tracer: t,
+		flags:  flags,
+		data: SpanData{
+			TraceID:      traceID,
+			SpanID:       randomID(8),
+			ParentSpanID: parentSpanID,
+			Name:         name,
+			Start:        t.now(),
+		},
+	}
+}
+
+// Middleware starts a span for each request, continuing the trace in the
+// traceparent header when there is a valid one. Writing the response has a
+// span of its own. A nil tracer traces nothing. New traces are sampled, but
+// a caller which hasn't sampled its trace has the spans of the request
+// dropped rather than exported, the trace is still propagated with the flag
+// unset.
+func Middleware(t *Tracer) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if t == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			traceID, parentSpanID, flags, ok := ParseTraceparent(r.Header.Get(TraceparentHeader))
+			if !ok {
+				traceID, parentSpanID, flags = randomID(16), "", "01"
+			}
+
+			route := r.URL.Path
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+
+			span := t.newSpan(r.Method+" "+route, traceID, parentSpanID, flags)
+			span.SetAttribute("http.method", r.Method)
+			span.SetAttribute("http.route", route)
+			if id := requestid.FromContext(r.Context()); id != "" {
+				span.SetAttribute("http.request_id", id)
+			}
+			ctx := context.WithValue(r.Context(), spanKey, span)
+
+			rw := &responseWriter{ResponseWriter: w, ctx: ctx, status: http.StatusOK}
+			rw.Header().Set(TraceparentHeader, span.Traceparent())
+			next.ServeHTTP(rw, r.WithContext(ctx))
+
+			rw.response.End()
+			span.SetAttribute("http.status_code", fmt.Sprint(rw.status))
+			span.End()
+		})
+	}
+}
+
+// Stage wraps a middleware in a span of its own which ends when it calls the
+// next handler, or returns without doing so, e.g. to time authentication
+func Stage(name string, mw mux.MiddlewareFunc) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		inner := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the stage is over, later spans are siblings rather than children
+			ctx := r.Context()
+			if s, ok := ctx.Value(stageKey).(stage); ok {
+				s.span.End()
+				ctx = context.WithValue(ctx, spanKey, s.parent)
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			parent, _ := r.Context().Value(spanKey).(*Span)
+			ctx, span := StartSpan(r.Context(), name)
+			if span == nil {
+				inner.ServeHTTP(w, r)
+				return
+			}
+
+			inner.ServeHTTP(w, r.WithContext(context.WithValue(ctx, stageKey, stage{span: span, parent: parent})))
+			span.End()
+		})
+	}
+}
+
+// stage is the span of a Stage which is in progress and the span to go back
+// to once it ends
+type stage struct {
+	span   *Span
+	parent *Span
+}
+
+// ParseTraceparent parses a traceparent header value, ok is false if it's
+// missing or invalid
+func ParseTraceparent(value string) (traceID, spanID, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return "", "", "", false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+
+	// future versions may add fields, but must keep these ones
+	if !isHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return "", "", "", false
+	}
+	if !isHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return "", "", "", false
+	}
+	if !isHex(spanID, 16) || spanID == strings.Repeat("0", 16) {
+		return "", "", "", false
+	}
+	if !isHex(flags, 2) {
+		return "", "", "", false
+	}
+
+	return traceID, spanID, flags, true
+}
+
+func isHex(value string, length int) bool {
+	if len(value) != length {
+		return false
+	}
+	for _, c := range value {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomID(bytes int) string {
+	id := make([]byte, bytes)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("failed to generate trace id: %s", err))
+	}
+	return hex.EncodeToString(id)
+}
+
+// responseWriter starts a response span when the handler begins writing its
+// response and records the status code
+type responseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	status   int
+	response *Span
+}
+
+func (w *responseWriter) start() {
+	if w.response == nil {
+		_, w.response = StartSpan(w.ctx, "response")
+	}
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.start()
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.start()
+	return w.ResponseWriter.Write(b)
+}
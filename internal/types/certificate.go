@@ -0,0 +1,22 @@
+package types
+
+import "time"
+
+// Certificate holds the attributes of a verified TLS client certificate so
+// that policies can use them
+type Certificate struct {
+	// Subject is the distinguished name, e.g. CN=backup,OU=jobs,O=Example
+	Subject            string
+	CommonName         string
+	Organization       []string
+	OrganizationalUnit []string
+
+	// DNSNames, EmailAddresses and URIs are the subject alternative names
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+
+	Issuer       string
+	SerialNumber string
+	NotAfter     time.Time
+}
@@ -3,4 +3,37 @@ package types
 type Entry struct {
 	User    string
 	Content string
+
+	// Readers is a list of userNames the entry has been shared with for
+	// reading only
+	Readers []string
+
+	// Editors is a list of userNames the entry has been shared with who may
+	// also update the entry and see its history
+	Editors []string
+
+	// Groups is a list of groups, from the groups claim of a JWT or the
+	// organizational units of a client certificate, the entry has been shared
+	// with for reading only
+	Groups []string
+
+	// Notebook is the id of the notebook the entry belongs to, if any. Entries
+	// inherit the sharing of their notebook.
+	Notebook string
+
+	// OverrideSharing is set when only the entry's own Readers and Editors
+	// should be used, rather than those inherited from the notebook
+	OverrideSharing bool
+
+	// Reported is set when the entry has been reported to the moderators,
+	// roles with the right permissions may then read it
+	Reported bool
+
+	// Private entries are never read by moderators, even when reported
+	Private bool
+
+	// Revisions is the history of the entry, each update that overwrites the
+	// Content keeps the previous Content as a new Revision at the end of the
+	// list
+	Revisions []Revision
 }
@@ -0,0 +1,16 @@
+package types
+
+// Notebook is a parent resource for entries. Sharing a notebook shares every
+// entry in it, unless the entry overrides the sharing.
+type Notebook struct {
+	// User is the userName of the owner of the notebook
+	User string
+
+	// Readers is a list of userNames the notebook has been shared with for
+	// reading only
+	Readers []string
+
+	// Editors is a list of userNames the notebook has been shared with who may
+	// also update the entries in it
+	Editors []string
+}
@@ -0,0 +1,67 @@
+package types
+
+// Types of principal, policies only apply the relationship rules to users
+const (
+	PrincipalTypeUser           = "user"
+	PrincipalTypeServiceAccount = "service_account"
+)
+
+// Risk levels of a principal, it's elevated when there have been recent
+// failed attempts to authenticate from the same client or as the same user
+const (
+	RiskLow      = "low"
+	RiskElevated = "elevated"
+)
+
+// Principal is the authenticated identity making a request
+type Principal struct {
+	// Name is the userName of the principal, or the name of the service
+	// account
+	Name string
+
+	// Type is either PrincipalTypeUser or PrincipalTypeServiceAccount,
+	// authenticators of users can leave it empty
+	Type string
+
+	// Authenticator is the name of the authenticator that identified the
+	// principal, e.g. bearer or basic
+	Authenticator string
+
+	// Claims are the verified claims of a JWT, they're passed to policies so
+	// rules can use them. Claims is nil for other authenticators.
+	Claims map[string]interface{}
+
+	// Certificate has the attributes of the TLS client certificate that
+	// identified the principal, it's nil for other authenticators
+	Certificate *Certificate
+
+	// Roles are the roles of the user the principal identifies, e.g.
+	// moderator. They're set from the user by the authn.UserRoles middleware.
+	Roles []string
+
+	// Grants are the explicit permissions of a service account, they're nil
+	// for users
+	Grants []string
+
+	// Impersonator is the name of the admin acting as the principal with the
+	// X-Act-As header, it's empty when the principal isn't being impersonated
+	Impersonator string
+
+	// Risk is RiskElevated when the principal authenticated after recent
+	// failed attempts, policies can be stricter about what they permit
+	Risk string
+
+	// Scopes limit what the principal may do, principals with unrestricted
+	// credentials have AllScopes
+	Scopes []string
+}
+
+// IsAdmin is true when the principal has the admin role
+func (p Principal) IsAdmin() bool {
+	for _, role := range p.Roles {
+		if role == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,15 @@
+package types
+
+import "time"
+
+type Revision struct {
+	// Content is the content of the entry before it was replaced
+	Content string
+
+	// ReplacedBy is the userName of the user who updated the entry and
+	// replaced this Content
+	ReplacedBy string
+
+	// ReplacedAt is the time when the Content was replaced
+	ReplacedAt time.Time
+}
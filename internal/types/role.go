@@ -0,0 +1,28 @@
+package types
+
+// Roles users can have, see User.Roles
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// Permissions granted to roles, these are checked alongside the relationship
+// rules in the policies
+const (
+	// PermissionReadReported allows reading reported entries which aren't
+	// private
+	PermissionReadReported = "read_reported_entries"
+
+	// PermissionReadPrivateReported allows reading reported entries, even
+	// when they're private
+	PermissionReadPrivateReported = "read_private_reported_entries"
+)
+
+// RolePermissions maps each role to the permissions it grants. It's given to
+// the policies of each engine as data rather than being written into them.
+var RolePermissions = map[string][]string{
+	RoleAdmin:     {PermissionReadReported, PermissionReadPrivateReported},
+	RoleModerator: {PermissionReadReported},
+	RoleMember:    {},
+}
@@ -0,0 +1,22 @@
+package types
+
+// Scopes restrict what a principal may do, regardless of what their
+// relationships to other users and entries would otherwise permit
+const (
+	ScopeEntriesRead  = "entries:read"
+	ScopeEntriesWrite = "entries:write"
+	ScopeFriendsWrite = "friends:write"
+)
+
+// AllScopes are held by principals whose credentials aren't restricted
+var AllScopes = []string{ScopeEntriesRead, ScopeEntriesWrite, ScopeFriendsWrite}
+
+// IsScope reports if scope is one of the known scopes
+func IsScope(scope string) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
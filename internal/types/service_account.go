@@ -0,0 +1,18 @@
+package types
+
+// Grants given to service accounts. Service accounts aren't part of the
+// friend graph, so they're only permitted what they've been granted.
+const (
+	// GrantReadAllEntries allows reading any entry, e.g. for backups
+	GrantReadAllEntries = "read_all_entries"
+)
+
+// ServiceAccount is a non-human principal, e.g. a backup job
+type ServiceAccount struct {
+	// Token is the bearer token the service account includes with requests,
+	// it must start with the authn.ServiceAccountPrefix
+	Token string
+
+	// Grants are the explicit permissions of the service account
+	Grants []string
+}
@@ -0,0 +1,28 @@
+package types
+
+import "time"
+
+// Token is an opaque bearer token issued to a user, users can have many
+// tokens and revoke them individually
+type Token struct {
+	ID string
+
+	// User is the userName of the user the token identifies
+	User string
+
+	// Name is a description of what the token is used for
+	Name string
+
+	// Scopes are the only scopes held by principals using the token
+	Scopes []string
+
+	// SecretHash is the SHA-256 of the secret, the secret itself is only
+	// known to the user
+	SecretHash string `json:"-"`
+
+	CreatedAt time.Time
+	ExpiresAt time.Time
+
+	// LastUsedAt is zero until the token is first used
+	LastUsedAt time.Time
+}
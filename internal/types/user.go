@@ -5,6 +5,13 @@ type User struct {
 	// themselves
 	Token string
 
+	// PasswordHash is the encoded result of hashing the user's password with
+	// a slow KDF, it's empty for users who can't log in with a password
+	PasswordHash string `json:"-"`
+
+	// Roles are the user's roles, e.g. admin
+	Roles []string
+
 	// Friends is a list of userNames of current accepted friends
 	Friends []string
 
@@ -0,0 +1,132 @@
+package userstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/types"
+)
+
+// Store holds the users shared by authentication and the handlers of every
+// engine. Users are read concurrently, but they're only changed with Put and
+// Delete, one at a time. Each change increments the store's version and
+// invalidates cached decisions, and is given to the store's watchers so that
+// copies of the users, like the rego engine's, are kept in step.
+type Store struct {
+	mu       sync.RWMutex
+	users    map[string]types.User
+	version  uint64
+	watchers []Watcher
+}
+
+// Watcher is called with each change to a user before it's made, while the
+// store is locked. The change isn't made if it returns an error. The user is
+// the zero value when it's deleted.
+type Watcher func(ctx context.Context, name string, user types.User, deleted bool) error
+
+// New creates a store holding a copy of the users
+func New(users map[string]types.User) *Store {
+	store := &Store{users: make(map[string]types.User, len(users))}
+	for name, user := range users {
+		store.users[name] = user
+	}
+	return store
+}
+
+// Get looks up a user by their name
+func (s *Store) Get(name string) (types.User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[name]
+	return user, ok
+}
+
+// Range calls f with each user, the users can't change until it returns
+func (s *Store) Range(f func(name string, user types.User)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for name, user := range s.users {
+		f(name, user)
+	}
+}
+
+// All returns a copy of every user, for policies which are given them all
+func (s *Store) All() map[string]types.User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make(map[string]types.User, len(s.users))
+	for name, user := range s.users {
+		users[name] = user
+	}
+	return users
+}
+
+// Version is incremented by each change to the users, so that anything built
+// from them can tell when it needs rebuilding
+func (s *Store) Version() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.version
+}
+
+// Watch calls start with the users as they are, then the watcher with each
+// later change to them. The store is locked while start runs so that no
+// change is missed, start mustn't keep the map it's given. The watcher isn't
+// added if start returns an error.
+func (s *Store) Watch(start func(users map[string]types.User) error, watcher Watcher) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := start(s.users); err != nil {
+		return err
+	}
+	s.watchers = append(s.watchers, watcher)
+	return nil
+}
+
+// Put adds or replaces the named user
+func (s *Store) Put(ctx context.Context, name string, user types.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, watcher := range s.watchers {
+		if err := watcher(ctx, name, user, false); err != nil {
+			return err
+		}
+	}
+
+	s.users[name] = user
+	s.changed()
+	return nil
+}
+
+// Delete removes the named user, it's not an error if there isn't one
+func (s *Store) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[name]; !ok {
+		return nil
+	}
+
+	for _, watcher := range s.watchers {
+		if err := watcher(ctx, name, types.User{}, true); err != nil {
+			return err
+		}
+	}
+
+	delete(s.users, name)
+	s.changed()
+	return nil
+}
+
+// changed records a change to the users, it's called with the store locked
+func (s *Store) changed() {
+	s.version++
+	decisioncache.Invalidate()
+}
@@ -1,48 +1,452 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/charlieegan3/go-authz-dsls/internal/authn"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisioncache"
+	"github.com/charlieegan3/go-authz-dsls/internal/decisions"
+	"github.com/charlieegan3/go-authz-dsls/internal/entrystore"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/cue"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/golang"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/polar"
 	"github.com/charlieegan3/go-authz-dsls/internal/handlers/rego"
+	"github.com/charlieegan3/go-authz-dsls/internal/health"
+	"github.com/charlieegan3/go-authz-dsls/internal/metrics"
+	"github.com/charlieegan3/go-authz-dsls/internal/profile"
+	"github.com/charlieegan3/go-authz-dsls/internal/requestid"
+	"github.com/charlieegan3/go-authz-dsls/internal/search"
+	"github.com/charlieegan3/go-authz-dsls/internal/tracing"
 	"github.com/charlieegan3/go-authz-dsls/internal/types"
+	"github.com/charlieegan3/go-authz-dsls/internal/userstore"
 	"github.com/gorilla/mux"
 )
 
 var users = map[string]types.User{
-	"Alice": {Token: "123"},
-	"Bob":   {Token: "456"},
+	"Alice": {Token: "123", Roles: []string{"admin"}},
+	"Bob":   {Token: "456", Roles: []string{"member"}},
+	"Carol": {Token: "789", Roles: []string{"moderator"}},
 }
 
-var entries = map[int]types.Entry{
-	1: {
-		User:    "Alice",
-		Content: "dear diary...",
+// serviceAccounts are the non-human principals, they're not part of the
+// friend graph and can only do what they've been granted
+var serviceAccounts = map[string]types.ServiceAccount{
+	"backup": {Token: "sa_backup", Grants: []string{types.GrantReadAllEntries}},
+}
+
+// passwords of the demo users, only their hashes are kept in users
+var passwords = map[string]string{
+	"Alice": "correct horse battery staple",
+	"Bob":   "band camp",
+	"Carol": "tr0ub4dor&3",
+}
+
+var entries = map[string]types.Entry{
+	"1": {
+		User:     "Alice",
+		Content:  "dear diary...",
+		Notebook: "diary",
 	},
-	2: {
-		User:    "Bob",
-		Content: "there was this one time at band camp...",
+	"2": {
+		User:     "Bob",
+		Content:  "there was this one time at band camp...",
+		Reported: true,
 	},
 }
 
+var notebooks = map[string]types.Notebook{
+	"diary": {User: "Alice"},
+}
+
+var (
+	jwtAlgorithm = flag.String("jwt-algorithm", "", "accept JWT bearer tokens signed with HS256, RS256 or ES256")
+	jwtKeyFile   = flag.String("jwt-key-file", "", "file with the HS256 secret, or the PEM public key for RS256 and ES256")
+	jwtIssuer    = flag.String("jwt-issuer", "", "required iss claim of JWTs")
+	jwtAudience  = flag.String("jwt-audience", "", "required aud claim of JWTs")
+
+	tlsAddr         = flag.String("tls-addr", "127.0.0.1:8443", "address of the TLS listener")
+	tlsCertFile     = flag.String("tls-cert-file", "", "PEM certificate for the TLS listener, which is only started when set")
+	tlsKeyFile      = flag.String("tls-key-file", "", "PEM private key for the TLS listener")
+	tlsClientCAFile = flag.String("tls-client-ca-file", "", "PEM CA certificates that client certificates must be signed by")
+	certMappingFile = flag.String("cert-mapping-file", "", "JSON file mapping client certificate subjects and SANs to principals")
+
+	decisionLogStdout      = flag.Bool("decision-log-stdout", false, "write each authorization decision to stdout as JSON")
+	decisionLogFile        = flag.String("decision-log-file", "", "file to write each authorization decision to as JSON")
+	decisionLogFileSize    = flag.Int64("decision-log-file-max-bytes", 10<<20, "size at which the decision log file is rotated")
+	decisionLogFileBackups = flag.Int("decision-log-file-backups", 5, "number of rotated decision log files to keep")
+	decisionLogRingSize    = flag.Int("decision-log-ring-size", 1000, "number of recent decisions kept for /debug/decisions")
+
+	auditLogFile            = flag.String("audit-log-file", "", "file to write each authorization decision to as a hash chained, tamper evident record")
+	auditLogKeyFile         = flag.String("audit-log-key-file", "", "file holding the secret the audit log's hash chain is keyed with, required with -audit-log-file")
+	auditLogCheckpointEvery = flag.Int64("audit-log-checkpoint-every", 100, "number of audit records between checkpoints of the chain head")
+
+	decisionCacheSize = flag.Int("decision-cache-size", decisioncache.DefaultSize, "number of authorization decisions cached until the data or policies change, zero disables the cache")
+
+	traceFile = flag.String("trace-file", "", "file to export request trace spans to as JSON, requests are only traced when set")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long requests in flight are given to finish when the server is stopped")
+)
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(verifyAudit(os.Args[2:]))
+	}
+
+	flag.Parse()
+
+	for userName, password := range passwords {
+		hash, err := authn.HashPassword(password)
+		if err != nil {
+			log.Fatalf("failed to hash password: %s", err)
+		}
+		user := users[userName]
+		user.PasswordHash = hash
+		users[userName] = user
+	}
+
+	// entries are shared by every engine and updated while they're read
+	entryStore := entrystore.New(entries)
+	index := search.NewIndex(entryStore)
+
+	// users are shared by authentication and every engine, and are only
+	// changed through the store so that every engine sees each change
+	userStore := userstore.New(users)
+
+	// rego policies read the users from OPA's storage rather than input
+	regoStore, err := rego.NewStore(userStore)
+	if err != nil {
+		log.Fatalf("failed to create rego store: %s", err)
+	}
+
+	sessions := authn.NewSessions()
+	cookieSession := authn.CookieSession{Sessions: sessions}
+	tokens := authn.NewTokens()
+
+	// JWTs, issued tokens, service account tokens and sessions are checked
+	// before static bearer tokens
+	var authenticators []authn.Authenticator
+	if *jwtAlgorithm != "" {
+		authenticators = append(authenticators, mustJWTAuthenticator())
+	}
+	authenticators = append(authenticators,
+		authn.IssuedToken{Tokens: tokens},
+		authn.ServiceAccountToken{Accounts: &serviceAccounts},
+		authn.BearerSession{Sessions: sessions},
+		authn.BearerToken{Users: userStore},
+		authn.Basic{Users: userStore},
+		authn.APIKey{Users: userStore},
+		cookieSession,
+	)
+
+	// client certificates are only used when no other credentials are sent,
+	// so people calling the TLS listener can still use their own
+	if *tlsCertFile != "" {
+		mapping, err := authn.LoadCertificateMapping(*certMappingFile)
+		if err != nil {
+			log.Fatalf("failed to load certificate mapping: %s", err)
+		}
+		authenticators = append(authenticators, authn.ClientCertificate{Mapping: mapping})
+	}
+
+	// every decision is kept in the ring for /debug/decisions and counted in
+	// /metrics, the other sinks are opt in. Files are closed once the servers
+	// have shut down, so that the decisions of requests in flight are written.
+	var closers []io.Closer
+	ring := decisions.NewRing(*decisionLogRingSize)
+	sinks := []decisions.Sink{ring, metrics.NewDecisions(metrics.Default)}
+	if *decisionLogStdout {
+		sinks = append(sinks, decisions.NewWriter(os.Stdout))
+	}
+	if *decisionLogFile != "" {
+		file, err := decisions.NewRotatingFile(*decisionLogFile, *decisionLogFileSize, *decisionLogFileBackups)
+		if err != nil {
+			log.Fatalf("failed to open decision log file: %s", err)
+		}
+		closers = append(closers, file)
+		sinks = append(sinks, file)
+	}
+	if *auditLogFile != "" {
+		if *auditLogKeyFile == "" {
+			log.Fatalf("-audit-log-key-file is required with -audit-log-file")
+		}
+		key, err := decisions.LoadAuditKey(*auditLogKeyFile)
+		if err != nil {
+			log.Fatalf("failed to load audit log key: %s", err)
+		}
+		audit, err := decisions.NewAuditLog(*auditLogFile, key, *auditLogCheckpointEvery)
+		if err != nil {
+			log.Fatalf("failed to open audit log: %s", err)
+		}
+		closers = append(closers, audit)
+		sinks = append(sinks, audit)
+	}
+	decisionLog := decisions.NewLog(sinks...)
+
+	var tracer *tracing.Tracer
+	if *traceFile != "" {
+		exporter, err := tracing.NewFileExporter(*traceFile)
+		if err != nil {
+			log.Fatalf("failed to open trace file: %s", err)
+		}
+		closers = append(closers, exporter)
+		tracer = tracing.NewTracer(exporter)
+	}
+
+	// each engine compiles its policies as its handlers are created, the
+	// server isn't ready until they're all loaded and compiled
+	engines := []string{"golang", "rego", "polar", "cue"}
+	health.Default.Enable(engines...)
+
 	r := mux.NewRouter()
 
-	r.HandleFunc("/golang/whoami", golang.WhoAmIHandler(&users)).Methods("GET")
-	r.HandleFunc("/rego/whoami", rego.WhoAmIHandler(&users)).Methods("GET")
-	r.HandleFunc("/polar/whoami", polar.WhoAmIHandler(&users)).Methods("GET")
-	r.HandleFunc("/cue/whoami", cue.WhoAmIHandler(&users)).Methods("GET")
+	// every request has an ID which is in its logs, decisions, spans and error
+	// responses. Requests are traced when enabled, with spans for each stage.
+	r.Use(
+		requestid.Middleware(),
+		tracing.Middleware(tracer),
+	)
+
+	// probes and scrapers don't authenticate, so these are kept out of the
+	// authentication middleware and can't be refused by its throttle
+	r.HandleFunc("/healthz", health.LivenessHandler(health.Default)).Methods("GET")
+	r.HandleFunc("/readyz", health.ReadinessHandler(health.Default)).Methods("GET")
+	r.HandleFunc("/metrics", metrics.Handler(metrics.Default)).Methods("GET")
+
+	// Decisions made while handling a request, including impersonation, are
+	// recorded in the decision log. Repeated checks are answered from the
+	// decision cache until the data or policies change.
+	// Requests are authenticated by the first authenticator to find
+	// credentials, handlers get the principal from the request context.
+	// Repeated failures from a client or for a user are throttled.
+	// Admins may then act as other users if the engine's policy permits it,
+	// and the principal is given the roles of the user it ends up as.
+	api := r.PathPrefix("/").Subrouter()
+	api.Use(
+		decisions.Middleware(decisionLog),
+		decisioncache.Middleware(decisioncache.New(*decisionCacheSize, metrics.Default)),
+		tracing.Stage("authn", authn.Middleware(authn.Throttled{
+			Throttle:       authn.NewThrottle(),
+			Authenticators: authenticators,
+		})),
+		tracing.Stage("impersonation", authn.Impersonation(map[string]authn.ImpersonationPolicy{
+			"golang": golang.ImpersonationPolicy(userStore),
+			"rego":   rego.ImpersonationPolicy(userStore),
+			"polar":  polar.ImpersonationPolicy(userStore),
+			"cue":    cue.ImpersonationPolicy(userStore),
+		}, nil)),
+		tracing.Stage("roles", authn.UserRoles(userStore)),
+	)
+
+	api.HandleFunc("/debug/decisions", decisions.DebugHandler(ring)).Methods("GET")
+	api.HandleFunc("/debug/authz/profile", profile.Handler(profile.Default, "rego", "polar", "cue")).Methods("GET")
+
+	api.HandleFunc("/login", authn.LoginHandler(userStore, sessions, cookieSession)).Methods("POST")
+	api.HandleFunc("/logout", authn.LogoutHandler(sessions, cookieSession)).Methods("POST")
+
+	api.HandleFunc("/golang/whoami", golang.WhoAmIHandler(userStore)).Methods("GET")
+	api.HandleFunc("/rego/whoami", rego.WhoAmIHandler(regoStore)).Methods("GET")
+	api.HandleFunc("/polar/whoami", polar.WhoAmIHandler(userStore)).Methods("GET")
+	api.HandleFunc("/cue/whoami", cue.WhoAmIHandler(userStore)).Methods("GET")
+
+	api.HandleFunc("/golang/entries/{entryID}", golang.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+	api.HandleFunc("/rego/entries/{entryID}", rego.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+	api.HandleFunc("/polar/entries/{entryID}", polar.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+	api.HandleFunc("/cue/entries/{entryID}", cue.GetEntryHandler(entryStore, &notebooks)).Methods("GET")
+
+	api.HandleFunc("/golang/entries/{entryID}", golang.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+	api.HandleFunc("/rego/entries/{entryID}", rego.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+	api.HandleFunc("/polar/entries/{entryID}", polar.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
+	api.HandleFunc("/cue/entries/{entryID}", cue.UpdateEntryHandler(entryStore, &notebooks, index)).Methods("PUT")
 
-	r.HandleFunc("/golang/entries/{id:[0-9]+}", golang.EntryHandler(&users, &entries)).Methods("GET")
+	api.HandleFunc("/golang/entries/{entryID}/revisions", golang.ListEntryRevisionsHandler(entryStore, &notebooks)).Methods("GET")
+	api.HandleFunc("/rego/entries/{entryID}/revisions", rego.ListEntryRevisionsHandler(entryStore, &notebooks)).Methods("GET")
+	api.HandleFunc("/polar/entries/{entryID}/revisions", polar.ListEntryRevisionsHandler(entryStore, &notebooks)).Methods("GET")
+	api.HandleFunc("/cue/entries/{entryID}/revisions", cue.ListEntryRevisionsHandler(entryStore, &notebooks)).Methods("GET")
+
+	api.HandleFunc("/golang/entries/{entryID}/revisions/{revisionID}", golang.GetEntryRevisionHandler(entryStore, &notebooks)).Methods("GET")
+	api.HandleFunc("/rego/entries/{entryID}/revisions/{revisionID}", rego.GetEntryRevisionHandler(entryStore, &notebooks)).Methods("GET")
+	api.HandleFunc("/polar/entries/{entryID}/revisions/{revisionID}", polar.GetEntryRevisionHandler(entryStore, &notebooks)).Methods("GET")
+	api.HandleFunc("/cue/entries/{entryID}/revisions/{revisionID}", cue.GetEntryRevisionHandler(entryStore, &notebooks)).Methods("GET")
+
+	api.HandleFunc("/golang/search", golang.SearchHandler(entryStore, &notebooks, index)).Methods("GET")
+	api.HandleFunc("/rego/search", rego.SearchHandler(entryStore, &notebooks, index)).Methods("GET")
+	api.HandleFunc("/polar/search", polar.SearchHandler(entryStore, &notebooks, index)).Methods("GET")
+	api.HandleFunc("/cue/search", cue.SearchHandler(entryStore, &notebooks, index)).Methods("GET")
+
+	api.HandleFunc("/golang/tokens", golang.CreateTokenHandler(tokens)).Methods("POST")
+	api.HandleFunc("/rego/tokens", rego.CreateTokenHandler(tokens)).Methods("POST")
+	api.HandleFunc("/polar/tokens", polar.CreateTokenHandler(tokens)).Methods("POST")
+	api.HandleFunc("/cue/tokens", cue.CreateTokenHandler(tokens)).Methods("POST")
+
+	api.HandleFunc("/golang/tokens", golang.ListTokensHandler(tokens)).Methods("GET")
+	api.HandleFunc("/rego/tokens", rego.ListTokensHandler(tokens)).Methods("GET")
+	api.HandleFunc("/polar/tokens", polar.ListTokensHandler(tokens)).Methods("GET")
+	api.HandleFunc("/cue/tokens", cue.ListTokensHandler(tokens)).Methods("GET")
+
+	api.HandleFunc("/golang/tokens/{tokenID}", golang.RevokeTokenHandler(tokens)).Methods("DELETE")
+	api.HandleFunc("/rego/tokens/{tokenID}", rego.RevokeTokenHandler(tokens)).Methods("DELETE")
+	api.HandleFunc("/polar/tokens/{tokenID}", polar.RevokeTokenHandler(tokens)).Methods("DELETE")
+	api.HandleFunc("/cue/tokens/{tokenID}", cue.RevokeTokenHandler(tokens)).Methods("DELETE")
+
+	for _, engine := range engines {
+		health.Default.Loaded(engine)
+	}
+	if report := health.Default.Report(); !report.Ready {
+		log.Printf("not ready, some policies failed to compile, see /readyz")
+	}
 
 	http.Handle("/", r)
+
+	// the servers run until the process is signalled to stop or one of them
+	// fails
 	srv := &http.Server{
 		Handler: r,
 		Addr:    "127.0.0.1:8000",
 	}
-	log.Printf("server started")
-	log.Fatal(srv.ListenAndServe())
+	servers := []*http.Server{srv}
+	errs := make(chan error, 2)
+	go func() {
+		log.Printf("server started")
+		errs <- srv.ListenAndServe()
+	}()
+
+	if *tlsCertFile != "" {
+		tlsConfig, err := authn.ClientCertTLSConfig(*tlsClientCAFile)
+		if err != nil {
+			log.Fatalf("failed to configure TLS: %s", err)
+		}
+		tlsSrv := &http.Server{
+			Handler:   r,
+			Addr:      *tlsAddr,
+			TLSConfig: tlsConfig,
+		}
+		servers = append(servers, tlsSrv)
+		go func() {
+			log.Printf("TLS server started")
+			errs <- tlsSrv.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	failed := false
+	select {
+	case sig := <-stop:
+		log.Printf("received %s, shutting down", sig)
+	case err := <-errs:
+		log.Printf("server failed: %s", err)
+		failed = true
+	}
+
+	// requests in flight are finished before the sinks they record their
+	// decisions and spans to are closed
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("failed to shut down server %s: %s", server.Addr, err)
+			failed = true
+		}
+	}
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			log.Printf("failed to close: %s", err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+	log.Printf("server stopped")
+}
+
+// mustJWTAuthenticator loads the key for verifying JWTs using the flags
+func mustJWTAuthenticator() authn.JWT {
+	var key interface{}
+	var err error
+	if *jwtAlgorithm == "HS256" {
+		key, err = authn.LoadHMACSecret(*jwtKeyFile)
+	} else {
+		key, err = authn.LoadPublicKey(*jwtKeyFile)
+	}
+	if err != nil {
+		log.Fatalf("failed to load JWT key: %s", err)
+	}
+
+	return authn.JWT{
+		Algorithm: *jwtAlgorithm,
+		Key:       key,
+		Issuer:    *jwtIssuer,
+		Audience:  *jwtAudience,
+		Leeway:    30 * time.Second,
+	}
+}
+
+// verifyAudit is the verify-audit subcommand, it checks the hash chain of an
+// audit log and its checkpoint with the log's key and reports the first broken
+// link
+func verifyAudit(args []string) int {
+	flags := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	checkpointFile := flags.String("checkpoint-file", "", "checkpoint of the chain head, defaults to the log file with a .checkpoint suffix")
+	keyFile := flags.String("key-file", "", "file holding the secret the chain is keyed with, required")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s verify-audit [flags] <audit log file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+	if *checkpointFile == "" {
+		*checkpointFile = decisions.CheckpointPath(path)
+	}
+	if *keyFile == "" {
+		flags.Usage()
+		return 2
+	}
+
+	key, err := decisions.LoadAuditKey(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load key: %s\n", err)
+		return 1
+	}
+
+	checkpoint, err := decisions.LoadAuditCheckpoint(*checkpointFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load checkpoint: %s\n", err)
+		return 1
+	}
+	if checkpoint == nil {
+		fmt.Fprintf(os.Stderr, "warning: no checkpoint, records removed from the end of the log can't be detected\n")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open audit log: %s\n", err)
+		return 1
+	}
+	defer file.Close()
+
+	report, err := decisions.VerifyAudit(file, key, checkpoint)
+	if err != nil {
+		fmt.Printf("broken: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("ok: %d records, head %s\n", report.Records, report.Head)
+	return 0
 }